@@ -0,0 +1,112 @@
+package main
+
+// Accessibility palettes
+//
+// -palette draws a pattern over the program cells of PNG images, so the structure of a program shows without telling
+// the cell colors apart. A cell is split into three stripes, one per channel, and every stripe gets the pattern of
+// the class of its token: dots for push literals, diagonal hatching for arithmetic and logic, horizontal lines for
+// the stack and memory, a cross hatch for comparisons and jumps and vertical lines for input and output. The
+// contrast palette inks the patterns black or white, whichever stands out more from the cell, the colorblind
+// palette with the Okabe-Ito color of the class, which stay apart with every kind of color blindness.
+// The patterns leave out the first pixel of the cell, the 3x3 pixels around its center, which the decoder samples,
+// and the grid lines, so the image still runs. Cells smaller than paletteMinCellsize get no patterns.
+
+import "image/color"
+
+// The accessibility palettes of -palette
+var accessPalettes = []string{"colorblind", "contrast"}
+
+// Smallest cell size with patterns
+const paletteMinCellsize = 9
+
+// The token classes
+const (
+	classNone = iota
+	classLiteral
+	classArithmetic
+	classStack
+	classControl
+	classIO
+)
+
+// tokenClasses maps the instructions to their classes, the others have no pattern
+var tokenClasses = map[string]int{
+	"add": classArithmetic, "sub": classArithmetic, "mul": classArithmetic, "div": classArithmetic, "rem": classArithmetic,
+	"not": classArithmetic, "or": classArithmetic, "and": classArithmetic, "neg": classArithmetic, "shl": classArithmetic,
+	"shr": classArithmetic, "addi1": classArithmetic, "addi2": classArithmetic, "addi3": classArithmetic,
+	"subi1": classArithmetic, "subi2": classArithmetic, "subi3": classArithmetic, "muli1": classArithmetic,
+	"muli2": classArithmetic, "muli3": classArithmetic,
+	"pop": classStack, "swap": classStack, "dup": classStack, "rot": classStack, "nip": classStack, "tuck": classStack,
+	"over": classStack, "pick": classStack, "depth": classStack, "roll": classStack, "alloc": classStack, "free": classStack,
+	"gt": classControl, "eq": classControl, "lt": classControl, "jgt": classControl, "jeq": classControl,
+	"jlt": classControl, "halt": classControl, "haltc": classControl, "jmpz": classControl, "jmpnz": classControl,
+	"outc": classIO, "outu": classIO, "outd": classIO, "inc": classIO, "poll": classIO, "outi": classIO, "ini": classIO,
+	"argc": classIO, "argn": classIO, "argb": classIO, "pusha": classIO, "waita": classIO, "sleep": classIO,
+	"fwd": classIO, "turn": classIO, "pen": classIO, "tcolor": classIO, "tone": classIO, "hostcall": classIO,
+}
+
+// Okabe-Ito colors of the classes in the colorblind palette
+var classColors = [...]color.RGBA{
+	classLiteral:    {R: 0xE6, G: 0x9F, B: 0x00, A: 255},
+	classArithmetic: {R: 0x56, G: 0xB4, B: 0xE9, A: 255},
+	classStack:      {R: 0x00, G: 0x9E, B: 0x73, A: 255},
+	classControl:    {R: 0xD5, G: 0x5E, B: 0x00, A: 255},
+	classIO:         {R: 0xCC, G: 0x79, B: 0xA7, A: 255},
+}
+
+// tokenClass returns the class of a token
+func tokenClass(token uint8) int {
+	if token&0b1000_0000 == 0 {
+		return classLiteral
+	}
+	return tokenClasses[mnemonic(token)]
+}
+
+// patterned tells if the cells of the size get patterns
+func (opts options) patterned(cellsize int) bool {
+	return len(opts.palette) > 0 && cellsize >= paletteMinCellsize
+}
+
+// patternInk returns the color of the pixel at x, y of a program cell, false if the pattern leaves it out
+func patternInk(palette string, cell color.RGBA, x int, y int, cellsize int) (color.RGBA, bool) {
+	center := cellsize / 2
+	if x == 0 && y == 0 || x == cellsize-1 || y == cellsize-1 || abs(x-center) <= 1 && abs(y-center) <= 1 {
+		return cell, false
+	}
+	// Repeat cells of -rle hold counts, not tokens
+	if cell.R == repeatToken {
+		return cell, false
+	}
+	stripe := min(x*3/(cellsize-1), 2)
+	class := tokenClass([3]uint8{cell.R, cell.G, cell.B}[stripe])
+	var ink bool
+	switch class {
+	case classLiteral:
+		ink = x%3 == 1 && y%3 == 1
+	case classArithmetic:
+		ink = (x+y)%4 == 0
+	case classStack:
+		ink = y%3 == 0
+	case classControl:
+		ink = (x+y)%4 == 0 || (x-y+cellsize)%4 == 0
+	case classIO:
+		ink = x%3 == 0
+	}
+	if !ink {
+		return cell, false
+	}
+	if palette == "colorblind" {
+		return classColors[class], true
+	}
+	if 299*int(cell.R)+587*int(cell.G)+114*int(cell.B) < 128000 {
+		return color.RGBA{R: 255, G: 255, B: 255, A: 255}, true
+	}
+	return color.RGBA{A: 255}, true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,188 @@
+package main
+
+// Static libraries, with "pollock ar -o lib.plka a.plko b.plko..."
+//
+// An archive bundles object files (see object.go), so a library of routines is a single file. It is the 8-byte
+// signature "\x89PLA\r\n\x1a\n" followed by chunks in the layout of PNG chunks:
+// plIx: the index, one "NAME MEMBER\n" line per label exported by a member, MEMBER counts the members from 0
+// plMb: a member, its file name, a NUL byte and the bytes of the object file, one chunk per member in order
+// pollock link takes archives after or between its images and objects, but doesn't link them whole: it pulls only
+// the members which export a label some linked image still needs (.extern), and the members those need in turn,
+// from the first archive on the command line which has it. Members are linked after the images, in the order
+// they are pulled. An archive can't have two members exporting the same label. The members are object files, which
+// are never signed, so pollock link -verify-key refuses archives as it refuses objects.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// File extension of archives
+const archiveExt = ".plka"
+
+var archiveSignature = []byte("\x89PLA\r\n\x1a\n")
+
+// archive is a read archive, index maps the exported labels to the members
+type archive struct {
+	name    string
+	members []string
+	objects []compiled
+	index   map[string]int
+}
+
+// registerAr registers the flags of the ar subcommand
+func registerAr(flags *flag.FlagSet, outputfile *string) {
+	flags.StringVar(outputfile, "o", "", "Output file name of the archive, mandatory")
+	flags.BoolVar(&silent, "s", false, "Run in silent mode, default is false")
+}
+
+// readArchive reads an archive and the objects of its members
+func readArchive(name string, data []byte) (archive, error) {
+	a := archive{name: name, index: make(map[string]int)}
+	chunks, err := chunkList(data)
+	if err != nil {
+		return a, verifyError(fmt.Sprint("Fatal error: Invalid archive \"", name, "\": ", err))
+	}
+	for _, chunk := range chunks {
+		switch chunk.name {
+		case "plIx":
+			for _, line := range strings.Split(strings.TrimSpace(string(chunk.data)), "\n") {
+				label, member, ok := strings.Cut(line, " ")
+				i, err := strconv.Atoi(member)
+				if len(line) > 0 && (!ok || err != nil || i < 0) {
+					return a, verifyError(fmt.Sprint("Fatal error: Invalid archive \"", name, "\": invalid index \"", line, "\""))
+				}
+				if len(line) > 0 {
+					a.index[label] = i
+				}
+			}
+		case "plMb":
+			member, object, ok := bytes.Cut(chunk.data, []byte{0})
+			var c compiled
+			if ok {
+				c, err = decodeObject(object)
+			}
+			if !ok || err != nil {
+				return a, verifyError(fmt.Sprint("Fatal error: Invalid member \"", string(member), "\" of archive \"", name, "\": ", err))
+			}
+			a.members = append(a.members, string(member))
+			a.objects = append(a.objects, c)
+		}
+	}
+	for label, i := range a.index {
+		if i >= len(a.members) {
+			return a, verifyError(fmt.Sprint("Fatal error: Invalid archive \"", name, "\": label \"", label, "\" of missing member ", i))
+		}
+	}
+	return a, nil
+}
+
+// pullMembers returns the archive members which export the labels the images still need, with their names
+func pullMembers(images []compiled, archives []archive) ([]compiled, []string) {
+	var pulled []compiled
+	var names []string
+	exported := make(map[string]bool)
+	taken := make(map[string]bool)
+	for _, img := range images {
+		for _, export := range img.exports {
+			exported[export] = true
+		}
+	}
+	// The pulled members may need more members
+	queue := slices.Clone(images)
+	for i := 0; i < len(queue); i++ {
+		for _, r := range queue[i].relocs {
+			if r.address != externAddress || exported[r.label] {
+				continue
+			}
+			for _, a := range archives {
+				member, ok := a.index[r.label]
+				if !ok {
+					continue
+				}
+				name := fmt.Sprint(a.name, "(", a.members[member], ")")
+				if !taken[name] {
+					taken[name] = true
+					logWrapper(fmt.Sprint("Pulling ", name, " for label \"", r.label, "\"."))
+					pulled = append(pulled, a.objects[member])
+					names = append(names, name)
+					queue = append(queue, a.objects[member])
+					for _, export := range a.objects[member].exports {
+						exported[export] = true
+					}
+				}
+				break
+			}
+		}
+	}
+	return pulled, names
+}
+
+// ar parses the flags of the ar subcommand, writes the archive and returns the exit code
+func ar(args []string) int {
+	var outputfile string
+
+	flags := flag.NewFlagSet("ar", flag.ExitOnError)
+	registerAr(flags, &outputfile)
+	flags.Parse(args)
+	err := applyEnv(flags)
+	if err == nil && len(outputfile) == 0 {
+		err = usageError("Fatal error: Output file is required.")
+	}
+	if err == nil && flags.NArg() < 1 {
+		err = usageError("Fatal error: At least one object file is needed.")
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+
+	var index, members bytes.Buffer
+	owners := make(map[string]string)
+	for i, name := range flags.Args() {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			err = ioError(fmt.Sprint("Fatal error: \"", err, "\""))
+		} else if !bytes.HasPrefix(data, objectSignature) {
+			err = usageError(fmt.Sprint("Fatal error: \"", name, "\" is not an object file, compile it with -format plko."))
+		}
+		var c compiled
+		if err == nil {
+			if c, err = decodeObject(data); err != nil {
+				err = verifyError(fmt.Sprint("Fatal error: Invalid object file \"", name, "\": ", err))
+			}
+		}
+		for _, export := range c.exports {
+			if err == nil && len(owners[export]) > 0 {
+				err = usageError(fmt.Sprint("Fatal error: Label \"", export, "\" of \"", name, "\" is already exported by \"", owners[export], "\"."))
+			}
+			owners[export] = name
+			fmt.Fprintln(&index, export, i)
+		}
+		if err != nil {
+			log.Println(err)
+			return exitCode(err)
+		}
+		member := append([]byte(filepath.Base(name)+"\x00"), data...)
+		writeChunk(&members, pngChunk{name: "plMb", data: member})
+		logWrapper(fmt.Sprint("Added ", name, " with ", len(c.exports), " exported labels."))
+	}
+	var buf bytes.Buffer
+	buf.Write(archiveSignature)
+	writeChunk(&buf, pngChunk{name: "plIx", data: index.Bytes()})
+	buf.Write(members.Bytes())
+	logWrapper(fmt.Sprint("Creating archive of ", flags.NArg(), " members: ", outputfile))
+	if err := os.WriteFile(outputfile, buf.Bytes(), 0o644); err != nil {
+		err = ioError(fmt.Sprint("Fatal create error: \"", err, "\""))
+		log.Println(err)
+		return exitCode(err)
+	}
+	return exitOK
+}
@@ -0,0 +1,419 @@
+package main
+
+// Assembler phases
+//
+// compile runs the source through four phases, each handing the next an explicit structure:
+//   lex      splits the source into sourceLines: blank, comment, pragma, include, contract, directive or code lines, with
+//            the label of the line and the instruction items of code lines, and the lines of the included files
+//            after their #include lines (see include.go)
+//   parse    turns the lines into statements: the tokens of the line in whole cells, with the label arguments
+//            among them as labelRefs, and applies the pragmas and the directives; nothing has an address yet
+//   place    lays the statements out as program cells, pads the aligned ones and gives the labels their
+//            addresses, and returns the label arguments as fixups of cells
+//   resolve  fills the fixups in with the addresses, writes the entry point and checks the .export labels
+// encode then applies -werror, -stats, -shuffle-key, -rle and the painting modes. A pass over the statements, e.g. an optimization or a
+// macro expansion, fits between parse and place, where labels are still names (see optimize.go).
+// Syntax errors found by the lexer are kept in their line and raised by the parser, so the errors and warnings
+// come in the order of the lines.
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Kinds of source lines
+const (
+	lineBlank = iota
+	lineComment
+	linePragma
+	lineInclude
+	lineContract
+	lineDirective
+	lineCode
+)
+
+// sourceLine is a line of the source after lexing, text is the raw line of pragmas, the directive or the
+// instructions after the label otherwise, file is the index of its file in the files of the compilation
+type sourceLine struct {
+	file   int
+	lineno int
+	kind   int
+	label  string
+	text   []byte
+	items  [][]byte
+	err    error
+}
+
+// labelRef is a label argument of a statement, index is its token, relative ones are counted from the pusha
+// token before them
+type labelRef struct {
+	index    int
+	label    string
+	part     int
+	item     int
+	relative bool
+}
+
+// statement is a parsed line, the label is defined after the padding of .align and before the cells, reserved
+// cells of .space are kept as they are by -O
+type statement struct {
+	file     int
+	lineno   int
+	label    string
+	align    int64
+	filler   uint8
+	tokens   []uint8
+	refs     []labelRef
+	reserved bool
+}
+
+// lex splits the source into lines and classifies them
+func (c *compiled) lex(file []byte) []sourceLine {
+	c.files = []sourceFile{{name: c.opts.sourceName}}
+	return c.lexFile(0, file, []int{0})
+}
+
+// lexFile splits a file of the compilation into lines, stack holds the files including it and the file itself
+func (c *compiled) lexFile(index int, file []byte, stack []int) []sourceLine {
+	commentLine, _ := regexp.Compile(`(?m)^\s*#.*$`)
+	emptyLine, _ := regexp.Compile(`(?m)^$`)
+	label, _ := regexp.Compile(`[A-Z][A-Z0-9]{0,6}`)
+
+	fileLines := bytes.Split(file, []byte("\n"))
+	c.files[index].source = fileLines
+	c.files[index].labels = make(map[int]string)
+	c.setFile(index)
+	lines := make([]sourceLine, 0, len(fileLines))
+	for lineno, lineStr := range fileLines {
+		line := sourceLine{file: index, lineno: lineno}
+		var included []sourceLine
+		switch {
+		case emptyLine.Match(lineStr) || lineStr[0] == 13:
+			// This is an empty line, skipping it
+			c.opts.logMsg(fmt.Sprint("Empty line detected at line: ", lineno+1, ". Skipping."))
+		case commentLine.Match(lineStr):
+			// This is a comment line, skipping it, unless it is a pragma which changes the options
+			line.kind = lineComment
+			if isPragma(lineStr) {
+				line.kind, line.text = linePragma, lineStr
+			} else if isInclude(lineStr) {
+				line.kind = lineInclude
+				included, line.err = c.include(lineno, lineStr, stack)
+			} else if isContract(lineStr) {
+				line.kind, line.text = lineContract, lineStr
+			}
+		default:
+			lineStr = cleanLine(lineStr)
+			labeledItems := splitOutsideQuotes(lineStr, ':')
+			if len(labeledItems) > 2 {
+				line.err = c.syntaxError(lineno, wholeLine, "label-multiple", c.opts.message("label-multiple", lineno+1))
+			} else if len(labeledItems) == 2 {
+				if len(labeledItems[0]) >= 1 && len(labeledItems[0]) <= 7 && label.Match(labeledItems[0]) {
+					c.opts.logMsg(fmt.Sprint("Label detected: ", string(labeledItems[0]), " in line: ", lineno+1, "."))
+					line.label = string(labeledItems[0])
+					c.files[index].labels[lineno] = line.label
+				} else if len(labeledItems[0]) == 0 {
+					line.err = c.syntaxError(lineno, labelItem, "label-empty", c.opts.message("label-empty", lineno+1))
+				} else {
+					line.err = c.syntaxError(lineno, labelItem, "label-invalid", c.opts.message("label-invalid", string(labeledItems[0]), lineno+1))
+				}
+				lineStr = labeledItems[1]
+			}
+			line.kind, line.text = lineCode, lineStr
+			if len(lineStr) > 0 && lineStr[0] == '.' {
+				line.kind = lineDirective
+			} else {
+				line.items = splitOutsideQuotes(lineStr, ';')
+			}
+		}
+		lines = append(lines, line)
+		lines = append(lines, included...)
+	}
+	return lines
+}
+
+// parse turns the lines into statements
+func (c *compiled) parse(lines []sourceLine) ([]statement, error) {
+	var status *progress
+	if c.opts.progress {
+		status = newProgress("Compiling lines", len(lines))
+		defer status.finish()
+	}
+	var statements []statement
+	defined := make(map[string]bool)
+	// Cells so far, the option pragmas must come before the first one
+	cells := 0
+	// The stack contract waiting for its label
+	var contract *stackContract
+	for _, line := range lines {
+		status.add(1)
+		c.setFile(line.file)
+		switch line.kind {
+		case lineBlank, lineComment:
+			continue
+		case linePragma:
+			c.pragma(line.lineno, line.text, cells > 0)
+			continue
+		case lineContract:
+			if parsed, ok := c.parseContract(line); ok {
+				contract = &parsed
+			}
+			continue
+		}
+		if line.err != nil {
+			return nil, line.err
+		}
+		if line.kind == lineInclude {
+			continue
+		}
+		if len(line.label) > 0 {
+			if defined[line.label] {
+				return nil, c.syntaxError(line.lineno, labelItem, "label-duplicate", c.opts.message("label-duplicate", line.label, line.lineno+1))
+			}
+			defined[line.label] = true
+		}
+		if contract != nil {
+			if len(line.label) > 0 && contract.file == line.file {
+				c.contracts[line.label] = *contract
+			} else {
+				c.setFile(contract.file)
+				c.warn(contract.lineno, "", wholeLine, "contract-invalid", c.opts.message("contract-misplaced", contract.lineno+1))
+				c.setFile(line.file)
+			}
+			contract = nil
+		}
+		s := statement{file: line.file, lineno: line.lineno, label: line.label}
+		if line.kind == lineDirective {
+			var err error
+			if s, err = c.directive(s, line.text); err != nil {
+				return nil, err
+			}
+		} else {
+			s.tokens, s.refs = c.parseCode(line)
+		}
+		for s.align > 0 && int64(cells+2)%s.align != 0 {
+			cells++
+		}
+		cells += len(s.tokens) / 3
+		statements = append(statements, s)
+	}
+	if contract != nil {
+		c.setFile(contract.file)
+		c.warn(contract.lineno, "", wholeLine, "contract-invalid", c.opts.message("contract-misplaced", contract.lineno+1))
+	}
+	return statements, nil
+}
+
+// parseCode returns the tokens of the instructions of a code line in whole cells, and its label arguments
+func (c *compiled) parseCode(line sourceLine) ([]uint8, []labelRef) {
+	lineno, opts := line.lineno, c.opts
+	var token uint8
+	var refs []labelRef
+	// A line is normally one cell, but pseudo-instructions may expand into more instructions,
+	// so the tokens of the line are collected first and split into cells afterwards
+	var lineTokens []uint8
+	for instrNum, instr := range line.items {
+		if instrNum > 2 {
+			if len(instr) > 0 {
+				// This is an extra instruction, we will skip it
+				c.warn(lineno, "", instrNum, "extra-text", c.opts.message("extra-text", string(instr), lineno+1))
+			}
+			continue
+		}
+		if len(instr) == 0 {
+			c.warn(lineno, colChannel(instrNum), instrNum, "empty-instr", c.opts.message("empty-instr", lineno+1, colChannel(instrNum)))
+			token, _ = tokenize([]byte("nop"))
+			lineTokens = append(lineTokens, token)
+			continue
+		}
+		expanded, err := expand(instr, opts.targetMinor, opts.wordsize)
+		if err != nil {
+			switch err {
+			case strLitInvalid:
+				c.warn(lineno, colChannel(instrNum), instrNum, "string-invalid", c.opts.message("string-invalid", lineno+1, colChannel(instrNum)))
+			case strLitOutOfRange:
+				c.warn(lineno, colChannel(instrNum), instrNum, "string-range", c.opts.message("string-range", lineno+1, colChannel(instrNum)))
+			}
+		} else if len(expanded) > 1 {
+			opts.logMsg(fmt.Sprint("Expanded \"", string(instr), "\" in line: ", lineno+1, ", position: ", colChannel(instrNum), " into ", len(expanded), " instructions."))
+		}
+		for _, item := range expanded {
+			if opts.release && string(item) == "outd" {
+				// Debug prints are compiled out
+				item = []byte("nop")
+			}
+			token, err = tokenize(item)
+			if err != nil {
+				switch err {
+				case unknownOp:
+					c.warn(lineno, colChannel(instrNum), instrNum, "unknown-op", c.opts.message("unknown-op", string(item), lineno+1, colChannel(instrNum)))
+				case pushOpWOArg:
+					c.warn(lineno, colChannel(instrNum), instrNum, "push-no-arg", c.opts.message("push-no-arg", lineno+1, colChannel(instrNum)))
+				case pushOpArgOutOfRange:
+					c.warn(lineno, colChannel(instrNum), instrNum, "push-range", c.opts.message("push-range", lineno+1, colChannel(instrNum)))
+				case pushOpArgInvalid:
+					c.warn(lineno, colChannel(instrNum), instrNum, "push-invalid", c.opts.message("push-invalid", lineno+1, colChannel(instrNum)))
+				case pushOpLabel:
+					labelName, labelPart, _ := strings.Cut(string(item[4:]), "_")
+					part, _ := strconv.Atoi(labelPart)
+					refs = append(refs, labelRef{index: len(lineTokens), label: labelName, part: part, item: instrNum})
+				case pushOpRelative:
+					if len(lineTokens) == 0 || lineTokens[len(lineTokens)-1] != pushaToken {
+						c.warn(lineno, colChannel(instrNum), instrNum, "push-invalid", c.opts.message("push-invalid", lineno+1, colChannel(instrNum)))
+						break
+					}
+					refs = append(refs, labelRef{index: len(lineTokens), label: string(item[5:]), item: instrNum, relative: true})
+				}
+			}
+			if tokenMinor(token) > c.minor {
+				c.minor = tokenMinor(token)
+				opts.logMsg(fmt.Sprint("Instruction \"", string(item), "\" in line: ", lineno+1, " needs format version ", VMAJOR, ".", c.minor, "."))
+			}
+			lineTokens = append(lineTokens, token)
+		}
+	}
+	// If the last cell of the line is not full, we need to fill the other channels with nop
+	for len(lineTokens)%3 != 0 {
+		c.warn(lineno, colChannel(len(lineTokens)%3), len(line.items), "missing-instr", c.opts.message("missing-instr", lineno+1, colChannel(len(lineTokens)%3)))
+		token, _ = tokenize([]byte("nop"))
+		lineTokens = append(lineTokens, token)
+	}
+	return lineTokens, refs
+}
+
+// place lays the statements out as program cells, defines the labels and returns the label arguments as fixups
+// The word size extension cell comes first, before the entry point of resolve
+func (c *compiled) place(statements []statement) []fixup {
+	var fixups []fixup
+	for _, s := range statements {
+		if s.align > 0 {
+			padding := 0
+			for int64(c.progline+2)%s.align != 0 {
+				c.appendCell(s.filler, s.filler, s.filler)
+				padding++
+			}
+			c.opts.logMsg(fmt.Sprint("Aligned to ", s.align, " with ", padding, " cells in line: ", s.lineno+1, "."))
+		}
+		if len(s.label) > 0 {
+			c.labels[s.label] = c.progline + 2
+		}
+		first := c.progline
+		for i := 0; i < len(s.tokens); i += 3 {
+			c.appendCell(s.tokens[i], s.tokens[i+1], s.tokens[i+2])
+		}
+		for len(c.cellLines) < c.progline {
+			c.cellLines = append(c.cellLines, s.lineno)
+			c.cellFiles = append(c.cellFiles, s.file)
+		}
+		if s.reserved && len(s.tokens) > 0 && mnemonic(s.tokens[0]) == "nop" {
+			// The cells of .space without a filler instruction hold data
+			for cell := first; cell < c.progline; cell++ {
+				c.dataCells[cell] = true
+			}
+		}
+		for _, ref := range s.refs {
+			f := fixup{cell: first + ref.index/3, channel: ref.index % 3, label: ref.label, part: ref.part, file: s.file, lineno: s.lineno, item: ref.item}
+			if ref.relative {
+				// The cell of the pusha before, which -O may have packed into the cell before the statement
+				f.base = first + (ref.index+2)/3 - 1 + 2
+			}
+			fixups = append(fixups, f)
+		}
+	}
+	c.opts.logMsg(fmt.Sprint("Program array filled with ", c.progline, " instructions."))
+	if c.opts.wordsize != 8 {
+		// Wider words are recorded in an extension cell, which needs 1.1
+		c.extensions = append(c.extensions, [3]uint8{extWordSize, 0, uint8(c.opts.wordsize)})
+		if c.minor < 1 {
+			c.minor = 1
+			c.opts.logMsg(fmt.Sprint("Word size ", c.opts.wordsize, " needs format version ", VMAJOR, ".", c.minor, "."))
+		}
+	}
+	return fixups
+}
+
+// resolve fills the label arguments in, now that every label has an address, and checks the .start and
+// .export labels
+func (c *compiled) resolve(fixups []fixup) error {
+	for _, f := range fixups {
+		c.setFile(f.file)
+		address, ok := c.labels[f.label]
+		if f.base > 0 {
+			if !ok {
+				return c.syntaxError(f.lineno, f.item, "label-undefined", c.opts.message("label-undefined-pusha", f.label, f.lineno+1))
+			}
+			if distance, ok := c.program.relative(f, address); !ok {
+				return c.syntaxError(f.lineno, f.item, "label-range", c.opts.message("label-range-pusha", f.label, distance, f.lineno+1, colChannel(f.channel)))
+			}
+			continue
+		}
+		if !ok && slices.Contains(c.externs, f.label) {
+			// Filled in by the linker
+			c.relocs = append(c.relocs, reloc{cell: f.cell, channel: f.channel, part: f.part, address: externAddress, label: f.label})
+			continue
+		}
+		if !ok {
+			return c.syntaxError(f.lineno, f.item, "label-undefined", c.opts.message("label-undefined", f.label, f.lineno+1))
+		}
+		if f.part > 0 || address <= 0b0111_1111 {
+			c.relocs = append(c.relocs, reloc{cell: f.cell, channel: f.channel, part: f.part, address: address, label: f.label})
+		}
+		if f.part > 0 {
+			address = (address >> (7 * (f.part - 1))) & 0b0111_1111
+		} else if address > 0b0111_1111 {
+			return c.syntaxError(f.lineno, f.item, "label-range", c.opts.message("label-range", address, f.label, f.lineno+1, colChannel(f.channel), groupPushes(c.opts, f.label, address)))
+		}
+		c.program.set(f.cell, f.channel, uint8(address))
+	}
+	c.opts.logMsg(fmt.Sprint("Resolved ", len(fixups), " label arguments."))
+	if err := c.resolveStart(); err != nil {
+		return err
+	}
+	return c.resolveExports()
+}
+
+// encode applies the options which change the written cells
+func (c *compiled) encode() error {
+	opts := c.opts
+	if opts.werror && len(c.diagnostics) > 0 {
+		id := "werror"
+		if len(c.diagnostics) == 1 {
+			id = "werror-one"
+		}
+		return &codedError{exit: exitSyntax, code: "werror", msg: c.opts.message(id, len(c.diagnostics))}
+	}
+	if opts.stats {
+		c.writeStats(opts.output())
+	}
+	if len(opts.shuffleKey) > 0 {
+		if err := c.shuffle(opts.shuffleKey); err != nil {
+			return err
+		}
+	}
+	if opts.rle && c.minor < 1 {
+		// Repeat cells need 1.1
+		c.minor = 1
+		opts.logMsg(fmt.Sprint("Run-length encoding needs format version ", VMAJOR, ".", c.minor, "."))
+	}
+	if modes := opts.artModes(); modes > 0 {
+		// Only the center pixels of painted cells hold the colors
+		c.extensions = append(c.extensions, [3]uint8{extArt, 0, uint8(modes)})
+		if c.minor < 1 {
+			c.minor = 1
+			opts.logMsg(fmt.Sprint("Painted cells need format version ", VMAJOR, ".", c.minor, "."))
+		}
+	}
+	if opts.orient {
+		c.extensions = append(c.extensions, [3]uint8{extOrientation, orientationMark >> 8, orientationMark & 0xFF})
+		if c.minor < 1 {
+			c.minor = 1
+			opts.logMsg(fmt.Sprint("The orientation cell needs format version ", VMAJOR, ".", c.minor, "."))
+		}
+	}
+	opts.logMsg(fmt.Sprint("Format version: ", VMAJOR, ".", c.minor))
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+// Background artwork
+//
+// -background FILE draws the program over a PNG, JPEG or GIF artwork, which is stretched over the whole image:
+// every pixel of a program cell but its center one is blended with the artwork pixel under it, -blend is the share
+// of the artwork, from 0 for the flat cell colors to 1 for the artwork alone, and the empty cells at the end of the
+// grid show the artwork unblended. The pixels are painted like those of -jitter (see paint.go), whose noise is
+// blended too.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+)
+
+// Default share of the artwork with -background
+const defaultBlend = 0.5
+
+// background is the artwork of -background, with the hash of its file for pollock build
+type background struct {
+	img   image.Image
+	sum   string
+	blend float64
+}
+
+// loadBackground reads the artwork of -background
+func loadBackground(name string, blend float64) (*background, error) {
+	if blend < 0 || blend > 1 {
+		return nil, usageError("Fatal error: The blend must be between 0 and 1.")
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, ioError(fmt.Sprint("Fatal error: \"", err, "\""))
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, usageError(fmt.Sprint("Fatal error: Invalid background \"", name, "\": ", err))
+	}
+	if img.Bounds().Empty() {
+		return nil, usageError(fmt.Sprint("Fatal error: Background \"", name, "\" is empty."))
+	}
+	sum := sha256.Sum256(data)
+	return &background{img: img, sum: hex.EncodeToString(sum[:]), blend: blend}, nil
+}
+
+// at returns the artwork pixel under the pixel x, y of an image of the size
+func (b *background) at(x int, y int, width int, height int) color.NRGBA {
+	bounds := b.img.Bounds()
+	return color.NRGBAModel.Convert(b.img.At(bounds.Min.X+x*bounds.Dx()/width, bounds.Min.Y+y*bounds.Dy()/height)).(color.NRGBA)
+}
+
+// over returns the ink blended with the artwork pixel under the pixel x, y of an image of the size
+func (b *background) over(ink color.RGBA, x int, y int, width int, height int) color.RGBA {
+	art := b.at(x, y, width, height)
+	// The artwork counts as much as it is opaque
+	share := b.blend * float64(art.A) / 255
+	channel := func(ink uint8, art uint8) uint8 {
+		return uint8(float64(ink)*(1-share) + float64(art)*share + 0.5)
+	}
+	return color.RGBA{R: channel(ink.R, art.R), G: channel(ink.G, art.G), B: channel(ink.B, art.B), A: ink.A}
+}
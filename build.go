@@ -0,0 +1,519 @@
+package main
+
+// Batch compilation, with "pollock build [flags] patterns..." or a pattern in -f
+//
+// A pattern can be a .plk file, a directory (its .plk files), a directory followed by /... (its .plk files
+// and those of all its subdirectories) or a glob pattern like progs/*.plk. Every file is compiled to a .png
+// next to it, then a summary is printed, and the exit code is that of the first failed file, 0 if none failed.
+// The files are compiled in parallel, by as many workers as GOMAXPROCS, and the messages of each file are
+// printed together, in the order of the file names.
+//
+// Next to every image a .hash file keeps the hash of the source, the options and the compiler version it was built
+// with, and those of the files it includes. If they did not change and the image is still there, the file is reported as up to date and not compiled again (unless -a).
+// Dry runs and byte array output always compile.
+//
+// With -outdir the images (and their .hash files) are written into that directory instead, named after the
+// sources without their directories, so two sources with the same name can't be built together.
+//
+// Without patterns, in a directory with a pollock.toml, or with the manifest as the only pattern, the targets of the
+// manifest are built instead, see manifest.go.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// buildFlags holds the flags shared by the default command and the build subcommand
+type buildFlags struct {
+	dryrun     bool
+	bytearray  bool
+	force      bool
+	progress   bool
+	cellsize   int
+	target     string
+	wordsize   int
+	outdir     string
+	werror     bool
+	nowarn     map[string]*bool
+	symbols    bool
+	reloc      bool
+	includes   dirList
+	cache      string
+	offline    bool
+	sign       string
+	shuffle    string
+	rle        bool
+	orient     bool
+	patch      bool
+	optimize   bool
+	release    bool
+	stats      bool
+	preview    bool
+	inline     string
+	format     string
+	grid       string
+	dpi        int
+	printW     float64
+	teach      bool
+	palette    string
+	jitter     int
+	background string
+	blend      float64
+	filler     string
+	sarif      string
+	lang       string
+}
+
+func (bf *buildFlags) register(flags *flag.FlagSet) {
+	flags.BoolVar(&bf.dryrun, "d", false, "Run in dry run mode, default is false")
+	flags.BoolVar(&silent, "s", false, "Run in silent mode, default is false")
+	flags.BoolVar(&bf.bytearray, "b", false, "Output only a bytes in text format, default is false")
+	flags.BoolVar(&bf.force, "a", false, "Rebuild the files of a batch even if they are up to date, default is false")
+	flags.BoolVar(&bf.preview, "preview", false, "Print the cell grid in the terminal with ANSI colors, default is false")
+	flags.StringVar(&bf.inline, "inline", "", "Print the image in the terminal with a graphics protocol, auto, sixel, iterm or kitty, default is none")
+	flags.BoolVar(&bf.progress, "progress", false, "Show a progress line on stderr during long compiles, default is false")
+	flags.IntVar(&bf.cellsize, "c", 10, "Cell size in pixels, 2 to 1024, sizes over 255 need format 1.1, default is 10")
+	flags.StringVar(&bf.target, "t", "1.0", "Target format version, 1.0 or 1.1, default is 1.0")
+	flags.IntVar(&bf.wordsize, "wordsize", 8, "Word size of the stack cells in bits, 8, 16 or 32, default is 8")
+	flags.StringVar(&bf.format, "format", "png", "Format of the default output file names, png, svg, pdf or plko (object files for pollock link), default is png")
+	flags.IntVar(&bf.dpi, "dpi", defaultDPI, "Resolution of PDF images in pixels per inch, which sets their print size, default is 300")
+	flags.Float64Var(&bf.printW, "print-width", 0, "Print width of PDF images in millimeters, default is their width at -dpi")
+	flags.BoolVar(&bf.teach, "teach", false, "Write a companion image with the mnemonics of the cells, NAME.teach.png, default is false")
+	flags.StringVar(&bf.palette, "palette", "", "Accessibility palette of the opcode patterns in PNG images, colorblind or contrast, default is none")
+	flags.IntVar(&bf.jitter, "jitter", 0, "Amplitude of the color noise of the program cells in PNG images, 1 to 255, the center pixels keep the exact colors, needs format 1.1, default is 0 for flat cells")
+	flags.StringVar(&bf.background, "background", "", "PNG, JPEG or GIF artwork to draw the program over in PNG images, needs format 1.1, default is none")
+	flags.Float64Var(&bf.blend, "blend", defaultBlend, "Share of the -background artwork in the program cells, 0 to 1, default is 0.5")
+	flags.StringVar(&bf.filler, "filler", "", "Generative art in the nop cells and the empty cells of PNG images, drip or splatter, drawn from the program, needs format 1.1, default is none")
+	flags.BoolVar(&bf.patch, "patch", false, "Draw only the cells which changed since the existing output image of PNG images, keeping the painting of the others, default is false")
+	flags.StringVar(&bf.grid, "grid", "", "Color of the cell borders, RRGGBB, drawn in PNG images with a cell size of 4 or more, default is none")
+	flags.StringVar(&bf.outdir, "outdir", "", "Directory of the output files, default is next to the input files")
+	flags.StringVar(&bf.lang, "lang", "en", "Language of the warnings and syntax errors, en or hu, default is en")
+	flags.StringVar(&bf.sarif, "sarif", "", "Write the warnings and errors into a SARIF log, for code scanning tools, default is none")
+	flags.Var(&bf.includes, "I", "Directory to search the included files in, after the directory of the including file, can be given more than once, default is none")
+	flags.StringVar(&bf.cache, "cache", "", "Cache directory of the remote includes, default is pollock in the user cache directory")
+	flags.BoolVar(&bf.offline, "offline", false, "Don't fetch the remote includes, they must be in the cache, default is false")
+	flags.BoolVar(&bf.werror, "Werror", false, "Treat warnings as errors, default is false")
+	flags.StringVar(&bf.sign, "sign", "", "Ed25519 private key in PEM format to sign the images with, default is no signature")
+	flags.StringVar(&bf.shuffle, "shuffle", "", "Shuffle the program cells with the key, which is needed to read the images back, default is no shuffling")
+	flags.BoolVar(&bf.optimize, "O", false, "Optimize the program, folding the constant expressions, replacing the multiplications by powers of two with shifts, dropping the values popped right away and threading the jumps, default is false")
+	flags.BoolVar(&bf.release, "release", false, "Assemble the outd debug prints to nop, default is false")
+	flags.BoolVar(&bf.stats, "stats", false, "Print the instruction counts, the nop density, the basic blocks, the labels, the jumps and the entropy of the program, default is false")
+	flags.BoolVar(&bf.rle, "rle", false, "Run-length encode the runs of identical cells, needs format 1.1, default is false")
+	flags.BoolVar(&bf.orient, "orient", false, "Add an orientation cell, so the images can be read after they are rotated or mirrored, needs format 1.1, default is false")
+	flags.BoolVar(&bf.symbols, "symbols", false, "Embed the label addresses and the relocation table for pollock extract, default is false")
+	flags.BoolVar(&bf.reloc, "reloc", false, "Embed the relocation table, so the image can be rebased and linked after other images, default is false")
+	bf.nowarn = make(map[string]*bool)
+	for _, w := range warningCodes {
+		bf.nowarn[w.code] = flags.Bool("Wno-"+w.code, false, "Disable the "+w.help+" warning, default is false")
+	}
+}
+
+// warnings sets the warning options of the compilation from the flags
+func (bf *buildFlags) warnings(opts *options) {
+	opts.werror = bf.werror
+	opts.nowarn = make(map[string]bool)
+	for code, disabled := range bf.nowarn {
+		if *disabled {
+			opts.nowarn[code] = true
+		}
+	}
+}
+
+// apply sets the options of the compilation from the flags
+func (bf *buildFlags) apply(opts *options) error {
+	bf.warnings(opts)
+	if !slices.Contains(languages, bf.lang) {
+		return usageError(fmt.Sprint("Fatal error: Unknown language \"", bf.lang, "\", must be ", strings.Join(languages, " or "), "."))
+	}
+	opts.lang = bf.lang
+	opts.symbols = bf.symbols
+	opts.reloc = bf.reloc
+	opts.includeDirs = bf.includes
+	opts.cacheDir, opts.offline = bf.cache, bf.offline
+	opts.shuffleKey = bf.shuffle
+	opts.rle = bf.rle
+	opts.orient = bf.orient
+	opts.optimize = bf.optimize
+	opts.release = bf.release
+	opts.stats = bf.stats
+	opts.teach = bf.teach
+	if !slices.Contains(outputFormats, bf.format) {
+		return usageError(fmt.Sprint("Fatal error: Unknown output format \"", bf.format, "\", must be ", strings.Join(outputFormats, " or "), "."))
+	}
+	if bf.dpi <= 0 || bf.printW < 0 {
+		return usageError("Fatal error: The resolution and the print width must be positive.")
+	}
+	opts.dpi, opts.printWidth = bf.dpi, bf.printW
+	if len(bf.palette) > 0 && !slices.Contains(accessPalettes, bf.palette) {
+		return usageError(fmt.Sprint("Fatal error: Unknown palette \"", bf.palette, "\", must be ", strings.Join(accessPalettes, " or "), "."))
+	}
+	opts.palette = bf.palette
+	if bf.jitter < 0 || bf.jitter > maxJitter {
+		return usageError(fmt.Sprint("Fatal error: The jitter must be between 0 and ", maxJitter, "."))
+	}
+	opts.jitter = bf.jitter
+	if len(bf.filler) > 0 && !slices.Contains(fillerStyles, bf.filler) {
+		return usageError(fmt.Sprint("Fatal error: Unknown filler \"", bf.filler, "\", must be ", strings.Join(fillerStyles, " or "), "."))
+	}
+	opts.filler = bf.filler
+	opts.patch = bf.patch
+	if len(bf.background) > 0 {
+		art, err := loadBackground(bf.background, bf.blend)
+		if err != nil {
+			return err
+		}
+		opts.background = art
+	}
+	if len(bf.grid) > 0 {
+		grid, err := parseColor(bf.grid)
+		if err != nil {
+			return usageError(fmt.Sprint("Fatal error: ", err))
+		}
+		opts.grid = grid
+	}
+	return bf.signing(opts)
+}
+
+// outputName returns the default image name of a source file
+func (bf *buildFlags) outputName(filename string) string {
+	outputfile := filename[0:len(filename)-4] + "." + bf.format
+	if len(bf.outdir) > 0 {
+		outputfile = filepath.Join(bf.outdir, filepath.Base(outputfile))
+	}
+	return outputfile
+}
+
+// makeOutdir creates the output directory if there is one and images are written
+func (bf *buildFlags) makeOutdir() error {
+	if len(bf.outdir) == 0 || bf.dryrun {
+		return nil
+	}
+	if err := os.MkdirAll(bf.outdir, 0o755); err != nil {
+		return ioError(fmt.Sprint("Fatal error: \"", err, "\""))
+	}
+	return nil
+}
+
+// isPattern tells if the name stands for more than one file
+func isPattern(name string) bool {
+	if strings.ContainsAny(name, "*?[") || strings.HasSuffix(name, "...") {
+		return true
+	}
+	info, err := os.Stat(name)
+	return err == nil && info.IsDir()
+}
+
+// expandPatterns returns the sorted list of .plk files the patterns stand for
+func expandPatterns(patterns []string) ([]string, error) {
+	found := make(map[string]bool)
+	for _, pattern := range patterns {
+		var matches []string
+		if root, ok := strings.CutSuffix(pattern, "..."); ok {
+			if len(root) == 0 {
+				root = "."
+			}
+			err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if !d.IsDir() && strings.HasSuffix(path, ".plk") {
+					matches = append(matches, path)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		} else if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+			matches, _ = filepath.Glob(filepath.Join(pattern, "*.plk"))
+		} else {
+			globbed, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, usageError(fmt.Sprint("Invalid pattern: \"", pattern, "\""))
+			}
+			for _, match := range globbed {
+				if strings.HasSuffix(match, ".plk") {
+					matches = append(matches, match)
+				}
+			}
+		}
+		if len(matches) == 0 {
+			return nil, usageError(fmt.Sprint("No .plk files match pattern: \"", pattern, "\""))
+		}
+		for _, match := range matches {
+			found[match] = true
+		}
+	}
+	files := make([]string, 0, len(found))
+	for file := range found {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// buildKey is the hash of the source, of the options which change the image and of the compiler, so a new release or
+// a changed instruction set builds the images again
+func buildKey(source []byte, opts options) string {
+	hash := sha256.New()
+	fingerprint, _ := opcodeFingerprint()
+	fmt.Fprintln(hash, "pollock", version, fingerprint)
+	fmt.Fprintln(hash, VMAJOR, VMINOR, opts.cellsize, opts.targetMinor, opts.wordsize)
+	if opts.werror {
+		// An image built with warnings is not up to date for -Werror
+		fmt.Fprintln(hash, "werror")
+	}
+	if opts.symbols {
+		fmt.Fprintln(hash, "symbols")
+	}
+	if opts.reloc {
+		fmt.Fprintln(hash, "reloc")
+	}
+	for _, dir := range opts.includeDirs {
+		fmt.Fprintln(hash, "include", dir)
+	}
+	if opts.rle {
+		fmt.Fprintln(hash, "rle")
+	}
+	if opts.orient {
+		fmt.Fprintln(hash, "orient")
+	}
+	if opts.patch {
+		fmt.Fprintln(hash, "patch")
+	}
+	if opts.optimize {
+		fmt.Fprintln(hash, "optimize")
+	}
+	if opts.release {
+		fmt.Fprintln(hash, "release")
+	}
+	if opts.teach {
+		fmt.Fprintln(hash, "teach")
+	}
+	if len(opts.palette) > 0 {
+		fmt.Fprintln(hash, "palette", opts.palette)
+	}
+	if opts.grid.A != 0 {
+		fmt.Fprintln(hash, "grid", hexColor(opts.grid))
+	}
+	if opts.jitter > 0 {
+		fmt.Fprintln(hash, "jitter", opts.jitter)
+	}
+	if len(opts.filler) > 0 {
+		fmt.Fprintln(hash, "filler", opts.filler)
+	}
+	if opts.background != nil {
+		fmt.Fprintln(hash, "background", opts.background.sum, opts.background.blend)
+	}
+	if opts.dpi != defaultDPI || opts.printWidth != 0 {
+		fmt.Fprintln(hash, "print", opts.dpi, opts.printWidth)
+	}
+	if len(opts.shuffleKey) > 0 {
+		fmt.Fprintf(hash, "shuffle %x\n", sha256.Sum256([]byte(opts.shuffleKey)))
+	}
+	if opts.signKey != nil {
+		fmt.Fprintf(hash, "sign %x\n", opts.signKey.Public())
+	}
+	hash.Write(source)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// upToDate tells if the image exists and was built from the same source, included files and options
+func upToDate(outputfile string, key string) bool {
+	if _, err := os.Stat(outputfile); err != nil {
+		return false
+	}
+	stored, err := os.ReadFile(outputfile + ".hash")
+	lines := strings.Split(strings.TrimSpace(string(stored)), "\n")
+	return err == nil && lines[0] == key && includesUnchanged(lines[1:])
+}
+
+// buildJob is a source file to compile into an image with its options
+type buildJob struct {
+	label      string
+	filename   string
+	outputfile string
+	opts       options
+}
+
+// buildPatterns compiles every file matching the patterns, prints the summary and returns the exit code
+func buildPatterns(patterns []string, opts options, bf buildFlags) int {
+	files, err := expandPatterns(patterns)
+	if err != nil {
+		log.Println("Fatal error:", err)
+		return exitCode(err)
+	}
+	outputs := make(map[string]string)
+	for _, filename := range files {
+		outputfile := bf.outputName(filename)
+		if other, ok := outputs[outputfile]; ok {
+			err := usageError(fmt.Sprint("Fatal error: \"", other, "\" and \"", filename, "\" would both be written to \"", outputfile, "\""))
+			log.Println(err)
+			return exitCode(err)
+		}
+		outputs[outputfile] = filename
+	}
+	if err := bf.makeOutdir(); err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+	jobs := make([]buildJob, len(files))
+	for i, filename := range files {
+		jobs[i] = buildJob{label: filename, filename: filename, outputfile: bf.outputName(filename), opts: opts}
+	}
+	return buildJobs(jobs, bf)
+}
+
+// buildJobs compiles the files of the jobs, prints the summary and returns the exit code
+func buildJobs(jobs []buildJob, bf buildFlags) int {
+	// The files are compiled by a pool of workers, each file writes its messages into its own buffer,
+	// which are printed in the order of the files at the end, so the output is the same for every run
+	type result struct {
+		output      bytes.Buffer
+		summary     string
+		err         error
+		diagnostics []diagnostic
+	}
+	results := make([]result, len(jobs))
+	var status *progress
+	if bf.progress {
+		status = newProgress("Building files", len(jobs))
+	}
+	// The messages of the files are printed on stdout
+	color := colorEnabled(os.Stdout)
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				filename, label, opts := jobs[i].filename, jobs[i].label, jobs[i].opts
+				r := &results[i]
+				fileOpts := opts
+				fileOpts.logger = log.New(&r.output, "", log.LstdFlags)
+				fileOpts.out = &r.output
+				fileOpts.color = color
+				outputfile := jobs[i].outputfile
+				cached := !bf.dryrun && !bf.bytearray
+				var key string
+				if cached {
+					if source, err := os.ReadFile(filename); err == nil {
+						key = buildKey(source, opts)
+					}
+					// The SARIF log needs the warnings of every file
+					if !bf.force && len(bf.sarif) == 0 && len(key) > 0 && upToDate(outputfile, key) {
+						r.summary = fmt.Sprint("ok   ", label, " -> ", outputfile, " (up to date)")
+						status.add(1)
+						continue
+					}
+				}
+				c, err := compileFile(filename, outputfile, fileOpts, bf.dryrun, bf.bytearray)
+				r.diagnostics = fileDiagnostics(c, err)
+				if err != nil {
+					r.err = err
+					if rendered := errorSnippet(err); len(rendered) > 0 {
+						fmt.Fprint(&r.output, "error: ", err, " [", errorCode(err), "]\n", rendered)
+					}
+					r.summary = fmt.Sprint("FAIL ", label, ": ", err)
+				} else {
+					r.summary = fmt.Sprint("ok   ", label, " -> ", outputfile, " (", c.progline, " cells, ", len(c.diagnostics), " warnings)")
+					if cached && len(key) > 0 {
+						if err := os.WriteFile(outputfile+".hash", []byte(key+"\n"+c.includeHashes()), 0o644); err != nil {
+							fileOpts.logMsg(fmt.Sprint("Hash file write error: ", err))
+						}
+					}
+				}
+				status.add(1)
+			}
+		}()
+	}
+	for i := range jobs {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	status.finish()
+
+	failed := 0
+	code := exitOK
+	var summary []string
+	for i := range results {
+		if results[i].output.Len() > 0 {
+			fmt.Println("==>", jobs[i].label, "<==")
+			os.Stdout.Write(results[i].output.Bytes())
+		}
+		if results[i].err != nil {
+			if failed == 0 {
+				code = exitCode(results[i].err)
+			}
+			failed++
+		}
+		summary = append(summary, results[i].summary)
+	}
+	fmt.Println("Build summary:")
+	for _, line := range summary {
+		fmt.Println(line)
+	}
+	fmt.Println(len(jobs), "files,", failed, "failed")
+	if len(bf.sarif) > 0 {
+		sources := make([]string, len(jobs))
+		diagnostics := make([][]diagnostic, len(jobs))
+		for i := range jobs {
+			sources[i], diagnostics[i] = jobs[i].filename, results[i].diagnostics
+		}
+		if err := writeSarif(bf.sarif, sources, diagnostics); err != nil {
+			log.Println(err)
+			if code == exitOK {
+				code = exitCode(err)
+			}
+		}
+	}
+	return code
+}
+
+// build parses the flags of the build subcommand and compiles the files matching its arguments
+func build(args []string) int {
+	var bf buildFlags
+
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	bf.register(flags)
+	flags.Parse(args)
+	if err := applyEnv(flags); err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+	patterns := flags.Args()
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+		if _, err := os.Stat(manifestName); err == nil {
+			patterns = []string{manifestName}
+		}
+	}
+	if len(patterns) == 1 && filepath.Base(patterns[0]) == manifestName {
+		return buildManifest(patterns[0], bf)
+	}
+
+	opts, err := newOptions(bf.cellsize, bf.target, bf.wordsize)
+	if err != nil {
+		log.Println("Fatal error:", err)
+		return exitCode(err)
+	}
+	if err := bf.apply(&opts); err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+	return buildPatterns(patterns, opts, bf)
+}
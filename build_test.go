@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestBuildKeyVersion(t *testing.T) {
+	opts, err := newOptions(10, "1.0", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := []byte("push 1; outi; halt\n")
+	key := buildKey(source, opts)
+	if buildKey(source, opts) != key {
+		t.Fatal("the key of the same source and options changed")
+	}
+	defer func(old string) { version = old }(version)
+	version += "-next"
+	if buildKey(source, opts) == key {
+		t.Error("the key did not change with the compiler version")
+	}
+}
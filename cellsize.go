@@ -0,0 +1,87 @@
+package main
+
+// Cell sizes
+//
+// The cell size is the third channel of the header cell, which holds the sizes up to 255 pixels. Larger cells, up
+// to maxCellsize pixels, e.g. for posters, have 0 there and their size in a cell size extension cell (kind 6):
+// [6, cellsize / 256, cellsize % 256], which needs format 1.1. Readers measure the run of identical pixels of the
+// header cell, which is the cell size or one less with grid lines, and take the size the extension cell of that
+// grid confirms, or a size it divides for images resized by an integer factor. Object files keep the high byte of
+// the size in a fourth byte of their header.
+
+import (
+	"fmt"
+	"image"
+)
+
+// The range of the cell sizes
+const (
+	minCellsize = 2
+	maxCellsize = 1024
+)
+
+// Largest cell size of the header cell
+const maxHeaderCellsize = 255
+
+// headerCellsize returns the cell size channel of the header cell, 0 for the sizes of the extension cell
+func headerCellsize(cellsize int) uint8 {
+	if cellsize > maxHeaderCellsize {
+		return 0
+	}
+	return uint8(cellsize)
+}
+
+// withCellsize returns the cells with the cell size extension cell, if the size doesn't fit in the header cell
+func (c compiled) withCellsize(cellsize int) compiled {
+	if cellsize <= maxHeaderCellsize {
+		return c
+	}
+	c.extensions = append(append([][3]uint8(nil), c.extensions...), [3]uint8{extCellsize, uint8(cellsize >> 8), uint8(cellsize)})
+	if c.minor < 1 {
+		c.minor = 1
+		c.opts.logMsg(fmt.Sprint("Cell size ", cellsize, " needs format version ", VMAJOR, ".", c.minor, "."))
+	}
+	return c
+}
+
+// headerRun returns the run of identical pixels of the header cell along the first row and column of the image
+func headerRun(img image.Image) int {
+	bounds := img.Bounds()
+	first := img.At(bounds.Min.X, bounds.Min.Y)
+	runX, runY := 1, 1
+	for runX < bounds.Dx() && img.At(bounds.Min.X+runX, bounds.Min.Y) == first {
+		runX++
+	}
+	for runY < bounds.Dy() && img.At(bounds.Min.X, bounds.Min.Y+runY) == first {
+		runY++
+	}
+	return min(runX, runY)
+}
+
+// extendedCellsize returns the cell size of the extension cell of an image with 0 in its header cell, and the
+// measured size of its cells, 0 and 0 if no grid of cells has a matching extension cell
+func extendedCellsize(img image.Image) (int, int) {
+	bounds := img.Bounds()
+	run := headerRun(img)
+	for _, size := range []int{run, run + 1} {
+		if bounds.Dx()%size != 0 || bounds.Dy()%size != 0 {
+			continue
+		}
+		maxX, cells := bounds.Dx()/size, bounds.Dx()/size*(bounds.Dy()/size)
+		if cells < 2 {
+			continue
+		}
+		cell := cellAt(img, 1, maxX, size)
+		progline := int(cell.R)<<16 | int(cell.G)<<8 | int(cell.B)
+		for k := progline + 2; k < cells; k++ {
+			cell := cellAt(img, k, maxX, size)
+			if cell.A == 0 || cell.R == 0 {
+				break
+			}
+			if stated := int(cell.G)<<8 | int(cell.B); cell.R == extCellsize && stated > maxHeaderCellsize && size%stated == 0 {
+				return stated, size
+			}
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCellsizeRange(t *testing.T) {
+	tests := []struct {
+		cellsize int
+		target   string
+		code     string
+	}{
+		{-1, "1.0", "usage"},
+		{0, "1.0", "usage"},
+		{minCellsize - 1, "1.0", "usage"},
+		{minCellsize, "1.0", ""},
+		{maxHeaderCellsize, "1.0", ""},
+		{maxHeaderCellsize + 1, "1.1", ""},
+		{maxCellsize, "1.1", ""},
+		{maxCellsize + 1, "1.1", "usage"},
+		{10, "1.2", "usage"},
+	}
+	for _, test := range tests {
+		if _, err := newOptions(test.cellsize, test.target, 8); errorCode(err) != test.code {
+			t.Errorf("cell size %d, target %s: got error code %q (%v), want %q", test.cellsize, test.target, errorCode(err), err, test.code)
+		}
+	}
+}
+
+func TestCellsizeImage(t *testing.T) {
+	tests := []struct {
+		cellsize  int
+		header    uint8
+		extension bool
+	}{
+		{minCellsize, minCellsize, false},
+		{maxHeaderCellsize, maxHeaderCellsize, false},
+		{maxHeaderCellsize + 1, 0, true},
+		{300, 0, true},
+	}
+	for _, test := range tests {
+		c, err := testCompile(t, "push 1; outi; halt\n", func(opts *options) { opts.cellsize = test.cellsize })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := headerCellsize(test.cellsize); got != test.header {
+			t.Errorf("cell size %d: header cell has %d, want %d", test.cellsize, got, test.header)
+		}
+		written := c.written(c.opts)
+		if _, extended := written.extension(extCellsize); extended != test.extension || test.extension && written.minor < 1 {
+			t.Errorf("cell size %d: extension cell %t with format 1.%d, want %t", test.cellsize, extended, written.minor, test.extension)
+		}
+		if decoded := testDecode(t, c); decoded.opts.cellsize != test.cellsize {
+			t.Errorf("cell size %d: decoded as %d", test.cellsize, decoded.opts.cellsize)
+		}
+	}
+}
+
+func TestCellsizePragma(t *testing.T) {
+	tests := []struct {
+		value    string
+		cellsize int
+		invalid  bool
+	}{
+		{"2", 2, false},
+		{"1024", 1024, false},
+		{"1", 10, true},
+		{"1025", 10, true},
+		{"-4", 10, true},
+		{"big", 10, true},
+	}
+	for _, test := range tests {
+		c, err := testCompile(t, "#pragma cellsize "+test.value+"\npush 1; outi; halt\n", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		invalid := false
+		for _, d := range c.diagnostics {
+			invalid = invalid || d.Code == "pragma-invalid"
+		}
+		if c.opts.cellsize != test.cellsize || invalid != test.invalid {
+			t.Errorf("pragma cellsize %s: got cell size %d and pragma-invalid %t, want %d and %t", test.value, c.opts.cellsize, invalid, test.cellsize, test.invalid)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+// Control-flow graphs, with "pollock cfg -o cfg.dot prog.plk"
+//
+// The program, compiled from a .plk file or read from an image, is split into basic blocks (see flow.go), one
+// node each, with the edges of their jumps and of the blocks they fall through to. Jumps to a computed address go
+// to a "computed" node, which stands for any labeled cell, and the blocks which can't run from the entry are gray.
+// The graph is written in the DOT format of Graphviz, render it with "dot -Tsvg cfg.dot -o cfg.svg".
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// instruction returns the source form of the token at a position, with the label of a relocated push
+func (c compiled) instruction(pos int) string {
+	for _, r := range c.relocs {
+		if r.cell == pos/3 && r.channel == pos%3 && r.address != externAddress {
+			if r.part > 0 {
+				return fmt.Sprint("push ", r.label, "_", r.part)
+			}
+			return fmt.Sprint("push ", r.label)
+		}
+	}
+	if value, ok := c.literal(pos); ok {
+		return fmt.Sprint("push ", value)
+	}
+	return mnemonic(c.token(pos))
+}
+
+// dotQuote quotes a DOT string
+func dotQuote(text string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(text) + "\""
+}
+
+// writeDOT writes the control-flow graph in the DOT format
+func writeDOT(w io.Writer, c compiled, name string) {
+	g := c.flowGraph()
+	labelsAt := make(map[int]string)
+	for label, address := range c.labels {
+		if other, ok := labelsAt[address]; !ok || label < other {
+			labelsAt[address] = label
+		}
+	}
+	computed := false
+	fmt.Fprintf(w, "digraph %s {\n", dotQuote(name))
+	fmt.Fprintln(w, "\tnode [shape=box, fontname=\"monospace\"];")
+	entry := c.entry()
+	for i, b := range g.blocks {
+		var text strings.Builder
+		address := b.start/3 + 2
+		title := fmt.Sprint(address, colChannel(b.start%3))
+		if label, ok := labelsAt[address]; ok && b.start%3 == 0 {
+			title = fmt.Sprint(label, " (", title, ")")
+		}
+		if b.start == entry {
+			title += " entry"
+		}
+		text.WriteString(title + "\\l")
+		for pos := b.start; pos < b.end; pos++ {
+			text.WriteString("  " + c.instruction(pos) + "\\l")
+		}
+		style := ""
+		if !g.reachable(i) {
+			style = ", color=gray, fontcolor=gray"
+		}
+		fmt.Fprintf(w, "\tb%d [label=\"%s\"%s];\n", i, strings.ReplaceAll(text.String(), "\"", "\\\""), style)
+		for _, e := range b.succs {
+			target := fmt.Sprint("b", e.to)
+			if e.to == computedTarget {
+				target, computed = "computed", true
+			}
+			style := ""
+			if e.kind == "next" {
+				style = ", style=dashed"
+			}
+			fmt.Fprintf(w, "\tb%d -> %s [label=%s%s];\n", i, target, dotQuote(e.kind), style)
+		}
+	}
+	if computed {
+		fmt.Fprintln(w, "\tcomputed [shape=ellipse, label=\"computed address\"];")
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// registerCfg registers the flags of the cfg subcommand
+func registerCfg(flags *flag.FlagSet, outputfile *string, target *string, wordsize *int, shuffleKey *string) {
+	flags.StringVar(outputfile, "o", "", "Output file name of the DOT graph, default is the standard output")
+	flags.StringVar(target, "t", "1.0", "Target format version of .plk files, 1.0 or 1.1, default is 1.0")
+	flags.IntVar(wordsize, "wordsize", 8, "Word size of .plk files in bits, 8, 16 or 32, default is 8")
+	flags.StringVar(shuffleKey, "shuffle-key", "", "Key of a shuffled image, default is none")
+	flags.BoolVar(&silent, "s", false, "Run in silent mode, default is false")
+}
+
+// loadProgram compiles a .plk file or reads an image or object file
+func loadProgram(name string, target string, wordsize int, shuffleKey string) (compiled, error) {
+	if !strings.HasSuffix(name, ".plk") {
+		return decodeVerified(name, nil, shuffleKey)
+	}
+	opts, err := newOptions(10, target, wordsize)
+	if err != nil {
+		return compiled{}, usageError(fmt.Sprint("Fatal error: ", err))
+	}
+	opts.color = colorEnabled(os.Stderr)
+	return compileFile(name, "", opts, true, false)
+}
+
+// cfg parses the flags of the cfg subcommand, writes the control-flow graph and returns the exit code
+func cfg(args []string) int {
+	var outputfile, target, shuffleKey string
+	var wordsize int
+
+	flags := flag.NewFlagSet("cfg", flag.ExitOnError)
+	registerCfg(flags, &outputfile, &target, &wordsize, &shuffleKey)
+	flags.Parse(args)
+	err := applyEnv(flags)
+	if err == nil && flags.NArg() != 1 {
+		err = usageError("Fatal error: Exactly one program is needed.")
+	}
+	var c compiled
+	if err == nil {
+		c, err = loadProgram(flags.Arg(0), target, wordsize, shuffleKey)
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+	var graph bytes.Buffer
+	name := strings.TrimSuffix(filepath.Base(flags.Arg(0)), filepath.Ext(flags.Arg(0)))
+	writeDOT(&graph, c, name)
+	if len(outputfile) == 0 {
+		os.Stdout.Write(graph.Bytes())
+		return exitOK
+	}
+	logWrapper(fmt.Sprint("Creating graph of ", len(c.flowGraph().blocks), " blocks: ", outputfile))
+	if err := os.WriteFile(outputfile, graph.Bytes(), 0o644); err != nil {
+		err = ioError(fmt.Sprint("Fatal create error: \"", err, "\""))
+		log.Println(err)
+		return exitCode(err)
+	}
+	return exitOK
+}
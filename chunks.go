@@ -0,0 +1,152 @@
+package main
+
+// Pollock chunks of the PNG file
+//
+// Metadata which is not needed to execute the image is written into private ancillary PNG chunks, which image
+// tools ignore or copy. They are inserted right after the IHDR chunk.
+// plEx: export table, one "NAME ADDRESS\n" line per label exported with .export, in the order of the source.
+// plRl: relocation table, one "CELL CHANNEL PART ADDRESS LABEL\n" line per program cell channel holding a label
+// address (PART 0) or its PART-th 7-bit group, CELL counts from the first program cell and the ADDRESS of an
+// external label is -1. It is written for images with exports or external labels, for pollock link, and with -symbols
+// or -reloc. The distances of pusha LABEL don't change when the image is rebased, so they have no entries.
+// plSy: symbol table, one "NAME ADDRESS\n" line per label of the program in address order, written with -symbols
+// for pollock extract.
+// plSm: source map of the images with outd debug prints, as in object files (see object.go).
+// plSg: Ed25519 signature of the token stream and the chunks above, 64 bytes, written with -sign (see sign.go) and
+// kept by pollock scale.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"sort"
+)
+
+// Length of the PNG signature and the IHDR chunk, which come first in every PNG file
+const pngHeaderLen = 8 + 4 + 4 + 13 + 4
+
+// pngChunk is an extra chunk of the PNG file
+type pngChunk struct {
+	name string
+	data []byte
+}
+
+// chunkWriter passes a PNG stream through and inserts the chunks after the IHDR chunk
+type chunkWriter struct {
+	w      io.Writer
+	chunks []pngChunk
+	header []byte
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	if len(cw.header) < pngHeaderLen {
+		n := min(pngHeaderLen-len(cw.header), len(p))
+		cw.header = append(cw.header, p[:n]...)
+		p = p[n:]
+		written = n
+		if len(cw.header) < pngHeaderLen {
+			return written, nil
+		}
+		if _, err := cw.w.Write(cw.header); err != nil {
+			return 0, err
+		}
+		for _, chunk := range cw.chunks {
+			if err := writeChunk(cw.w, chunk); err != nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := cw.w.Write(p)
+	return written + n, err
+}
+
+// writeChunk writes the length, the name, the data and the CRC of the chunk
+func writeChunk(w io.Writer, chunk pngChunk) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(chunk.data)))
+	buf.WriteString(chunk.name)
+	buf.Write(chunk.data)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()[4:]))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// chunks returns the Pollock chunks of the compiled program
+func (c compiled) chunks() []pngChunk {
+	chunks := c.tableChunks()
+	if c.opts.signKey != nil {
+		chunks = append(chunks, pngChunk{name: "plSg", data: c.sign()})
+	} else if len(c.signature) > 0 {
+		// The signature of a decoded image, whose cells are written again
+		chunks = append(chunks, pngChunk{name: "plSg", data: c.signature})
+	}
+	return chunks
+}
+
+// tableChunks returns the Pollock chunks of the compiled program but the signature, which covers them
+func (c compiled) tableChunks() []pngChunk {
+	var chunks []pngChunk
+	if len(c.exports) > 0 {
+		var table bytes.Buffer
+		for _, name := range c.exports {
+			fmt.Fprintln(&table, name, c.labels[name])
+		}
+		chunks = append(chunks, pngChunk{name: "plEx", data: table.Bytes()})
+	}
+	if c.relocatable {
+		var relocs bytes.Buffer
+		for _, r := range c.relocs {
+			fmt.Fprintln(&relocs, r.cell, r.channel, r.part, r.address, r.label)
+		}
+		chunks = append(chunks, pngChunk{name: "plRl", data: relocs.Bytes()})
+	}
+	if c.opts.symbols {
+		var names []string
+		for name := range c.labels {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			if c.labels[names[i]] != c.labels[names[j]] {
+				return c.labels[names[i]] < c.labels[names[j]]
+			}
+			return names[i] < names[j]
+		})
+		var table bytes.Buffer
+		for _, name := range names {
+			fmt.Fprintln(&table, name, c.labels[name])
+		}
+		chunks = append(chunks, pngChunk{name: "plSy", data: table.Bytes()})
+	}
+	if c.debugPrints() {
+		chunks = append(chunks, pngChunk{name: "plSm", data: c.sourceMap()})
+	}
+	return chunks
+}
+
+// debugPrints tells if the program has outd instructions and their source lines
+func (c compiled) debugPrints() bool {
+	if len(c.cellLines) != c.progline || len(c.cellFiles) != c.progline {
+		return false
+	}
+	outd, _ := tokenize([]byte("outd"))
+	for pos := 0; pos < 3*c.progline; pos++ {
+		if c.program.at(pos/3, pos%3) == outd {
+			return true
+		}
+	}
+	return false
+}
+
+// encodePNG encodes the image of the compiled program with its chunks
+func encodePNG(w io.Writer, img image.Image, c compiled) error {
+	chunks := c.chunks()
+	if len(chunks) == 0 {
+		return png.Encode(w, img)
+	}
+	return png.Encode(&chunkWriter{w: w, chunks: chunks}, img)
+}
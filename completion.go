@@ -0,0 +1,465 @@
+package main
+
+// Subcommands and shell completion
+//
+// subcommands is the table of the subcommands, main dispatches on it and the completion scripts are generated
+// from it and from the flags every command registers, so the scripts always match the command line.
+// "pollock completion bash|zsh|fish" prints the script of the shell, e.g.
+//   source <(pollock completion bash)
+//   pollock completion zsh > "${fpath[1]}/_pollock"
+//   pollock completion fish > ~/.config/fish/completions/pollock.fish
+// Sources are completed with .plk files, output files with .png files and -outdir with directories.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// command is a subcommand, register registers its flags on a flag set
+type command struct {
+	name     string
+	help     string
+	register func(flags *flag.FlagSet)
+	args     completion
+	run      func(args []string) int
+}
+
+// completion tells how the value of a flag or the arguments of a command are completed
+type completion struct {
+	ext   string
+	dirs  bool
+	words []string
+}
+
+// The completion of the flag values, the other flags take any text
+var flagCompletions = map[string]completion{
+	"f":          {ext: ".plk"},
+	"o":          {ext: ".png"},
+	"outdir":     {dirs: true},
+	"t":          {words: []string{"1.0", "1.1"}},
+	"wordsize":   {words: []string{"8", "16", "32"}},
+	"sign":       {ext: ".pem"},
+	"verify-key": {ext: ".pem"},
+	"key":        {ext: ".pem"},
+	"inline":     {words: inlineProtocols},
+	"format":     {words: outputFormats},
+	"palette":    {words: accessPalettes},
+	"background": {ext: ".png"},
+	"filler":     {words: fillerStyles},
+	"thumbs":     {dirs: true},
+	"I":          {dirs: true},
+	"cache":      {dirs: true},
+	"sarif":      {ext: ".sarif"},
+	"lang":       {words: languages},
+}
+
+var shells = []string{"bash", "zsh", "fish"}
+
+func subcommands() []command {
+	return []command{
+		{
+			name: "build",
+			help: "Compile the .plk files matching the patterns",
+			register: func(flags *flag.FlagSet) {
+				var bf buildFlags
+				bf.register(flags)
+			},
+			args: completion{ext: ".plk"},
+			run:  build,
+		},
+		{
+			name: "serve",
+			help: "Run the HTTP compile service and the playground",
+			register: func(flags *flag.FlagSet) {
+				var listen string
+				registerServe(flags, &listen)
+			},
+			run: serve,
+		},
+		{
+			name: "link",
+			help: "Link compiled images and object files into one image",
+			register: func(flags *flag.FlagSet) {
+				var outputfile, keyfile, shuffleKey string
+				var cellsize int
+				registerLink(flags, &outputfile, &cellsize, &keyfile, &shuffleKey)
+			},
+			args: completion{ext: ".png"},
+			run:  link,
+		},
+		{
+			name: "cfg",
+			help: "Write the control-flow graph of a program in the DOT format",
+			register: func(flags *flag.FlagSet) {
+				var outputfile, target, shuffleKey string
+				var wordsize int
+				registerCfg(flags, &outputfile, &target, &wordsize, &shuffleKey)
+			},
+			args: completion{ext: ".plk"},
+			run:  cfg,
+		},
+		{
+			name: "validate",
+			help: "Check images against the format definition and print a conformance report",
+			register: func(flags *flag.FlagSet) {
+				registerValidate(flags)
+			},
+			args: completion{ext: ".png"},
+			run:  validate,
+		},
+		{
+			name: "scale",
+			help: "Encode an image again at another cell size, keeping its cells",
+			register: func(flags *flag.FlagSet) {
+				var outputfile, grid, keyfile string
+				var cellsize int
+				var rle bool
+				registerScale(flags, &outputfile, &cellsize, &grid, &rle, &keyfile)
+			},
+			args: completion{ext: ".png"},
+			run:  scale,
+		},
+		{
+			name: "gen",
+			help: "Write a random program which compiles and halts, for differential tests",
+			register: func(flags *flag.FlagSet) {
+				var outputfile, target string
+				var seed uint64
+				var cells int
+				registerGen(flags, &outputfile, &seed, &cells, &target)
+			},
+			run: gen,
+		},
+		{
+			name: "roundtrip",
+			help: "Check that programs come through their images unchanged",
+			register: func(flags *flag.FlagSet) {
+				var programs int
+				registerRoundtrip(flags, &programs)
+			},
+			args: completion{ext: ".plk"},
+			run:  roundtrip,
+		},
+		{
+			name: "examples",
+			help: "Compare the images of the example programs with their golden images",
+			register: func(flags *flag.FlagSet) {
+				var dir string
+				var update bool
+				registerExamples(flags, &dir, &update)
+			},
+			args: completion{words: []string{"verify"}},
+			run:  examples,
+		},
+		{
+			name: "init",
+			help: "Create a project with a manifest, a main program and an example",
+			register: func(flags *flag.FlagSet) {
+				registerInit(flags)
+			},
+			args: completion{dirs: true},
+			run:  initProject,
+		},
+		{
+			name: "new",
+			help: "Write a starter program, hello, fizzbuzz or snake",
+			register: func(flags *flag.FlagSet) {
+				var outputfile string
+				registerNew(flags, &outputfile)
+			},
+			args: completion{words: templateNames()},
+			run:  newProgram,
+		},
+		{
+			name: "ar",
+			help: "Bundle object files into an archive for pollock link",
+			register: func(flags *flag.FlagSet) {
+				var outputfile string
+				registerAr(flags, &outputfile)
+			},
+			args: completion{ext: ".plko"},
+			run:  ar,
+		},
+		{
+			name: "extract",
+			help: "Extract the cells between two labels of an image into a library image",
+			register: func(flags *flag.FlagSet) {
+				var outputfile, from, to, keyfile, shuffleKey string
+				registerExtract(flags, &outputfile, &from, &to, &keyfile, &shuffleKey)
+			},
+			args: completion{ext: ".png"},
+			run:  extract,
+		},
+		{
+			name: "verify",
+			help: "Check the signatures of images",
+			register: func(flags *flag.FlagSet) {
+				var keyfile string
+				registerVerify(flags, &keyfile)
+			},
+			args: completion{ext: ".png"},
+			run:  verify,
+		},
+		{
+			name: "sheet",
+			help: "Write a contact sheet and thumbnails of the images in a directory",
+			register: func(flags *flag.FlagSet) {
+				var outputfile, thumbs string
+				var size, columns int
+				registerSheet(flags, &outputfile, &thumbs, &size, &columns)
+			},
+			args: completion{dirs: true},
+			run:  sheet,
+		},
+		{
+			name:     "ops",
+			help:     "Print the instruction reference",
+			register: func(flags *flag.FlagSet) {},
+			args:     completion{words: opNames()},
+			run:      ops,
+		},
+		{
+			name:     "completion",
+			help:     "Print the completion script of bash, zsh or fish",
+			register: func(flags *flag.FlagSet) {},
+			args:     completion{words: shells},
+			run:      completionScript,
+		},
+	}
+}
+
+// defaultCommand is the command without a subcommand name, which compiles -f
+func defaultCommand() command {
+	return command{
+		register: func(flags *flag.FlagSet) {
+			var filename, outputfile string
+			var showVersion bool
+			var bf buildFlags
+			registerMain(flags, &filename, &outputfile, &showVersion, &bf)
+		},
+	}
+}
+
+// flagsOf returns the flags of the command in name order
+func flagsOf(cmd command) []*flag.Flag {
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	cmd.register(flags)
+	var list []*flag.Flag
+	flags.VisitAll(func(f *flag.Flag) {
+		list = append(list, f)
+	})
+	return list
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// flagHelp is the usage text of the flag without its default
+func flagHelp(f *flag.Flag) string {
+	help, _, _ := strings.Cut(f.Usage, ", default")
+	return help
+}
+
+// completionScript is the completion subcommand, it prints the script of the shell given as the argument
+func completionScript(args []string) int {
+	silent = true
+	if len(args) != 1 {
+		err := usageError("Fatal error: Usage: pollock completion bash|zsh|fish")
+		log.Println(err)
+		return exitCode(err)
+	}
+	switch args[0] {
+	case "bash":
+		bashCompletion(os.Stdout)
+	case "zsh":
+		zshCompletion(os.Stdout)
+	case "fish":
+		fishCompletion(os.Stdout)
+	default:
+		err := usageError(fmt.Sprint("Fatal error: Unknown shell \"", args[0], "\", must be bash, zsh or fish."))
+		log.Println(err)
+		return exitCode(err)
+	}
+	return exitOK
+}
+
+func commandNames() string {
+	var names []string
+	for _, cmd := range subcommands() {
+		names = append(names, cmd.name)
+	}
+	return strings.Join(names, " ")
+}
+
+func bashReply(c completion) string {
+	switch {
+	case len(c.ext) > 0:
+		return fmt.Sprint("COMPREPLY=($(compgen -d -- \"$cur\") $(compgen -f -X '!*", c.ext, "' -- \"$cur\"))")
+	case c.dirs:
+		return "COMPREPLY=($(compgen -d -- \"$cur\"))"
+	case len(c.words) > 0:
+		return fmt.Sprint("COMPREPLY=($(compgen -W \"", strings.Join(c.words, " "), "\" -- \"$cur\"))")
+	}
+	return "COMPREPLY=()"
+}
+
+// bashCase writes the completion of a command in the case of the bash function
+func bashCase(w io.Writer, cmd command, pattern string) {
+	flags := flagsOf(cmd)
+	fmt.Fprintf(w, "\t%s)\n", pattern)
+	fmt.Fprintln(w, "\t\tcase \"$prev\" in")
+	var names []string
+	for _, f := range flags {
+		names = append(names, "-"+f.Name)
+		if !isBoolFlag(f) {
+			fmt.Fprintf(w, "\t\t-%s) %s; return ;;\n", f.Name, bashReply(flagCompletions[f.Name]))
+		}
+	}
+	fmt.Fprintln(w, "\t\tesac")
+	fmt.Fprintf(w, "\t\tif [[ $cur == -* ]]; then COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")); return; fi\n", strings.Join(names, " "))
+	if len(cmd.name) == 0 {
+		fmt.Fprintf(w, "\t\tif [[ $COMP_CWORD -eq 1 ]]; then COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")); return; fi\n", commandNames())
+	}
+	fmt.Fprintf(w, "\t\t%s\n", bashReply(cmd.args))
+	fmt.Fprintln(w, "\t\t;;")
+}
+
+func bashCompletion(w io.Writer) {
+	fmt.Fprintln(w, "# bash completion of pollock, generated by \"pollock completion bash\"")
+	fmt.Fprintln(w, "_pollock() {")
+	fmt.Fprintln(w, "\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\" cmd=\"\"")
+	fmt.Fprintln(w, "\tif [[ $COMP_CWORD -gt 1 && ${COMP_WORDS[1]} != -* ]]; then")
+	fmt.Fprintln(w, "\t\tcmd=\"${COMP_WORDS[1]}\"")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, "\tcase \"$cmd\" in")
+	for _, cmd := range subcommands() {
+		bashCase(w, cmd, cmd.name)
+	}
+	bashCase(w, defaultCommand(), "*")
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -o filenames -F _pollock pollock")
+}
+
+// zshEscape escapes the characters which separate the parts of an _arguments or _describe spec
+func zshEscape(text string) string {
+	return strings.NewReplacer("[", "\\[", "]", "\\]", ":", "\\:").Replace(text)
+}
+
+// zshQuote quotes the text for zsh
+func zshQuote(text string) string {
+	return "'" + strings.ReplaceAll(text, "'", "'\\''") + "'"
+}
+
+func zshAction(c completion) string {
+	switch {
+	case len(c.ext) > 0:
+		return fmt.Sprint("_files -g \"*", c.ext, "\"")
+	case c.dirs:
+		return "_files -/"
+	case len(c.words) > 0:
+		return fmt.Sprint("(", strings.Join(c.words, " "), ")")
+	}
+	return " "
+}
+
+// zshArguments writes the _arguments call of a command
+func zshArguments(w io.Writer, cmd command) {
+	fmt.Fprint(w, "\t\t_arguments")
+	for _, f := range flagsOf(cmd) {
+		spec := fmt.Sprint("-", f.Name, "[", zshEscape(flagHelp(f)), "]")
+		if !isBoolFlag(f) {
+			spec += ":value:" + zshAction(flagCompletions[f.Name])
+		}
+		fmt.Fprintf(w, " \\\n\t\t\t%s", zshQuote(spec))
+	}
+	if len(cmd.args.ext) > 0 || cmd.args.dirs || len(cmd.args.words) > 0 {
+		fmt.Fprintf(w, " \\\n\t\t\t%s", zshQuote("*:argument:"+zshAction(cmd.args)))
+	}
+	fmt.Fprintln(w)
+}
+
+func zshCompletion(w io.Writer) {
+	fmt.Fprintln(w, "#compdef pollock")
+	fmt.Fprintln(w, "# zsh completion of pollock, generated by \"pollock completion zsh\"")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "_pollock() {")
+	fmt.Fprintln(w, "\tlocal -a commands")
+	fmt.Fprintln(w, "\tcommands=(")
+	for _, cmd := range subcommands() {
+		fmt.Fprintf(w, "\t\t%s\n", zshQuote(cmd.name+":"+zshEscape(cmd.help)))
+	}
+	fmt.Fprintln(w, "\t)")
+	fmt.Fprintln(w, "\tif (( CURRENT == 2 )) && [[ $words[2] != -* ]]; then")
+	fmt.Fprintln(w, "\t\t_describe -t commands 'pollock command' commands")
+	fmt.Fprintln(w, "\t\treturn")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, "\tcase $words[2] in")
+	for _, cmd := range subcommands() {
+		fmt.Fprintf(w, "\t%s)\n", cmd.name)
+		fmt.Fprintln(w, "\t\tshift words")
+		fmt.Fprintln(w, "\t\t(( CURRENT-- ))")
+		zshArguments(w, cmd)
+		fmt.Fprintln(w, "\t\t;;")
+	}
+	fmt.Fprintln(w, "\t*)")
+	zshArguments(w, defaultCommand())
+	fmt.Fprintln(w, "\t\t;;")
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "if [ \"$funcstack[1]\" = \"_pollock\" ]; then")
+	fmt.Fprintln(w, "\t_pollock \"$@\"")
+	fmt.Fprintln(w, "else")
+	fmt.Fprintln(w, "\tcompdef _pollock pollock")
+	fmt.Fprintln(w, "fi")
+}
+
+// fishQuote quotes the text for fish
+func fishQuote(text string) string {
+	return "'" + strings.NewReplacer("\\", "\\\\", "'", "\\'").Replace(text) + "'"
+}
+
+func fishArgs(c completion) string {
+	switch {
+	case len(c.ext) > 0:
+		return fmt.Sprint(" -a '(__fish_complete_suffix ", c.ext, ")'")
+	case c.dirs:
+		return " -a '(__fish_complete_directories)'"
+	case len(c.words) > 0:
+		return " -a " + fishQuote(strings.Join(c.words, " "))
+	}
+	return ""
+}
+
+// fishCommand writes the completions of a command, valid when condition holds
+func fishCommand(w io.Writer, cmd command, condition string) {
+	for _, f := range flagsOf(cmd) {
+		line := fmt.Sprint("complete -c pollock -n ", fishQuote(condition), " -o ", f.Name)
+		if !isBoolFlag(f) {
+			line += " -x" + fishArgs(flagCompletions[f.Name])
+		}
+		fmt.Fprintln(w, line, "-d", fishQuote(flagHelp(f)))
+	}
+	if args := fishArgs(cmd.args); len(args) > 0 {
+		fmt.Fprintf(w, "complete -c pollock -n %s%s\n", fishQuote(condition), args)
+	}
+}
+
+func fishCompletion(w io.Writer) {
+	fmt.Fprintln(w, "# fish completion of pollock, generated by \"pollock completion fish\"")
+	fmt.Fprintln(w, "complete -c pollock -f")
+	for _, cmd := range subcommands() {
+		fmt.Fprintf(w, "complete -c pollock -n __fish_use_subcommand -a %s -d %s\n", cmd.name, fishQuote(cmd.help))
+	}
+	for _, cmd := range subcommands() {
+		fishCommand(w, cmd, "__fish_seen_subcommand_from "+cmd.name)
+	}
+	fishCommand(w, defaultCommand(), "not __fish_seen_subcommand_from "+commandNames())
+}
@@ -0,0 +1,234 @@
+package main
+
+// Stack contracts
+//
+// A comment line # stack: IN -> OUT right above a labeled line declares the stack effect of the routine at the
+// label: it starts with IN values on the stack and leaves OUT values. The return address of the caller is under the
+// inputs and isn't counted, a jump to a computed address is the return of the routine and pops it. After the labels
+// have their addresses every path from the label is followed through the program cells, with the stack effects of
+// the opcodes table, and the contract is broken by a return with another number of values, by a line reached with
+// two different numbers of values, e.g. a loop which grows the stack, and by an instruction popping values below
+// the inputs and the return address. A jump or a fall through to the label of another contract is a call when the
+// value under the inputs of the other routine is the address of a label pushed on the path, by push LABEL or pusha
+// LABEL: the path goes on at that label with the effect of the other contract and the return address popped.
+// Without it the other routine gets the return address of the caller, it is a tail call and its effect must leave
+// the outputs of the contract. A halt ends the path. Each broken contract is a stack-contract warning at its
+// comment line, in the context of its label.
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// stackContract is the declared stack effect of the routine at a label, with the line of its comment
+type stackContract struct {
+	in     int
+	out    int
+	file   int
+	lineno int
+}
+
+// isContract tells if the comment line declares a stack contract
+func isContract(line []byte) bool {
+	_, ok := strings.CutPrefix(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(string(line)), "#")), "stack:")
+	return ok
+}
+
+// parseContract returns the contract of a # stack: IN -> OUT comment line, false with a warning if it is invalid
+func (c *compiled) parseContract(line sourceLine) (stackContract, bool) {
+	text, _ := strings.CutPrefix(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(string(line.text)), "#")), "stack:")
+	before, after, ok := strings.Cut(text, "->")
+	in, errIn := strconv.Atoi(strings.TrimSpace(before))
+	out, errOut := strconv.Atoi(strings.TrimSpace(after))
+	if !ok || errIn != nil || errOut != nil || in < 0 || out < 0 {
+		c.warn(line.lineno, "", wholeLine, "contract-invalid", c.opts.message("contract-invalid", strings.TrimSpace(text), line.lineno+1))
+		return stackContract{}, false
+	}
+	return stackContract{in: in, out: out, file: line.file, lineno: line.lineno}, true
+}
+
+// lineRef returns the number of the source line of the cell at a position, with the name of its file if it isn't
+// the current one, "" if the cell has no source line
+func (c *compiled) lineRef(pos int) string {
+	cell := pos / 3
+	if cell >= len(c.cellLines) || cell >= len(c.cellFiles) {
+		return ""
+	}
+	if c.cellFiles[cell] != c.file {
+		return c.opts.message("line-ref-file", c.cellLines[cell]+1, c.files[c.cellFiles[cell]].name)
+	}
+	return fmt.Sprint(c.cellLines[cell] + 1)
+}
+
+// cellLine describes the source line of the cell at a position for the contract warnings
+func (c *compiled) cellLine(pos int) string {
+	if ref := c.lineRef(pos); len(ref) > 0 {
+		return c.opts.message("cell-line", ref)
+	}
+	return c.opts.message("cell-address", pos/3+2)
+}
+
+// breach follows the paths of the routine at the label and describes the first place which breaks its contract,
+// "" if none does
+func (c *compiled) breach(label string, contract stackContract, entries map[int]stackContract) string {
+	// A path to follow, returns has the values on its stack which are label addresses, by their depth
+	type state struct {
+		pos     int
+		depth   int
+		returns map[int]int
+	}
+	start := 3 * (c.labels[label] - 2)
+	end := 3 * c.progline
+	labeled := make(map[int]bool)
+	for _, address := range c.labels {
+		labeled[3*(address-2)] = true
+	}
+	seen := make(map[int]int)
+	work := []state{{start, contract.in, map[int]int{}}}
+	for len(work) > 0 {
+		s := work[len(work)-1]
+		work = work[:len(work)-1]
+		returns := s.returns
+	path:
+		for pos, depth := s.pos, s.depth; pos < end; pos++ {
+			if other, ok := entries[pos]; ok && pos != start {
+				if depth < other.in {
+					return c.opts.message("contract-call-short", c.cellLine(pos), depth, other.in)
+				}
+				if back, ok := returns[depth-other.in]; ok {
+					// A call of the routine of another contract, which returns to the pushed label
+					after := make(map[int]int)
+					for at, target := range returns {
+						if at < depth-other.in {
+							after[at] = target
+						}
+					}
+					work = append(work, state{back, depth - other.in - 1 + other.out, after})
+					break
+				}
+				// A tail call of the routine of another contract
+				if result := depth - other.in + other.out; result != contract.out {
+					return c.opts.message("contract-call-result", c.cellLine(pos), result)
+				}
+				break
+			}
+			if before, ok := seen[pos]; ok {
+				if before != depth {
+					return c.opts.message("contract-join", c.cellLine(pos), before, depth)
+				}
+				break
+			}
+			seen[pos] = depth
+			token := c.token(pos)
+			if token&0b1000_0000 == 0 {
+				depth++
+				delete(returns, depth)
+				if target, _, ok := c.jumpTarget(pos + 1); ok && labeled[target] {
+					returns[depth] = target
+				}
+				continue
+			}
+			name := mnemonic(token)
+			pops, pushes := stackEffect(name)
+			switch name {
+			case "pick":
+				pops, pushes = 1, 1
+			case "roll":
+				pops, pushes = 1, 0
+			case "hostcall":
+				// The host function may use any values, the path can't be followed
+				break path
+			}
+			// The return address is the value right under the inputs
+			if depth-pops < -1 {
+				return c.opts.message("contract-underflow", c.cellLine(pos))
+			}
+			returns = moveReturns(returns, name, depth, pops, pushes)
+			if target, _, ok := c.jumpTarget(pos + 1); ok && labeled[target] && (name == "add" || name == "sub") {
+				returns[depth-pops+1] = target
+			}
+			depth += pushes - pops
+			switch {
+			case stops[name]:
+				break path
+			case condJumps[name] || fusedJumps[name]:
+				target, pushed, ok := c.jumpTarget(pos)
+				if !ok {
+					// The return pops the return address too
+					if depth+1 != contract.out {
+						return c.opts.message("contract-return", c.cellLine(pos), depth+1)
+					}
+					break path
+				}
+				taken, falls := true, true
+				if condition, isLiteral := c.literal(pushed - 1); isLiteral && condJumps[name] {
+					taken = (condition == 0) == (name == "jmpz")
+					falls = !taken
+				}
+				if taken {
+					work = append(work, state{target, depth, maps.Clone(returns)})
+				}
+				if !falls {
+					break path
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// moveReturns returns the label addresses on the stack after an instruction at the depth, those it moves keep
+// their values, those it pops or pushes are gone
+func moveReturns(returns map[int]int, name string, depth int, pops int, pushes int) map[int]int {
+	moved := make(map[int]int)
+	for at, target := range returns {
+		if at <= depth-pops {
+			moved[at] = target
+		}
+	}
+	// The values of the stack before the instruction, the top last, and the ones it leaves
+	order := map[string][]int{
+		"swap": {1, 0},
+		"dup":  {0, 0},
+		"over": {0, 1, 0},
+		"rot":  {1, 2, 0},
+		"nip":  {1},
+		"tuck": {1, 0, 1},
+		"outd": {0},
+	}[name]
+	for i, from := range order {
+		if target, ok := returns[depth-pops+1+from]; ok {
+			moved[depth-pops+1+i] = target
+		}
+	}
+	return moved
+}
+
+// checkContracts warns about the routines which break their stack contracts
+func (c *compiled) checkContracts() {
+	entries := make(map[int]stackContract)
+	var labels []string
+	for label, contract := range c.contracts {
+		if address, ok := c.labels[label]; ok && address >= 2 && address-2 < c.progline {
+			entries[3*(address-2)] = contract
+			labels = append(labels, label)
+		}
+	}
+	// In the order of the lines
+	slices.SortFunc(labels, func(a string, b string) int {
+		return cmp.Or(c.contracts[a].file-c.contracts[b].file, c.contracts[a].lineno-c.contracts[b].lineno)
+	})
+	file := c.file
+	for _, label := range labels {
+		contract := c.contracts[label]
+		c.setFile(contract.file)
+		if why := c.breach(label, contract, entries); len(why) > 0 {
+			c.warn(contract.lineno, "", wholeLine, "stack-contract", c.opts.message("stack-contract", contract.in, contract.out, label, why, contract.lineno+1))
+		}
+	}
+	c.setFile(file)
+}
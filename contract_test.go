@@ -0,0 +1,45 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCheckContracts(t *testing.T) {
+	const (
+		main = "push 5; push RET; swap\npush 1; push A; jmpnz\nRET: outi; halt; nop\n"
+		// B adds 1 and returns
+		routineB = "# stack: 1 -> 1\nB: push 1; add; swap\npush 1; swap; jmpnz\n"
+		// RA returns the value left by B
+		returnRA = "RA: swap; push 1; swap\njmpnz; nop; nop\n"
+	)
+	tests := []struct {
+		name   string
+		source string
+		warned []string
+	}{
+		{"call with a pushed return label", main + "# stack: 1 -> 1\nA: push RA; swap; push 1\npush B; jmpnz; nop\n" + returnRA + routineB, nil},
+		{"call with a pusha return label", main + "# stack: 1 -> 1\nA: pusha RA\nswap; push 1; push B\njmpnz; nop; nop\n" + returnRA + routineB, nil},
+		{"call returning too many values", main + "# stack: 1 -> 1\nA: push RA; swap; push 1\npush B; jmpnz; nop\nRA: dup; swap; push 1\nswap; jmpnz; nop\n" + routineB, []string{"A"}},
+		{"tail call", main + "# stack: 1 -> 1\nA: push 1; add; push 1\npush B; jmpnz; nop\n" + routineB, nil},
+		{"tail call leaving too many values", main + "# stack: 1 -> 1\n# doubles its input\nA: dup; push 1; push B\njmpnz; nop; nop\n" + routineB, []string{"A"}},
+		{"broken contract after another routine", main + routineB + "# stack: 1 -> 1\nA: dup; dup; push 1\nswap; jmpnz; nop\n", []string{"A"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := testCompile(t, test.source, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var warned []string
+			for _, d := range c.diagnostics {
+				if d.Code == "stack-contract" {
+					warned = append(warned, d.Label)
+				}
+			}
+			if !slices.Equal(warned, test.warned) {
+				t.Errorf("got stack-contract warnings in %q, want %q: %v", warned, test.warned, c.diagnostics)
+			}
+		})
+	}
+}
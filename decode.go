@@ -0,0 +1,232 @@
+package main
+
+// Decoding of Pollock images
+//
+// decodeFile reads a compiled image back: the header cells, the program cells, the extension cells and the
+// Pollock chunks (export, relocation and symbol tables, signature), into the same compiled structure the compiler produces,
+// so the image can be rendered again, linked or inspected. Images resized by an integer factor are read with the
+// measured size of their cells, with a warning. Cell sizes over 255 are read from their extension cell (see
+// cellsize.go), rotated and mirrored images with an orientation cell are turned back (see orient.go).
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// readChunks returns the data of the chunks of a PNG file by name, the later of repeated chunks wins
+func readChunks(data []byte) (map[string][]byte, error) {
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return nil, errors.New("not a PNG file")
+	}
+	return chunkMap(data)
+}
+
+// chunkMap returns the data of the chunks after the 8 bytes of the signature by name
+func chunkMap(data []byte) (map[string][]byte, error) {
+	list, err := chunkList(data)
+	if err != nil {
+		return nil, err
+	}
+	chunks := make(map[string][]byte)
+	for _, chunk := range list {
+		chunks[chunk.name] = chunk.data
+	}
+	return chunks, nil
+}
+
+// chunkList returns the chunks after the 8 bytes of the signature in file order
+func chunkList(data []byte) ([]pngChunk, error) {
+	var chunks []pngChunk
+	for i := 8; i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		if length < 0 || i+12+length > len(data) {
+			return nil, errors.New("truncated chunk")
+		}
+		chunks = append(chunks, pngChunk{name: string(data[i+4 : i+8]), data: data[i+8 : i+8+length]})
+		i += 12 + length
+	}
+	return chunks, nil
+}
+
+// cellAt returns the color of the k-th cell of the grid, from its center pixel, which grid lines never cover
+func cellAt(img image.Image, k int, maxX int, cellsize int) color.NRGBA {
+	bounds := img.Bounds()
+	x, y := bounds.Min.X+(k%maxX)*cellsize+cellsize/2, bounds.Min.Y+(k/maxX)*cellsize+cellsize/2
+	return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+}
+
+// measureCellsize returns the size of the cells in the image, which is the stated size of the header unless the
+// image was resized by an integer factor, or 0 if no size fits the image. The first cell is the header, its run
+// of identical pixels along the first row and column is the cell size, less the width of the grid lines if the
+// image has them.
+func measureCellsize(img image.Image, stated int) int {
+	if stated < 1 {
+		return 0
+	}
+	bounds := img.Bounds()
+	run := headerRun(img)
+	// A grid line is a pixel of the stated cell size, as wide as the resizing factor
+	sizes := []int{run, run + 1}
+	if stated > 1 && run*stated%(stated-1) == 0 {
+		sizes = []int{run, run * stated / (stated - 1), run + 1}
+	}
+	for _, size := range sizes {
+		if bounds.Dx()%size == 0 && bounds.Dy()%size == 0 && (size%stated == 0 || stated%size == 0) {
+			return size
+		}
+	}
+	return 0
+}
+
+// decodeImage reads the cells and the chunks of an encoded Pollock image
+func decodeImage(data []byte) (compiled, error) {
+	var c compiled
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return c, err
+	}
+	chunks, err := readChunks(data)
+	if err != nil {
+		return c, err
+	}
+	img = srgbImage(img, chunks)
+	img, moved := orient(img)
+	if len(moved) > 0 {
+		logWrapper(fmt.Sprint("Warning: The image was ", moved, ", reading it in its original orientation."))
+	}
+	bounds := img.Bounds()
+	header := color.NRGBAModel.Convert(img.At(bounds.Min.X, bounds.Min.Y)).(color.NRGBA)
+	if header.R != VMAJOR {
+		return c, errors.New(fmt.Sprint("unsupported format version ", header.R, ".", header.G))
+	}
+	stated := int(header.B)
+	cellsize := measureCellsize(img, stated)
+	if stated == 0 {
+		if stated, cellsize = extendedCellsize(img); cellsize == 0 {
+			return c, errors.New("image has no cell size extension cell matching its cells")
+		}
+	}
+	if cellsize == 0 {
+		return c, errors.New(fmt.Sprint("image size doesn't match the cell size ", stated))
+	}
+	if cellsize != stated {
+		logWrapper(fmt.Sprint("Warning: The image was resized, its cells are ", cellsize, " pixels instead of ", stated, "."))
+	}
+	c.minor = int(header.G)
+	c.opts.cellsize = stated
+	maxX, maxY := bounds.Dx()/cellsize, bounds.Dy()/cellsize
+	if maxX*maxY < 2 {
+		return c, errors.New("image has no program size cell")
+	}
+	size := cellAt(img, 1, maxX, cellsize)
+	c.progline = int(size.R)<<16 | int(size.G)<<8 | int(size.B)
+	if c.progline+2 > maxX*maxY {
+		return c, errors.New(fmt.Sprint("image is too small for ", c.progline, " program cells"))
+	}
+	for k := 2; k < c.progline+2; k++ {
+		cell := cellAt(img, k, maxX, cellsize)
+		c.program.r = append(c.program.r, cell.R)
+		c.program.g = append(c.program.g, cell.G)
+		c.program.b = append(c.program.b, cell.B)
+	}
+	for k := c.progline + 2; k < maxX*maxY; k++ {
+		cell := cellAt(img, k, maxX, cellsize)
+		if cell.A == 0 || cell.R == 0 {
+			break
+		}
+		c.extensions = append(c.extensions, [3]uint8{cell.R, cell.G, cell.B})
+	}
+	// The features are checked before the program cells are read, the cell size is known by now
+	if err := c.checkFeatures(); err != nil {
+		return c, err
+	}
+	c.extensions = slices.DeleteFunc(c.extensions, func(ext [3]uint8) bool {
+		return ext[0] == extCellsize
+	})
+	if c.minor >= 1 {
+		if err := c.program.expandRuns(); err != nil {
+			return c, err
+		}
+		c.progline = len(c.program.r)
+	}
+	if err := c.readTables(chunks); err != nil {
+		return c, err
+	}
+	c.signature = chunks["plSg"]
+	_, c.opts.symbols = chunks["plSy"]
+	return c, c.readSourceMap(chunks["plSm"])
+}
+
+// readTables reads the export, symbol and relocation tables of the chunks
+func (c *compiled) readTables(chunks map[string][]byte) error {
+	var err error
+	c.labels = make(map[string]int)
+	if c.exports, err = labelTable(chunks["plEx"], c.labels); err != nil {
+		return errors.New(fmt.Sprint("invalid export ", err))
+	}
+	if _, err = labelTable(chunks["plSy"], c.labels); err != nil {
+		return errors.New(fmt.Sprint("invalid symbol ", err))
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(chunks["plRl"])), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var numbers [4]int
+		valid := len(fields) == 5
+		for i := 0; valid && i < 4; i++ {
+			numbers[i], err = strconv.Atoi(fields[i])
+			valid = err == nil && (numbers[i] >= 0 || (i == 3 && numbers[i] == externAddress))
+		}
+		if !valid || numbers[0] >= c.progline || numbers[1] > 2 || numbers[2] > 4 {
+			return errors.New(fmt.Sprint("invalid relocation \"", line, "\""))
+		}
+		c.relocs = append(c.relocs, reloc{cell: numbers[0], channel: numbers[1], part: numbers[2], address: numbers[3], label: fields[4]})
+	}
+	_, c.relocatable = chunks["plRl"]
+	return nil
+}
+
+// labelTable reads the "NAME ADDRESS" lines of an export or symbol table into labels, and returns the names
+func labelTable(data []byte, labels map[string]int) ([]string, error) {
+	var names []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var name string
+		var address int
+		if len(line) == 0 {
+			continue
+		}
+		if _, err := fmt.Sscan(line, &name, &address); err != nil {
+			return nil, errors.New(fmt.Sprint("\"", line, "\""))
+		}
+		names = append(names, name)
+		labels[name] = address
+	}
+	return names, nil
+}
+
+// decodeFile reads a Pollock image file or object file, the errors are I/O errors or verification failures
+func decodeFile(filename string) (compiled, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return compiled{}, ioError(fmt.Sprint("Fatal error: \"", err, "\""))
+	}
+	decode := decodeImage
+	if bytes.HasPrefix(data, objectSignature) {
+		decode = decodeObject
+	}
+	c, err := decode(data)
+	if err != nil {
+		return c, verifyError(fmt.Sprint("Fatal error: Invalid Pollock image \"", filename, "\": ", err))
+	}
+	return c, nil
+}
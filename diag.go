@@ -0,0 +1,212 @@
+package main
+
+// Caret diagnostics
+//
+// Warnings and syntax errors are printed with the source line and a caret under the offending instruction:
+//   2026/01/02 15:04:05 warning: Unknown instruction "foo" in line: 3, position: G. Replacing with nop. [unknown-op]
+//       3 | push 1; foo; add
+//         |         ^^^
+// The output is colored if it goes to a terminal and the NO_COLOR environment variable is empty.
+//
+// The messages end with the nearest label above the line and the number of lines after it, (in MAIN+5), so the
+// lines of large generated or disassembled programs can be found by their labels.
+//
+// Every warning can be disabled with -Wno- and its code, e.g. -Wno-extra-text, and -Werror turns the remaining
+// warnings into errors: the file is still compiled to the end, so all of them are printed, but no image is written.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// warningCodes are the codes of the warnings, with what they are about
+var warningCodes = []struct {
+	code string
+	help string
+}{
+	{"unknown-op", "unknown instruction"},
+	{"push-no-arg", "push without argument"},
+	{"push-range", "push argument out of range"},
+	{"push-invalid", "invalid push argument"},
+	{"string-invalid", "invalid string literal"},
+	{"string-range", "string literal out of range"},
+	{"empty-instr", "empty instruction"},
+	{"extra-text", "dropped extra text"},
+	{"missing-instr", "missing instruction"},
+	{"pragma-unknown", "unknown pragma"},
+	{"pragma-invalid", "invalid pragma"},
+	{"contract-invalid", "invalid stack contract"},
+	{"stack-contract", "broken stack contract"},
+}
+
+// Items of a line which are not instructions
+const (
+	wholeLine = -1
+	labelItem = -2
+)
+
+const (
+	colorReset   = "\x1b[0m"
+	colorGutter  = "\x1b[34m"
+	colorWarning = "\x1b[1;33m"
+	colorError   = "\x1b[1;31m"
+)
+
+// colorEnabled tells if the output to the file should be colored
+func colorEnabled(f *os.File) bool {
+	if len(os.Getenv("NO_COLOR")) > 0 {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// itemSpan returns the byte offsets of an instruction in a raw source line, item is its index in the line,
+// or wholeLine or labelItem. A missing instruction is placed after the end of the line, and the whole line of a
+// comment is its comment.
+func itemSpan(line []byte, item int) (start int, end int) {
+	var bounds [][2]int
+	var quote byte
+	escaped := false
+	begin := 0
+	label := -1
+	stop := len(line)
+	for i, c := range line {
+		if quote != 0 {
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if c == '#' {
+			stop = i
+			break
+		}
+		switch c {
+		case '"', '\'':
+			quote = c
+		case ':':
+			if label < 0 && len(bounds) == 0 {
+				label = i
+				begin = i + 1
+			}
+		case ';':
+			bounds = append(bounds, [2]int{begin, i})
+			begin = i + 1
+		}
+	}
+	bounds = append(bounds, [2]int{begin, stop})
+	trim := func(span [2]int) (int, int) {
+		for span[0] < span[1] && isSpace(line[span[0]]) {
+			span[0]++
+		}
+		for span[1] > span[0] && isSpace(line[span[1]-1]) {
+			span[1]--
+		}
+		return span[0], span[1]
+	}
+	switch {
+	case item == labelItem && label >= 0:
+		return trim([2]int{0, label})
+	case item >= 0 && item < len(bounds):
+		return trim(bounds[item])
+	case item >= len(bounds):
+		_, end = trim([2]int{0, stop})
+		return end, end
+	}
+	if start, end = trim([2]int{0, stop}); start == end {
+		// A comment line, like a pragma
+		return trim([2]int{0, len(line)})
+	}
+	return start, end
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// snippet renders the source line with a caret under the span, lineno is 0 based
+func snippet(line []byte, lineno int, start int, end int, color bool, caretColor string) string {
+	line = []byte(strings.TrimRight(string(line), "\r"))
+	number := fmt.Sprint(lineno + 1)
+	gutter := strings.Repeat(" ", len(number))
+	var caret strings.Builder
+	for _, c := range line[:min(start, len(line))] {
+		if c == '\t' {
+			caret.WriteByte('\t')
+		} else {
+			caret.WriteByte(' ')
+		}
+	}
+	caret.WriteString(strings.Repeat(" ", max(start-len(line), 0)))
+	caret.WriteString(strings.Repeat("^", max(end-start, 1)))
+	if color {
+		return fmt.Sprint(colorGutter, number, " | ", colorReset, string(line), "\n",
+			colorGutter, gutter, " | ", colorReset, caretColor, caret.String(), colorReset, "\n")
+	}
+	return fmt.Sprint(number, " | ", string(line), "\n", gutter, " | ", caret.String(), "\n")
+}
+
+// locate returns the column and width of the item for the diagnostics, and its rendered source line
+func (c *compiled) locate(lineno int, item int, caretColor string) (column int, width int, rendered string) {
+	if lineno < 0 || lineno >= len(c.source) {
+		return 0, 0, ""
+	}
+	start, end := itemSpan(c.source[lineno], item)
+	return start + 1, max(end-start, 1), snippet(c.source[lineno], lineno, start, end, c.opts.color, caretColor)
+}
+
+// labelContext returns the nearest label defined in or above the line of the current file and the number of lines
+// after it, the label of a stack contract line, "" if there is none
+func (c *compiled) labelContext(lineno int) string {
+	if c.file >= len(c.files) {
+		return ""
+	}
+	// A stack contract belongs to the routine of the label below it
+	if lineno >= 0 && lineno < len(c.source) && isContract(c.source[lineno]) {
+		for i := lineno + 1; i < len(c.source); i++ {
+			if label, ok := c.files[c.file].labels[i]; ok {
+				return label
+			}
+			if text := bytes.TrimSpace(c.source[i]); len(text) > 0 && text[0] != '#' {
+				break
+			}
+		}
+	}
+	for i := min(lineno, len(c.source)-1); i >= 0; i-- {
+		if label, ok := c.files[c.file].labels[i]; ok {
+			return fmt.Sprint(label, "+", lineno-i)
+		}
+	}
+	return ""
+}
+
+// syntaxError returns a syntax error located at the item of the line, lineno is 0 based
+func (c *compiled) syntaxError(lineno int, item int, code string, msg string) error {
+	column, width, rendered := c.locate(lineno, item, colorError)
+	label := c.labelContext(lineno)
+	if len(label) > 0 {
+		msg = fmt.Sprint(msg, " ", c.opts.message("in-label", label))
+	}
+	if file := c.fileName(); len(file) > 0 {
+		msg = fmt.Sprint(file, ": ", msg)
+	}
+	at := &diagnostic{File: c.fileName(), Line: lineno + 1, Column: column, Width: width, Code: code, Label: label, Level: "error", Message: msg}
+	return &codedError{exit: exitSyntax, code: code, msg: msg, snippet: rendered, at: at}
+}
+
+// errorSnippet returns the rendered source line of the error, empty if it has none
+func errorSnippet(err error) string {
+	var ce *codedError
+	if errors.As(err, &ce) {
+		return ce.snippet
+	}
+	return ""
+}
@@ -0,0 +1,188 @@
+package main
+
+// Directives
+//
+// A line starting with a dot, after its label if it has one, is a directive instead of instructions.
+// .space N reserves N cells of nop, and .space N, instruction fills them with that instruction in all three
+// channels instead, e.g. .space 8, halt. A label on the line is the address of the first reserved cell.
+// .align N pads with nop cells until the address of the next cell is a multiple of N, and .align N, instruction
+// pads with that instruction. A label on the line is the address after the padding, so it is aligned too.
+// .start LABEL makes the VM begin the execution at the label instead of cell 2, so data and library code can
+// come before the main program without a jump. The address is written into an extension cell (kind 2, needs 1.1).
+// .export NAME, NAME... marks labels as public, their addresses are written into the plEx chunk of the PNG file
+// (see chunks.go), so the linker and the VM can call into the image by name.
+// .extern NAME, NAME... declares labels exported by other images, push NAME is filled in by pollock link, and the
+// image gets a relocation table for that.
+// Unknown directives and invalid arguments are syntax errors.
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Largest number of cells a directive may add
+const maxDirectiveCells = 1 << 20
+
+// directives maps the directive names to their handlers, which get the statement of the line and the cleaned
+// argument and return the statement with the cells of the directive
+var directives = []struct {
+	name   string
+	handle func(c *compiled, s statement, arg string) (statement, error)
+}{
+	{".space", (*compiled).space},
+	{".align", (*compiled).align},
+	{".start", (*compiled).startAt},
+	{".export", (*compiled).export},
+	{".extern", (*compiled).extern},
+}
+
+// directive parses a cleaned directive line into the statement of the line
+// The whitespace is already removed, so the name is recognized as a prefix
+func (c *compiled) directive(s statement, line []byte) (statement, error) {
+	for _, d := range directives {
+		if arg, ok := strings.CutPrefix(string(line), d.name); ok {
+			return d.handle(c, s, arg)
+		}
+	}
+	return s, c.syntaxError(s.lineno, wholeLine, "directive-unknown", c.opts.message("directive-unknown", string(line), s.lineno+1))
+}
+
+// appendCell adds a program cell
+func (c *compiled) appendCell(r uint8, g uint8, b uint8) {
+	c.program.r = append(c.program.r, r)
+	c.program.g = append(c.program.g, g)
+	c.program.b = append(c.program.b, b)
+	c.progline++
+}
+
+// fillerArgs parses the count and the optional filler instruction of .space and .align
+func (c *compiled) fillerArgs(lineno int, name string, arg string, least int64) (int64, uint8, error) {
+	count, filler, _ := strings.Cut(arg, ",")
+	n, err := parseLiteral(count)
+	if err != nil || n < least || n > maxDirectiveCells {
+		return 0, 0, c.syntaxError(lineno, wholeLine, "directive-invalid", c.opts.message("directive-count", count, name, lineno+1))
+	}
+	if len(filler) == 0 {
+		filler = "nop"
+	}
+	token, err := tokenize([]byte(filler))
+	if err != nil {
+		return 0, 0, c.syntaxError(lineno, wholeLine, "directive-invalid", c.opts.message("directive-filler", filler, name, lineno+1))
+	}
+	if tokenMinor(token) > c.minor {
+		c.minor = tokenMinor(token)
+		c.opts.logMsg(fmt.Sprint("Instruction \"", filler, "\" in line: ", lineno+1, " needs format version ", VMAJOR, ".", c.minor, "."))
+	}
+	return n, token, nil
+}
+
+// space reserves cells filled with nop or the instruction given after the count
+func (c *compiled) space(s statement, arg string) (statement, error) {
+	n, token, err := c.fillerArgs(s.lineno, ".space", arg, 0)
+	if err != nil {
+		return s, err
+	}
+	s.tokens, s.reserved = bytes.Repeat([]byte{token}, int(3*n)), true
+	c.opts.logMsg(fmt.Sprint("Reserved ", n, " cells in line: ", s.lineno+1, "."))
+	return s, nil
+}
+
+// align records the alignment, the padding is added when the statement gets its address
+func (c *compiled) align(s statement, arg string) (statement, error) {
+	var err error
+	s.align, s.filler, err = c.fillerArgs(s.lineno, ".align", arg, 1)
+	return s, err
+}
+
+// startAt records the entry label, which is resolved after the whole file is read
+func (c *compiled) startAt(s statement, arg string) (statement, error) {
+	lineno := s.lineno
+	validLabel, _ := regexp.Compile(`^[A-Z][A-Z0-9]{0,6}$`)
+	if !validLabel.MatchString(arg) {
+		return s, c.syntaxError(lineno, wholeLine, "directive-invalid", c.opts.message("start-invalid", arg, lineno+1))
+	}
+	if len(c.start) > 0 {
+		return s, c.syntaxError(lineno, wholeLine, "directive-invalid", c.opts.message("start-second", lineno+1, c.startLine+1))
+	}
+	c.start, c.startFile, c.startLine = arg, s.file, lineno
+	return s, nil
+}
+
+// resolveStart writes the extension cell of the entry point, if the program has one
+func (c *compiled) resolveStart() error {
+	if len(c.start) == 0 {
+		return nil
+	}
+	c.setFile(c.startFile)
+	address, ok := c.labels[c.start]
+	if !ok {
+		return c.syntaxError(c.startLine, wholeLine, "label-undefined", c.opts.message("label-undefined", c.start, c.startLine+1))
+	}
+	if address > 0xFFFF {
+		return c.syntaxError(c.startLine, wholeLine, "directive-invalid", c.opts.message("start-range", c.start, c.startLine+1))
+	}
+	c.extensions = append(c.extensions, [3]uint8{extEntry, uint8(address >> 8), uint8(address)})
+	c.opts.logMsg(fmt.Sprint("Entry point: ", c.start, " at address ", address, "."))
+	if c.minor < 1 {
+		c.minor = 1
+		c.opts.logMsg(fmt.Sprint("Entry point needs format version ", VMAJOR, ".", c.minor, "."))
+	}
+	return nil
+}
+
+// export records the exported labels, which are resolved after the whole file is read
+func (c *compiled) export(s statement, arg string) (statement, error) {
+	lineno := s.lineno
+	validLabel, _ := regexp.Compile(`^[A-Z][A-Z0-9]{0,6}$`)
+	for _, name := range strings.Split(arg, ",") {
+		if !validLabel.MatchString(name) {
+			return s, c.syntaxError(lineno, wholeLine, "directive-invalid", c.opts.message("export-invalid", name, lineno+1))
+		}
+		for _, exported := range c.exports {
+			if exported == name {
+				return s, c.syntaxError(lineno, wholeLine, "directive-invalid", c.opts.message("export-twice", name, lineno+1))
+			}
+		}
+		c.exports = append(c.exports, name)
+		c.exportFiles = append(c.exportFiles, s.file)
+		c.exportLines = append(c.exportLines, lineno)
+	}
+	return s, nil
+}
+
+// resolveExports checks that every exported label is defined
+func (c *compiled) resolveExports() error {
+	for i, name := range c.exports {
+		if _, ok := c.labels[name]; !ok {
+			c.setFile(c.exportFiles[i])
+			return c.syntaxError(c.exportLines[i], wholeLine, "label-undefined", c.opts.message("label-undefined", name, c.exportLines[i]+1))
+		}
+	}
+	if len(c.exports) > 0 || len(c.externs) > 0 || c.opts.symbols || c.opts.reloc {
+		// Libraries and their users get a relocation table, so they can be linked, -symbols for pollock extract
+		// and -reloc for rebasing
+		c.relocatable = true
+	}
+	if c.relocatable {
+		c.opts.logMsg(fmt.Sprint("Relocation table with ", len(c.relocs), " entries."))
+	}
+	if len(c.exports) > 0 {
+		c.opts.logMsg(fmt.Sprint("Exported ", len(c.exports), " labels."))
+	}
+	return nil
+}
+
+// extern records the labels exported by other images
+func (c *compiled) extern(s statement, arg string) (statement, error) {
+	lineno := s.lineno
+	validLabel, _ := regexp.Compile(`^[A-Z][A-Z0-9]{0,6}$`)
+	for _, name := range strings.Split(arg, ",") {
+		if !validLabel.MatchString(name) {
+			return s, c.syntaxError(lineno, wholeLine, "directive-invalid", c.opts.message("extern-invalid", name, lineno+1))
+		}
+		c.externs = append(c.externs, name)
+	}
+	return s, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+// Environment variable overrides
+//
+// Every flag can also be set with a POLLOCK_ environment variable, e.g. POLLOCK_CELLSIZE=20 or POLLOCK_SILENT=true,
+// so CI jobs and containers can configure the compiler without wrapper scripts. A flag given on the command line
+// wins over the environment, and the environment wins over the default. Invalid values are usage errors.
+// The -Wno- flags are set with POLLOCK_WNO_ and the warning code, e.g. POLLOCK_WNO_EXTRA_TEXT=true. -version has no
+// variable, POLLOCK_VERSION is commonly set to pin the installed version of the tool.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envNames maps the flags to their environment variables
+var envNames = map[string]string{
+	"f":           "POLLOCK_FILE",
+	"o":           "POLLOCK_OUTPUT",
+	"outdir":      "POLLOCK_OUTPUT_DIR",
+	"d":           "POLLOCK_DRYRUN",
+	"s":           "POLLOCK_SILENT",
+	"b":           "POLLOCK_BYTEARRAY",
+	"a":           "POLLOCK_FORCE",
+	"progress":    "POLLOCK_PROGRESS",
+	"preview":     "POLLOCK_PREVIEW",
+	"inline":      "POLLOCK_INLINE",
+	"format":      "POLLOCK_FORMAT",
+	"grid":        "POLLOCK_GRID",
+	"jitter":      "POLLOCK_JITTER",
+	"background":  "POLLOCK_BACKGROUND",
+	"blend":       "POLLOCK_BLEND",
+	"filler":      "POLLOCK_FILLER",
+	"teach":       "POLLOCK_TEACH",
+	"palette":     "POLLOCK_PALETTE",
+	"thumbs":      "POLLOCK_THUMBS_DIR",
+	"size":        "POLLOCK_THUMB_SIZE",
+	"columns":     "POLLOCK_COLUMNS",
+	"dpi":         "POLLOCK_DPI",
+	"print-width": "POLLOCK_PRINT_WIDTH",
+	"Werror":      "POLLOCK_WERROR",
+	"sarif":       "POLLOCK_SARIF",
+	"lang":        "POLLOCK_LANG",
+	"symbols":     "POLLOCK_SYMBOLS",
+	"reloc":       "POLLOCK_RELOC",
+	"I":           "POLLOCK_INCLUDE",
+	"cache":       "POLLOCK_CACHE",
+	"offline":     "POLLOCK_OFFLINE",
+	"sign":        "POLLOCK_SIGN",
+	"verify-key":  "POLLOCK_VERIFY_KEY",
+	"key":         "POLLOCK_VERIFY_KEY",
+	"shuffle":     "POLLOCK_SHUFFLE",
+	"rle":         "POLLOCK_RLE",
+	"orient":      "POLLOCK_ORIENT",
+	"patch":       "POLLOCK_PATCH",
+	"O":           "POLLOCK_OPTIMIZE",
+	"release":     "POLLOCK_RELEASE",
+	"stats":       "POLLOCK_STATS",
+	"shuffle-key": "POLLOCK_SHUFFLE_KEY",
+	"c":           "POLLOCK_CELLSIZE",
+	"t":           "POLLOCK_TARGET",
+	"wordsize":    "POLLOCK_WORDSIZE",
+	"listen":      "POLLOCK_LISTEN",
+	"from":        "POLLOCK_EXTRACT_FROM",
+	"to":          "POLLOCK_EXTRACT_TO",
+	"seed":        "POLLOCK_GEN_SEED",
+	"cells":       "POLLOCK_GEN_CELLS",
+	"gen":         "POLLOCK_ROUNDTRIP_PROGRAMS",
+	"dir":         "POLLOCK_EXAMPLES_DIR",
+	"update":      "POLLOCK_EXAMPLES_UPDATE",
+}
+
+// applyEnv sets the flags which were not given on the command line from their environment variables
+func applyEnv(flags *flag.FlagSet) error {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		name, ok := envNames[f.Name]
+		if code, found := strings.CutPrefix(f.Name, "Wno-"); found {
+			name, ok = "POLLOCK_WNO_"+strings.ToUpper(strings.ReplaceAll(code, "-", "_")), true
+		}
+		if !ok || given[f.Name] || err != nil {
+			return
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = usageError(fmt.Sprint("Fatal error: Invalid value \"", value, "\" in ", name, ": ", setErr))
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,125 @@
+package main
+
+// Golden example images, with "pollock examples verify [-dir testdata/examples] [-update]"
+//
+// Every program under the testdata/examples directory, NAME.plk, has its golden image NAME.png committed next to it.
+// pollock examples verify compiles the programs with the default options and their pragmas and compares the pixels of
+// the images with the golden ones, so a change of the layout or of the colors shows up as drift: a different image
+// size, or the first cell whose pixels changed. -update writes the golden images of the programs instead, after a
+// deliberate change. The outputs of running the programs belong to the VM, they are not checked here. go test verifies
+// the examples too.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// registerExamples registers the flags of the examples subcommand
+func registerExamples(flags *flag.FlagSet, dir *string, update *bool) {
+	flags.StringVar(dir, "dir", "testdata/examples", "Directory of the example programs and their golden images, default is testdata/examples")
+	flags.BoolVar(update, "update", false, "Write the golden images instead of comparing them, default is false")
+	flags.BoolVar(&silent, "s", false, "Run in silent mode, default is false")
+}
+
+// imageDrift describes how the image differs from the golden image, "" if they have the same pixels
+func imageDrift(img image.Image, golden image.Image, cellsize int) string {
+	if img.Bounds().Size() != golden.Bounds().Size() {
+		return fmt.Sprint("the image is ", img.Bounds().Dx(), "x", img.Bounds().Dy(), " pixels instead of ", golden.Bounds().Dx(), "x", golden.Bounds().Dy())
+	}
+	maxX := img.Bounds().Dx() / cellsize
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			pixel := color.NRGBAModel.Convert(img.At(img.Bounds().Min.X+x, img.Bounds().Min.Y+y))
+			if pixel != color.NRGBAModel.Convert(golden.At(golden.Bounds().Min.X+x, golden.Bounds().Min.Y+y)) {
+				return fmt.Sprint("cell ", y/cellsize*maxX+x/cellsize, " differs from pixel ", x, ",", y, " on")
+			}
+		}
+	}
+	return ""
+}
+
+// verifyExample compiles the example and compares its image with the golden image, or writes it with update
+func verifyExample(filename string, update bool) error {
+	source, err := os.ReadFile(filename)
+	if err != nil {
+		return ioError(fmt.Sprint("Fatal error: \"", err, "\""))
+	}
+	opts, err := newOptions(10, "1.0", 8)
+	if err != nil {
+		return err
+	}
+	opts.sourceName = filename
+	opts.logger = log.New(io.Discard, "", 0)
+	c, err := compile(source, opts)
+	if err != nil {
+		return err
+	}
+	opts = c.opts
+	golden := filename[:len(filename)-len(".plk")] + ".png"
+	if update {
+		return writeImage(c, golden, opts)
+	}
+	data, err := os.ReadFile(golden)
+	if err != nil {
+		return ioError(fmt.Sprint("Fatal error: No golden image for \"", filename, "\": \"", err, "\""))
+	}
+	want, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return verifyError(fmt.Sprint("Fatal error: Invalid golden image \"", golden, "\": ", err))
+	}
+	if drift := imageDrift(render(c.written(opts), opts.cellsize), want, opts.cellsize); len(drift) > 0 {
+		return verifyError(fmt.Sprint("Fatal error: \"", filename, "\" drifted from \"", golden, "\": ", drift, "."))
+	}
+	return nil
+}
+
+// examples parses the flags of the examples subcommand, verifies the examples and returns the exit code
+func examples(args []string) int {
+	var dir string
+	var update bool
+
+	flags := flag.NewFlagSet("examples", flag.ExitOnError)
+	registerExamples(flags, &dir, &update)
+	if len(args) == 0 || args[0] != "verify" {
+		err := usageError("Fatal error: Unknown examples command, must be verify.")
+		log.Println(err)
+		return exitCode(err)
+	}
+	flags.Parse(args[1:])
+	err := applyEnv(flags)
+	var files []string
+	if err == nil {
+		files, err = expandPatterns([]string{filepath.Join(dir, "...")})
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+
+	status, drifted := exitOK, 0
+	for _, filename := range files {
+		if err := verifyExample(filename, update); err != nil {
+			log.Println(err)
+			drifted++
+			if status == exitOK {
+				status = exitCode(err)
+			}
+			continue
+		}
+		if update {
+			logWrapper(fmt.Sprint("Updated the golden image of \"", filename, "\"."))
+		}
+	}
+	if !update {
+		logWrapper(fmt.Sprint(len(files)-drifted, " of ", len(files), " examples match their golden images."))
+	}
+	return status
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestExamples(t *testing.T) {
+	silent = true
+	files, err := filepath.Glob(filepath.Join("testdata", "examples", "*.plk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no examples in testdata/examples")
+	}
+	for _, filename := range files {
+		t.Run(filepath.Base(filename), func(t *testing.T) {
+			if err := verifyExample(filename, false); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
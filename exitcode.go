@@ -0,0 +1,82 @@
+package main
+
+// Exit codes and diagnostic codes
+//
+// Every class of failure exits with its own code, so wrappers can branch on it instead of parsing the messages:
+// 0 success, 1 internal error, 2 usage error (invalid flags, options or patterns), 3 syntax error,
+// 4 I/O error (reading the source, writing the image), 5 verification failure (an input image which is not a
+// valid Pollock image, or not signed with the -verify-key) and 6 VM trap. 6 is reserved for the VM, which is not part of this build.
+// A batch exits with the code of its first failed file, in file order.
+//
+// Every diagnostic and syntax error also has a short code, e.g. unknown-op or label-undefined, which is
+// returned by pollock serve next to the message.
+
+import (
+	"errors"
+	"log"
+	"os"
+)
+
+const (
+	exitOK       = 0
+	exitInternal = 1
+	exitUsage    = 2
+	exitSyntax   = 3
+	exitIO       = 4
+	exitVerify   = 5
+	exitTrap     = 6
+)
+
+// codedError is an error of a failure class, with its exit code and diagnostic code
+// snippet is the rendered source line of a syntax error and at its diagnostic
+type codedError struct {
+	exit    int
+	code    string
+	msg     string
+	snippet string
+	at      *diagnostic
+}
+
+func (e *codedError) Error() string {
+	return e.msg
+}
+
+func usageError(msg string) error {
+	return &codedError{exit: exitUsage, code: "usage", msg: msg}
+}
+
+func ioError(msg string) error {
+	return &codedError{exit: exitIO, code: "io", msg: msg}
+}
+
+func verifyError(msg string) error {
+	return &codedError{exit: exitVerify, code: "verify", msg: msg}
+}
+
+// exitCode returns the exit code of the failure class of the error
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var ce *codedError
+	if errors.As(err, &ce) {
+		return ce.exit
+	}
+	return exitInternal
+}
+
+// errorCode returns the diagnostic code of the error, empty if it has none
+func errorCode(err error) string {
+	var ce *codedError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	return ""
+}
+
+// fatal logs the error with its source line and exits with the code of its class
+func fatal(err error) {
+	log.Println(err)
+	os.Stderr.WriteString(errorSnippet(err))
+	os.Exit(exitCode(err))
+}
@@ -0,0 +1,138 @@
+package main
+
+// Extraction of routines from images, with "pollock extract -o lib.png -from START -to END art.png"
+//
+// The program cells from the label START up to the label END (or the end of the program without -to) are copied
+// into a new library image, which can be linked with pollock link. The image must be compiled with -symbols, so it
+// has the addresses of all the labels and the relocation table. In the region, the label addresses are rebased, the
+// labels are exported and the labels outside of it become external labels, filled in when the library is linked.
+// Jumps to literal addresses instead of labels can't be told apart from other pushes and are copied as they are.
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// registerExtract registers the flags of the extract subcommand
+func registerExtract(flags *flag.FlagSet, outputfile *string, from *string, to *string, keyfile *string, shuffleKey *string) {
+	flags.StringVar(outputfile, "o", "", "Output file name, mandatory")
+	flags.StringVar(keyfile, "verify-key", "", "Ed25519 public key in PEM format the image must be signed with, default is no check")
+	flags.StringVar(shuffleKey, "shuffle-key", "", "Key of the shuffled image, default is none")
+	flags.StringVar(from, "from", "", "Label of the first cell of the region, mandatory")
+	flags.StringVar(to, "to", "", "Label after the last cell of the region, default is the end of the program")
+	flags.BoolVar(&silent, "s", false, "Run in silent mode, default is false")
+}
+
+// extractRegion returns the library image of the cells from the label from up to the label to, name is used in
+// the errors
+func extractRegion(img compiled, name string, from string, to string) (compiled, error) {
+	var lib compiled
+	if _, ok := img.labels[from]; !ok || !img.relocatable {
+		return lib, usageError(fmt.Sprint("Fatal error: \"", name, "\" has no symbol table with label \"", from, "\", compile it with -symbols."))
+	}
+	start, end := img.labels[from], img.progline+2
+	if len(to) > 0 {
+		var ok bool
+		if end, ok = img.labels[to]; !ok {
+			return lib, usageError(fmt.Sprint("Fatal error: \"", name, "\" has no label \"", to, "\"."))
+		}
+	}
+	if start >= end {
+		return lib, usageError(fmt.Sprint("Fatal error: Label \"", from, "\" doesn't come before the end of the region."))
+	}
+
+	// Addresses are 2 for the first program cell
+	first, last := start-2, end-2
+	lib.program = progarray{
+		r: append([]uint8(nil), img.program.r[first:last]...),
+		g: append([]uint8(nil), img.program.g[first:last]...),
+		b: append([]uint8(nil), img.program.b[first:last]...),
+	}
+	lib.progline = last - first
+	lib.minor = img.minor
+	lib.opts.cellsize = img.opts.cellsize
+	lib.opts.symbols = true
+	lib.relocatable = true
+	if wordsize, ok := img.extension(extWordSize); ok {
+		lib.extensions = append(lib.extensions, [3]uint8{extWordSize, uint8(wordsize >> 8), uint8(wordsize)})
+	}
+	lib.labels = make(map[string]int)
+	for label, address := range img.labels {
+		if address >= start && address < end {
+			lib.labels[label] = address - first
+			lib.exports = append(lib.exports, label)
+		}
+	}
+	sort.Slice(lib.exports, func(i, j int) bool {
+		if lib.labels[lib.exports[i]] != lib.labels[lib.exports[j]] {
+			return lib.labels[lib.exports[i]] < lib.labels[lib.exports[j]]
+		}
+		return lib.exports[i] < lib.exports[j]
+	})
+
+	externs := make(map[string]bool)
+	for _, r := range img.relocs {
+		if r.cell < first || r.cell >= last {
+			continue
+		}
+		r.cell -= first
+		if r.address >= start && r.address < end {
+			r.address -= first
+			if err := lib.program.relocate(r, r.address); err != nil {
+				return lib, usageError(fmt.Sprint("Fatal error: ", err, "."))
+			}
+		} else {
+			// Filled in by the linker
+			r.address = externAddress
+			externs[r.label] = true
+		}
+		lib.relocs = append(lib.relocs, r)
+	}
+	logWrapper(fmt.Sprint("Extracted ", lib.progline, " cells with ", len(lib.exports), " exported and ", len(externs), " external labels."))
+	return lib, nil
+}
+
+// extract parses the flags of the extract subcommand, extracts the region and returns the exit code
+func extract(args []string) int {
+	var outputfile, from, to, keyfile, shuffleKey string
+
+	flags := flag.NewFlagSet("extract", flag.ExitOnError)
+	registerExtract(flags, &outputfile, &from, &to, &keyfile, &shuffleKey)
+	flags.Parse(args)
+	err := applyEnv(flags)
+	if err == nil && len(outputfile) == 0 {
+		err = usageError("Fatal error: Output file is required.")
+	}
+	if err == nil && len(from) == 0 {
+		err = usageError("Fatal error: The first label of the region is required.")
+	}
+	if err == nil && flags.NArg() != 1 {
+		err = usageError("Fatal error: Exactly one image is needed.")
+	}
+	var key ed25519.PublicKey
+	if err == nil {
+		key, err = verifyKeyFlag(keyfile)
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+
+	name := flags.Arg(0)
+	logWrapper(fmt.Sprint("Reading image: ", name))
+	img, err := decodeVerified(name, key, shuffleKey)
+	if err == nil {
+		var lib compiled
+		if lib, err = extractRegion(img, name, from, to); err == nil {
+			err = writeImage(lib, outputfile, lib.opts)
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+	return exitOK
+}
@@ -0,0 +1,367 @@
+package main
+
+// Guaranteed runtime faults
+//
+// After the labels have their addresses the program is run symbolically from its entry: the values of the push
+// literals, pusha and the arithmetic on them are followed on an abstract stack, the values of input, of the host
+// and under the known part of the stack are unknown. The stacks of the paths meeting at a label or at a jump target
+// are joined, a value stays known if it is the same on every path, and the jumps with a known condition and a
+// known address only go one way, so the code behind a jump which is never taken isn't checked. A value outside the
+// range of the word size is unknown, so the result is the same with every VM. Three faults are certain when their
+// instruction runs and are syntax errors listing the lines the values come from: a division or a remainder by 0,
+// a jump which is always taken to an address outside the program, and one into the data cells of a .space without
+// a filler instruction. A jump to an unknown address may go to any labeled cell. The cells of .extern labels hold 0
+// until they are linked, so their values are unknown, and the addresses of a relocatable image, -reloc or an object
+// file, may be rebased, so a jump out of it is no fault.
+
+import (
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Most source lines kept for a value
+const maxOrigins = 8
+
+// absValue is a value of the abstract stack, with the positions of the tokens it was computed by
+type absValue struct {
+	known   bool
+	value   int
+	origins []int
+}
+
+// absStack is the known top of the stack, the values under it are unknown
+type absStack []absValue
+
+// pop removes the top value, unknown if the stack has no known values left
+func (s *absStack) pop() absValue {
+	if len(*s) == 0 {
+		return absValue{}
+	}
+	v := (*s)[len(*s)-1]
+	*s = (*s)[:len(*s)-1]
+	return v
+}
+
+// push adds a value on the top
+func (s *absStack) push(v absValue) {
+	*s = append(*s, v)
+}
+
+// join returns the values known on both stacks, lined up at their tops
+func (s absStack) join(other absStack) absStack {
+	n := min(len(s), len(other))
+	joined := make(absStack, n)
+	for i := 0; i < n; i++ {
+		a, b := s[len(s)-n+i], other[len(other)-n+i]
+		if a.known && b.known && a.value == b.value {
+			joined[i] = a
+		}
+	}
+	return joined
+}
+
+// same tells if the stacks hold the same values
+func (s absStack) same(other absStack) bool {
+	return slices.EqualFunc(s, other, func(a absValue, b absValue) bool {
+		return a.known == b.known && (!a.known || a.value == b.value)
+	})
+}
+
+// derived returns the value computed by the token at pos from the operands, unknown if one of them is or if it
+// doesn't fit the word size
+func derived(value int, ok bool, pos int, wordsize int, operands ...absValue) absValue {
+	limit := 1 << (wordsize - 1)
+	if !ok || value < -limit || value >= limit {
+		return absValue{}
+	}
+	var origins []int
+	for _, operand := range operands {
+		if !operand.known {
+			return absValue{}
+		}
+		origins = append(origins, operand.origins...)
+	}
+	origins = append(origins, pos)
+	slices.Sort(origins)
+	origins = slices.Compact(origins)
+	return absValue{known: true, value: value, origins: origins[max(0, len(origins)-maxOrigins):]}
+}
+
+// evaluate returns the result of an arithmetic instruction on known operands, false if it isn't one
+func (c *compiled) evaluate(name string, a int, b int) (int, bool) {
+	switch name {
+	case "add":
+		return a + b, true
+	case "sub":
+		return a - b, true
+	case "mul":
+		return a * b, true
+	case "div", "rem":
+		if b == 0 {
+			return 0, false
+		}
+		if name == "rem" {
+			return a % b, true
+		}
+		return a / b, true
+	case "and":
+		return a & b, true
+	case "or":
+		return a | b, true
+	case "gt":
+		return truth(a > b), true
+	case "eq":
+		return truth(a == b), true
+	case "lt":
+		return truth(a < b), true
+	case "shl", "shr":
+		if b < 0 || b >= c.opts.wordsize {
+			return 0, false
+		}
+		if name == "shr" {
+			return a >> b, true
+		}
+		return a << b, true
+	}
+	return 0, false
+}
+
+// runtimeFault is a fault found by the symbolic execution, at the position of its instruction
+type runtimeFault struct {
+	pos     int
+	code    string
+	msg     string
+	origins []int
+}
+
+// faultFinder runs the program symbolically, states holds the stacks at the leaders, the positions where paths
+// meet
+type faultFinder struct {
+	c       *compiled
+	leaders map[int]bool
+	labeled []int
+	// The positions of the push literals of .extern labels
+	externs map[int]bool
+	states  map[int]absStack
+	work    []int
+	// A jump to a position which is not a leader makes it one, and the analysis starts again
+	restart bool
+	faults  []runtimeFault
+	report  bool
+}
+
+// reach joins the stack into the state of a leader, which is run again if it changed
+func (f *faultFinder) reach(pos int, stack absStack) {
+	if !f.leaders[pos] {
+		f.leaders[pos], f.restart = true, true
+		return
+	}
+	old, ok := f.states[pos]
+	joined := slices.Clone(stack)
+	if ok {
+		joined = old.join(stack)
+		if joined.same(old) {
+			return
+		}
+	}
+	f.states[pos] = joined
+	f.work = append(f.work, pos)
+}
+
+// fault records a fault in the report run
+func (f *faultFinder) fault(pos int, code string, msg string, origins ...[]int) {
+	if f.report {
+		f.faults = append(f.faults, runtimeFault{pos: pos, code: code, msg: msg, origins: slices.Concat(origins...)})
+	}
+}
+
+// run follows the program from a leader up to the next leader, a jump or a halt
+func (f *faultFinder) run(start int) {
+	c := f.c
+	stack := slices.Clone(f.states[start])
+	end := 3 * c.progline
+	for pos := start; pos < end; pos++ {
+		if pos != start && f.leaders[pos] {
+			f.reach(pos, stack)
+			return
+		}
+		token := c.token(pos)
+		if token&0b1000_0000 == 0 {
+			if f.externs[pos] {
+				stack.push(absValue{})
+			} else {
+				stack.push(absValue{known: true, value: int(token), origins: []int{pos}})
+			}
+			continue
+		}
+		name := mnemonic(token)
+		switch {
+		case token == pushaToken:
+			stack.push(absValue{known: true, value: pos/3 + 2, origins: []int{pos}})
+		case name == "dup":
+			v := stack.pop()
+			stack.push(v)
+			stack.push(v)
+		case name == "swap":
+			b, a := stack.pop(), stack.pop()
+			stack.push(b)
+			stack.push(a)
+		case name == "rot":
+			x3, x2, x1 := stack.pop(), stack.pop(), stack.pop()
+			stack.push(x2)
+			stack.push(x3)
+			stack.push(x1)
+		case name == "over":
+			b, a := stack.pop(), stack.pop()
+			stack.push(a)
+			stack.push(b)
+			stack.push(a)
+		case name == "nip":
+			b := stack.pop()
+			stack.pop()
+			stack.push(b)
+		case name == "tuck":
+			b, a := stack.pop(), stack.pop()
+			stack.push(b)
+			stack.push(a)
+			stack.push(b)
+		case name == "pick":
+			stack.pop()
+			stack.push(absValue{})
+		case name == "roll" || name == "hostcall":
+			// The values under the top may move or change
+			stack = nil
+		case name == "not" || name == "neg":
+			a := stack.pop()
+			value := ^a.value
+			if name == "neg" {
+				value = -a.value
+			}
+			stack.push(derived(value, true, pos, c.opts.wordsize, a))
+		case strings.HasPrefix(name, "addi") || strings.HasPrefix(name, "subi") || strings.HasPrefix(name, "muli"):
+			a := stack.pop()
+			value, ok := c.evaluate(name[:3], a.value, int(name[4]-'0'))
+			stack.push(derived(value, ok, pos, c.opts.wordsize, a))
+		case condJumps[name] || fusedJumps[name]:
+			address := stack.pop()
+			taken, sure := true, false
+			var because []int
+			if fusedJumps[name] {
+				b, a := stack.pop(), stack.pop()
+				if a.known && b.known {
+					result, _ := c.evaluate(strings.TrimPrefix(name, "j"), a.value, b.value)
+					taken, sure, because = result != 0, true, slices.Concat(a.origins, b.origins)
+				}
+			} else if condition := stack.pop(); condition.known {
+				taken, sure, because = (condition.value == 0) == (name == "jmpz"), true, condition.origins
+			}
+			if taken {
+				f.jump(pos, address, sure, because, stack)
+			}
+			if sure && taken {
+				return
+			}
+		case stops[name]:
+			return
+		default:
+			pops, pushes := stackEffect(name)
+			var operands []absValue
+			for i := 0; i < pops; i++ {
+				operands = append([]absValue{stack.pop()}, operands...)
+			}
+			if (name == "div" || name == "rem") && operands[1].known && operands[1].value == 0 {
+				f.fault(pos, "fault-div-zero", c.opts.message("fault-div-zero"), operands[1].origins)
+			}
+			if pops == 2 && pushes == 1 {
+				value, ok := c.evaluate(name, operands[0].value, operands[1].value)
+				stack.push(derived(value, ok, pos, c.opts.wordsize, operands...))
+				continue
+			}
+			for i := 0; i < pushes; i++ {
+				stack.push(absValue{})
+			}
+		}
+	}
+}
+
+// jump follows a jump which may be taken, sure if it always is
+func (f *faultFinder) jump(pos int, address absValue, sure bool, because []int, stack absStack) {
+	c := f.c
+	if !address.known {
+		for _, target := range f.labeled {
+			f.reach(target, nil)
+		}
+		return
+	}
+	switch {
+	case address.value < 2 || address.value-2 >= c.progline:
+		if sure && !c.relocatable {
+			f.fault(pos, "fault-address", c.opts.message("fault-address", address.value, c.progline+1), address.origins, because)
+		}
+	case c.dataCells[address.value-2]:
+		if sure {
+			f.fault(pos, "fault-data", c.opts.message("fault-data", address.value), address.origins, because)
+		}
+		f.reach(3*(address.value-2), stack)
+	default:
+		f.reach(3*(address.value-2), stack)
+	}
+}
+
+// checkFaults runs the program symbolically and returns the first guaranteed runtime fault as a syntax error
+func (c *compiled) checkFaults() error {
+	if c.progline == 0 {
+		return nil
+	}
+	f := faultFinder{c: c, leaders: map[int]bool{c.entry(): true}, externs: make(map[int]bool)}
+	for _, r := range c.relocs {
+		if r.address == externAddress {
+			f.externs[3*r.cell+r.channel] = true
+		}
+	}
+	for _, address := range c.labels {
+		if address >= 2 && address-2 < c.progline {
+			f.leaders[3*(address-2)] = true
+			f.labeled = append(f.labeled, 3*(address-2))
+		}
+	}
+	sort.Ints(f.labeled)
+	for f.restart = true; f.restart; {
+		f.restart = false
+		f.states = map[int]absStack{c.entry(): nil}
+		f.work = []int{c.entry()}
+		for len(f.work) > 0 && !f.restart {
+			pos := f.work[len(f.work)-1]
+			f.work = f.work[:len(f.work)-1]
+			f.run(pos)
+		}
+	}
+	// The stacks don't change any more, the leaders which were reached are run once more to find the faults
+	f.report = true
+	for pos := range f.states {
+		f.run(pos)
+	}
+	if len(f.faults) == 0 {
+		return nil
+	}
+	slices.SortFunc(f.faults, func(a runtimeFault, b runtimeFault) int { return a.pos - b.pos })
+	first := f.faults[0]
+	cell := first.pos / 3
+	c.setFile(c.cellFiles[cell])
+	lineno := c.cellLines[cell]
+	var lines []string
+	for _, pos := range slices.Sorted(slices.Values(first.origins)) {
+		if line := c.lineRef(pos); len(line) > 0 && !slices.Contains(lines, line) {
+			lines = append(lines, line)
+		}
+	}
+	msg := c.opts.message("fault", first.msg, lineno+1)
+	switch {
+	case len(lines) == 1:
+		msg = c.opts.message("fault-origin", first.msg, lineno+1, lines[0])
+	case len(lines) > 1:
+		msg = c.opts.message("fault-origins", first.msg, lineno+1, strings.Join(lines, ", "))
+	}
+	return c.syntaxError(lineno, wholeLine, first.code, msg)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckFaults(t *testing.T) {
+	reloc := func(opts *options) { opts.reloc = true }
+	tests := []struct {
+		name   string
+		source string
+		edit   func(opts *options)
+		code   string
+	}{
+		{"division by a constant zero", "push 6; push 0; div\nhalt\n", nil, "fault-div-zero"},
+		{"division by a folded zero", "push 6; push 3; push 3\nsub; div; halt\n", nil, "fault-div-zero"},
+		{"division by an input", "push 6; inc; div\nhalt\n", nil, ""},
+		{"jump out of the program", "push 1; push 90; jmpnz\nhalt\n", nil, "fault-address"},
+		{"jump out of a relocatable image", "push 1; push 90; jmpnz\nhalt\n", reloc, ""},
+		{"jump to an extern label", ".extern FOO\npush 3; push FOO; jmpnz\nhalt\n", nil, ""},
+		{"jump into data cells", "push 1; push DATA; jmpnz\nDATA: .space 2\nhalt\n", nil, "fault-data"},
+		{"jump which is never taken", "push 0; push 90; jmpnz\nhalt\n", nil, ""},
+		{"code behind a jump which is always taken", "push 1; push SKIP; jmpnz\npush 0; push 0; div\nSKIP: halt\n", nil, ""},
+		{"jmpz out of the program", "push 0; push 99; jmpz\nhalt; nop; nop\n", nil, "fault-address"},
+		{"jump to an unknown address", "ini; push 1; swap\njmpnz; halt; nop\n", nil, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := testCompile(t, test.source, test.edit)
+			if code := errorCode(err); code != test.code {
+				t.Errorf("got error code %q (%v), want %q", code, err, test.code)
+			}
+		})
+	}
+}
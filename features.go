@@ -0,0 +1,97 @@
+package main
+
+// Required features (v1.1)
+//
+// An image whose cells can't be read right without a feature of the format gets a features extension cell
+// (kind 5) as its first extension cell: [5, features / 256, features % 256], with a bit for every feature the
+// reader needs: 1 wide words (-wordsize 16 and 32), 2 repeat cells (-rle), 4 shuffled cells (-shuffle). The next
+// bits are reserved for the alpha channel, error correction, a data segment and the Hilbert layout of the cells,
+// which this version doesn't implement. Readers check the cell before they look at the program cells and refuse
+// the images with features they don't know, instead of running the wrong cells. The painting modes of the art
+// extension cell (kind 4) change no pixel a reader samples, they are no required feature. The cell is added when
+// the image is written and dropped when it is read back.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The bits of the features extension cell
+const (
+	featureWideWords = 1 << iota
+	featureRepeats
+	featureShuffled
+	featureAlpha
+	featureECC
+	featureDataSegment
+	featureHilbert
+)
+
+// The names of the features, in bit order
+var featureNames = []string{"wide words", "repeat cells", "shuffled cells", "alpha channel", "error correction", "data segment", "Hilbert layout"}
+
+// The features this version reads
+const knownFeatures = featureWideWords | featureRepeats | featureShuffled
+
+// features returns the bits of the features the cells need
+func (c compiled) features() int {
+	features := 0
+	if _, ok := c.extension(extWordSize); ok {
+		features |= featureWideWords
+	}
+	for _, r := range c.program.r {
+		if r == repeatToken {
+			features |= featureRepeats
+			break
+		}
+	}
+	if _, ok := c.extension(extShuffle); ok {
+		features |= featureShuffled
+	}
+	return features
+}
+
+// withFeatures returns the cells with the features cell in front of the extension cells, if they need any feature
+func (c compiled) withFeatures() compiled {
+	if features := c.features(); features > 0 {
+		c.extensions = append([][3]uint8{{extFeatures, uint8(features >> 8), uint8(features)}}, c.extensions...)
+	}
+	return c
+}
+
+// featureList returns the names of the bits of the features, the unnamed ones as "bit N"
+func featureList(features int) string {
+	var names []string
+	for bit := 0; bit < 16; bit++ {
+		if features&(1<<bit) == 0 {
+			continue
+		}
+		if bit < len(featureNames) {
+			names = append(names, featureNames[bit])
+		} else {
+			names = append(names, fmt.Sprint("bit ", bit))
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// checkFeatures drops the features cell of a decoded image, it fails if the image needs features this version
+// doesn't read
+func (c *compiled) checkFeatures() error {
+	features, ok := c.extension(extFeatures)
+	if !ok {
+		return nil
+	}
+	if unknown := features &^ knownFeatures; unknown != 0 {
+		return errors.New("image needs features this version doesn't support: " + featureList(unknown))
+	}
+	var extensions [][3]uint8
+	for _, ext := range c.extensions {
+		if ext[0] != extFeatures {
+			extensions = append(extensions, ext)
+		}
+	}
+	c.extensions = extensions
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+// Generative filler
+//
+// -filler STYLE paints the cells which hold no code, the program cells of three nops, e.g. the padding of .space and
+// .align, and the empty cells at the end of the grid, with paint thrown over the whole image: splatter throws blobs
+// ringed by droplets, drip throws blobs which run down in streaks ending in a drop. The paint takes the colors of
+// the code cells, and the throws are drawn from the SHA-256 hash of the program cells, so every program gets its
+// own artwork and a build of the same program gets the same one. The painted cells are marked in the art extension
+// cell and keep the exact color at their center (see paint.go).
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"image/color"
+)
+
+// The styles of -filler
+var fillerStyles = []string{"drip", "splatter"}
+
+// Largest number of blobs thrown over an image
+const maxSplats = 1024
+
+// splat is a round blob of paint of radius r at x, y, running down drip pixels if it drips
+type splat struct {
+	x    int
+	y    int
+	r    int
+	drip int
+	ink  color.RGBA
+}
+
+// covers tells if the splat paints the pixel at x, y
+func (s splat) covers(x int, y int) bool {
+	dx, dy := x-s.x, y-s.y
+	if dx*dx+dy*dy <= s.r*s.r {
+		return true
+	}
+	if s.drip == 0 {
+		return false
+	}
+	// The streak is half as wide as the blob and ends in a drop
+	drop := dy - s.drip
+	return 2*abs(dx) <= s.r && dy >= 0 && dy <= s.drip || 9*(dx*dx+drop*drop) <= 4*s.r*s.r
+}
+
+// filler is the paint of the filler cells of an image, with the splats over every cell
+type filler struct {
+	splats   []splat
+	cells    map[int][]int
+	maxX     int
+	cellsize int
+}
+
+// isNopCell tells if a program cell is three nops
+func isNopCell(cell color.RGBA) bool {
+	nop, _ := tokenize([]byte("nop"))
+	return cell.R == nop && cell.G == nop && cell.B == nop
+}
+
+// newFiller throws the splats of the style over the image of the cell colors
+func newFiller(style string, colors []color.RGBA, progline int, maxX int, maxY int, cellsize int) *filler {
+	hash := sha256.New()
+	var inks []color.RGBA
+	seen := make(map[color.RGBA]bool)
+	for _, cell := range colors[2 : progline+2] {
+		hash.Write([]byte{cell.R, cell.G, cell.B})
+		if !isNopCell(cell) && !seen[cell] {
+			seen[cell] = true
+			inks = append(inks, cell)
+		}
+	}
+	if len(inks) == 0 {
+		inks = classColors[classLiteral:]
+	}
+	state := binary.BigEndian.Uint64(hash.Sum(nil))
+	random := func(n int) int {
+		state += 0x9E3779B97F4A7C15
+		return int(mix(state) % uint64(max(n, 1)))
+	}
+	f := &filler{cells: make(map[int][]int), maxX: maxX, cellsize: cellsize}
+	width, height := maxX*cellsize, maxY*cellsize
+	for range min(max(maxX*maxY/3, 4), maxSplats) {
+		s := splat{x: random(width), y: random(height), r: cellsize/4 + random(cellsize) + 1, ink: inks[random(len(inks))]}
+		switch style {
+		case "drip":
+			s.drip = s.r + random(3*cellsize)
+			f.add(s, maxY)
+		case "splatter":
+			f.add(s, maxY)
+			for range 3 + random(4) {
+				droplet := splat{x: s.x + random(6*s.r+1) - 3*s.r, y: s.y + random(6*s.r+1) - 3*s.r, r: max(s.r/4, 1), ink: s.ink}
+				f.add(droplet, maxY)
+			}
+		}
+	}
+	return f
+}
+
+// add adds a splat to the cells it may paint
+func (f *filler) add(s splat, maxY int) {
+	index := len(f.splats)
+	f.splats = append(f.splats, s)
+	top, bottom := max(s.y-s.r, 0)/f.cellsize, min((s.y+s.drip+s.r)/f.cellsize, maxY-1)
+	left, right := max(s.x-s.r, 0)/f.cellsize, min((s.x+s.r)/f.cellsize, f.maxX-1)
+	for y := top; y <= bottom; y++ {
+		for x := left; x <= right; x++ {
+			f.cells[y*f.maxX+x] = append(f.cells[y*f.maxX+x], index)
+		}
+	}
+}
+
+// ink returns the color of the last splat painting the pixel at x, y, false if none does
+func (f *filler) ink(x int, y int) (color.RGBA, bool) {
+	splats := f.cells[(y/f.cellsize)*f.maxX+x/f.cellsize]
+	for i := len(splats) - 1; i >= 0; i-- {
+		if s := f.splats[splats[i]]; s.covers(x, y) {
+			return s.ink, true
+		}
+	}
+	return color.RGBA{}, false
+}
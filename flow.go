@@ -0,0 +1,217 @@
+package main
+
+// Control-flow analysis
+//
+// The program is split into basic blocks of tokens, counted over the three channels of the cells. A block starts
+// at the entry cell, at a labeled cell, at a cell a jump goes to and after a jump or a halt. Jumps pop their
+// address, so the target is known when the address was pushed right before the jump, by push LABEL (a literal) or
+// by pusha LABEL (pusha, push DISTANCE, add or sub); other jumps go to a computed address, which may be any labeled
+// cell. jmpz and jmpnz with a condition pushed as a literal right before the address always or never jump.
+// flowGraph adds the predecessors and the blocks reachable from the entry, for pollock cfg and pollock stats.
+
+import (
+	"slices"
+	"sort"
+)
+
+// Jump instructions, by the order they pop their address and condition, and the instructions ending the program
+var (
+	condJumps  = map[string]bool{"jmpz": true, "jmpnz": true}
+	fusedJumps = map[string]bool{"jeq": true, "jlt": true, "jgt": true}
+	stops      = map[string]bool{"halt": true, "haltc": true}
+)
+
+// Target of the jumps with a computed address
+const computedTarget = -1
+
+// flowEdge goes to the block at index to, or to computedTarget
+type flowEdge struct {
+	to   int
+	kind string
+}
+
+// flowBlock is a basic block, the tokens from start up to end, counted from the R channel of the first program
+// cell
+type flowBlock struct {
+	start int
+	end   int
+	succs []flowEdge
+}
+
+// token returns the token at a position of the program
+func (c compiled) token(pos int) uint8 {
+	return c.program.at(pos/3, pos%3)
+}
+
+// literal returns the value of the push literal at a position, false if it isn't one
+func (c compiled) literal(pos int) (int, bool) {
+	if pos < 0 || pos >= 3*c.progline || c.token(pos)&0b1000_0000 != 0 {
+		return 0, false
+	}
+	return int(c.token(pos)), true
+}
+
+// jumpTarget returns the position of the cell a jump goes to and the position of the token which pushed its
+// address, false if the address is computed
+func (c compiled) jumpTarget(pos int) (int, int, bool) {
+	address, ok := c.literal(pos - 1)
+	pushed := pos - 1
+	if !ok && pos >= 3 && c.token(pos-3) == pushaToken {
+		distance, isLiteral := c.literal(pos - 2)
+		switch mnemonic(c.token(pos - 1)) {
+		case "add":
+			address, ok = (pos-3)/3+2+distance, isLiteral
+		case "sub":
+			address, ok = (pos-3)/3+2-distance, isLiteral
+		}
+		pushed = pos - 3
+	}
+	if !ok || address < 2 || address-2 >= c.progline {
+		return 0, pushed, false
+	}
+	return 3 * (address - 2), pushed, true
+}
+
+// entry returns the position of the first token executed
+func (c compiled) entry() int {
+	if address, ok := c.extension(extEntry); ok && address >= 2 && address-2 < c.progline {
+		return 3 * (address - 2)
+	}
+	return 0
+}
+
+// flowBlocks splits the program into basic blocks in program order
+func (c compiled) flowBlocks() []flowBlock {
+	end := 3 * c.progline
+	leaders := map[int]bool{0: true, c.entry(): true}
+	for _, address := range c.labels {
+		if address >= 2 && address-2 < c.progline {
+			leaders[3*(address-2)] = true
+		}
+	}
+	for pos := 0; pos < end; pos++ {
+		name := mnemonic(c.token(pos))
+		if !condJumps[name] && !fusedJumps[name] && !stops[name] {
+			continue
+		}
+		leaders[pos+1] = true
+		if target, _, ok := c.jumpTarget(pos); ok && !stops[name] {
+			leaders[target] = true
+		}
+	}
+	var starts []int
+	for pos := range leaders {
+		if pos < end {
+			starts = append(starts, pos)
+		}
+	}
+	sort.Ints(starts)
+	blocks := make([]flowBlock, len(starts))
+	index := make(map[int]int)
+	for i, start := range starts {
+		blocks[i] = flowBlock{start: start, end: end}
+		if i+1 < len(starts) {
+			blocks[i].end = starts[i+1]
+		}
+		index[start] = i
+	}
+	for i := range blocks {
+		b := &blocks[i]
+		last := b.end - 1
+		name := mnemonic(c.token(last))
+		falls := b.end < end
+		switch {
+		case stops[name]:
+			falls = false
+		case condJumps[name] || fusedJumps[name]:
+			target, pushed, ok := c.jumpTarget(last)
+			to := computedTarget
+			if ok {
+				to = index[target]
+			}
+			always := false
+			if condition, isLiteral := c.literal(pushed - 1); ok && isLiteral && condJumps[name] {
+				taken := condition != 0
+				if name == "jmpz" {
+					taken = condition == 0
+				}
+				always, falls = taken, falls && !taken
+				if !taken {
+					break
+				}
+			}
+			kind := name
+			if always {
+				kind = "always"
+			}
+			b.succs = append(b.succs, flowEdge{to: to, kind: kind})
+		}
+		if falls {
+			b.succs = append(b.succs, flowEdge{to: i + 1, kind: "next"})
+		}
+	}
+	return blocks
+}
+
+// flowGraph is the control-flow graph of a program
+type flowGraph struct {
+	blocks []flowBlock
+	entry  int
+	// succs and preds are the blocks following and preceding each block, a computed address stands for every
+	// labeled block
+	succs [][]int
+	preds [][]int
+	// reach tells which blocks can run, starting from the entry
+	reach []bool
+}
+
+// flowGraph builds the control-flow graph of the program
+func (c compiled) flowGraph() flowGraph {
+	g := flowGraph{blocks: c.flowBlocks()}
+	g.succs = make([][]int, len(g.blocks))
+	g.preds = make([][]int, len(g.blocks))
+	addresses := make(map[int]bool)
+	for _, address := range c.labels {
+		addresses[address] = true
+	}
+	var labeled []int
+	for i, b := range g.blocks {
+		if b.start == c.entry() {
+			g.entry = i
+		}
+		if b.start%3 == 0 && addresses[b.start/3+2] {
+			labeled = append(labeled, i)
+		}
+	}
+	for i, b := range g.blocks {
+		for _, e := range b.succs {
+			targets := []int{e.to}
+			if e.to == computedTarget {
+				targets = labeled
+			}
+			for _, to := range targets {
+				if !slices.Contains(g.succs[i], to) {
+					g.succs[i] = append(g.succs[i], to)
+					g.preds[to] = append(g.preds[to], i)
+				}
+			}
+		}
+	}
+	g.reach = make([]bool, len(g.blocks))
+	work := []int{g.entry}
+	for len(g.blocks) > 0 && len(work) > 0 {
+		block := work[len(work)-1]
+		work = work[:len(work)-1]
+		if g.reach[block] {
+			continue
+		}
+		g.reach[block] = true
+		work = append(work, g.succs[block]...)
+	}
+	return g
+}
+
+// reachable tells if a block can run, starting from the entry
+func (g flowGraph) reachable(block int) bool {
+	return g.reach[block]
+}
@@ -0,0 +1,210 @@
+package main
+
+// Random programs for differential tests, with "pollock gen -seed N -cells M"
+//
+// pollock gen writes a random program of M program cells which the compiler accepts and which always runs to its
+// halt: every instruction finds the values it pops on the stack, the divisors and the shift counts are pushed
+// literals above 0, nothing reads input or waits, and the program is a row of blocks which start and end with an
+// empty stack. A block may end with a conditional jump to the start of a later block, so there are no loops. The
+// instructions and their stack effects come from the opcodes table. The same seed always gives the same program,
+// so the assembler, the disassembler, the optimizer and the VM can be checked against each other on it. Programs
+// for -t 1.1 use the 1.1 stack and immediate instructions too and must be compiled with -t 1.1.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"os"
+	"strings"
+)
+
+// Instructions of the generated programs
+var (
+	genOps        = []string{"add", "sub", "mul", "and", "or", "not", "neg", "gt", "eq", "lt", "pop", "swap", "dup", "rot", "nop", "outi"}
+	genOps11      = []string{"nip", "tuck", "over", "depth", "addi1", "addi2", "addi3", "subi1", "subi2", "subi3", "muli2", "muli3"}
+	genLiteralOps = []string{"div", "rem", "shl", "shr"}
+)
+
+// Most values a generated block keeps on the stack
+const maxGenDepth = 8
+
+// Highest address push LABEL reaches
+const maxPushAddress = 0b0111_1111
+
+// stackEffect returns the number of values an instruction pops and pushes, from its stack effect in the table
+func stackEffect(name string) (int, int) {
+	for _, op := range opcodes {
+		if op.name == name {
+			before, after, _ := strings.Cut(strings.Trim(op.effect, "( )"), "--")
+			return len(strings.Fields(before)), len(strings.Fields(after))
+		}
+	}
+	return 0, 0
+}
+
+// genBlock is a block of a generated program
+type genBlock struct {
+	body   []string
+	jump   string
+	target int
+	lines  int
+}
+
+// generator draws the instructions of a program
+type generator struct {
+	random *rand.Rand
+	ops    []string
+}
+
+// body returns the instructions of a block of size tokens, which starts and ends with an empty stack, or with the
+// condition of its jump and room for it if jump is set
+func (g *generator) body(size int, jump bool) []string {
+	var body []string
+	keep, tail := 0, 0
+	if jump {
+		keep, tail = 1, 2
+	}
+	depth := 0
+	// A step adds up to two tokens, with the outi of the values left
+	for len(body)+max(depth-keep, keep-depth)+tail+2 <= size {
+		switch r := g.random.IntN(10); {
+		case depth == 0 || r < 3 && depth < maxGenDepth:
+			body = append(body, fmt.Sprint("push ", g.random.IntN(maxPushAddress+1)))
+			depth++
+		case r < 4:
+			// Divisors and shift counts from 1 to 7
+			op := genLiteralOps[g.random.IntN(len(genLiteralOps))]
+			body = append(body, fmt.Sprint("push ", 1+g.random.IntN(7)), op)
+		default:
+			op := g.ops[g.random.IntN(len(g.ops))]
+			pops, pushes := stackEffect(op)
+			if pops > depth || depth-pops+pushes > maxGenDepth {
+				continue
+			}
+			body = append(body, op)
+			depth += pushes - pops
+		}
+	}
+	for ; depth > keep; depth-- {
+		body = append(body, "outi")
+	}
+	if depth < keep {
+		body = append(body, fmt.Sprint("push ", g.random.IntN(2)))
+	}
+	for len(body)+tail < size {
+		body = append(body, "nop")
+	}
+	return body
+}
+
+// generate returns the source of the random program of the seed with the number of program cells
+func generate(seed uint64, cells int, target string) string {
+	g := generator{random: rand.New(rand.NewPCG(seed, uint64(cells))), ops: genOps}
+	if target == "1.1" {
+		g.ops = append(append([]string(nil), genOps...), genOps11...)
+	}
+	var blocks []genBlock
+	for left := cells - 1; left > 0; {
+		lines := 1 + g.random.IntN(min(left, 4))
+		block := genBlock{lines: lines, target: -1}
+		if g.random.IntN(3) > 0 {
+			block.jump = []string{"jmpz", "jmpnz"}[g.random.IntN(2)]
+		}
+		block.body = g.body(3*lines, len(block.jump) > 0)
+		blocks = append(blocks, block)
+		left -= lines
+	}
+	// The last block halts, every block can jump to it
+	blocks = append(blocks, genBlock{body: []string{"halt", "nop", "nop"}, lines: 1, target: -1})
+
+	addresses := make([]int, len(blocks))
+	for i, address := 0, 2; i < len(blocks); i++ {
+		addresses[i], address = address, address+blocks[i].lines
+	}
+	labeled := make(map[int]bool)
+	for i := range blocks {
+		if len(blocks[i].jump) == 0 {
+			continue
+		}
+		var targets []int
+		for j := i + 1; j < len(blocks) && addresses[j] <= maxPushAddress; j++ {
+			targets = append(targets, j)
+		}
+		if len(targets) == 0 {
+			// Too far for push LABEL, the condition is printed instead
+			blocks[i].body = append(blocks[i].body, "outi", "nop")
+			continue
+		}
+		blocks[i].target = targets[g.random.IntN(len(targets))]
+		labeled[blocks[i].target] = true
+	}
+
+	var source strings.Builder
+	fmt.Fprintln(&source, "# pollock gen -seed", seed, "-cells", cells, "-t", target)
+	for i, block := range blocks {
+		tokens := block.body
+		if block.target >= 0 {
+			tokens = append(tokens, fmt.Sprint("push B", block.target), block.jump)
+		}
+		for line := 0; line < len(tokens); line += 3 {
+			if line == 0 && labeled[i] {
+				fmt.Fprint(&source, "B", i, ": ")
+			}
+			fmt.Fprintln(&source, strings.Join(tokens[line:line+3], "; "))
+		}
+	}
+	return source.String()
+}
+
+// registerGen registers the flags of the gen subcommand
+func registerGen(flags *flag.FlagSet, outputfile *string, seed *uint64, cells *int, target *string) {
+	flags.StringVar(outputfile, "o", "", "Output file name, default is the standard output")
+	flags.Uint64Var(seed, "seed", 1, "Seed of the random program, default is 1")
+	flags.IntVar(cells, "cells", 32, "Number of program cells, default is 32")
+	flags.StringVar(target, "t", "1.0", "Target format version of the instructions, 1.0 or 1.1, default is 1.0")
+}
+
+// gen parses the flags of the gen subcommand, writes the random program and returns the exit code
+func gen(args []string) int {
+	var outputfile, target string
+	var seed uint64
+	var cells int
+
+	flags := flag.NewFlagSet("gen", flag.ExitOnError)
+	registerGen(flags, &outputfile, &seed, &cells, &target)
+	flags.Parse(args)
+	err := applyEnv(flags)
+	if err == nil && cells < 1 {
+		err = usageError("Fatal error: The program needs at least 1 cell.")
+	}
+	if err == nil && target != "1.0" && target != "1.1" {
+		err = usageError("Fatal error: Target must be 1.0 or 1.1.")
+	}
+	if err == nil && flags.NArg() > 0 {
+		err = usageError("Fatal error: gen takes no arguments.")
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+
+	var w io.Writer = os.Stdout
+	if len(outputfile) > 0 {
+		f, err := os.Create(outputfile)
+		if err != nil {
+			err = ioError(fmt.Sprint("Fatal create error: \"", err, "\""))
+			log.Println(err)
+			return exitCode(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if _, err := io.WriteString(w, generate(seed, cells, target)); err != nil {
+		err = ioError(fmt.Sprint("Fatal write error: \"", err, "\""))
+		log.Println(err)
+		return exitCode(err)
+	}
+	return exitOK
+}
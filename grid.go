@@ -0,0 +1,28 @@
+package main
+
+// Grid lines
+//
+// -grid COLOR draws the borders of the cells, so the structure of the program shows in presentations. In PNG images
+// the last pixel column and row of every cell are painted with the color, which leaves the first pixel of the cell,
+// the one the format is defined with, and its center pixel, the one the decoder samples, untouched. Cells smaller
+// than gridMinCellsize would be mostly border, they are drawn without grid lines. The empty cells at the end of the
+// grid stay transparent. SVG and PDF images stroke the outline of the cells instead.
+
+import "image/color"
+
+// Smallest cell size with grid lines
+const gridMinCellsize = 4
+
+// gridded tells if the cells of the size get grid lines
+func (opts options) gridded(cellsize int) bool {
+	return opts.grid.A != 0 && cellsize >= gridMinCellsize
+}
+
+// gridRow returns the pixel row of a cell border
+func gridRow(grid color.RGBA, cellsize int) []uint8 {
+	row := make([]uint8, cellsize*4)
+	for i := 0; i < len(row); i += 4 {
+		row[i], row[i+1], row[i+2], row[i+3] = grid.R, grid.G, grid.B, grid.A
+	}
+	return row
+}
@@ -0,0 +1,285 @@
+package main
+
+// Color spaces of decoded images
+//
+// The cells are defined in 8-bit sRGB. Image editors may save a program as 16-bit, as a palette or with a color
+// profile. 16-bit samples are read by their high byte and palettes by their colors, the profile needs more: an iCCP
+// chunk with a matrix/TRC profile, or a gAMA chunk without one, describes other values for the same colors, which
+// are converted back to sRGB before the cells are read. Per the PNG rules an sRGB chunk wins over gAMA, and iCCP
+// over both. Profiles close enough to sRGB to give the same 8-bit values are left alone, other profiles (LUT
+// based, CMYK, gray) are not converted and the values are read as they are, with a warning.
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// gAMA of sRGB images, 1/2.2 times 100000, and the difference still taken for sRGB
+const (
+	srgbGamma      = 45455
+	srgbGammaSlack = 500
+)
+
+// The colorants of sRGB in the D50 connection space of ICC profiles, one column per primary
+var srgbColorants = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// colorSpace converts the values of a color space to linear light and the linear light to linear sRGB
+type colorSpace struct {
+	curves [3]func(v float64) float64
+	matrix [3][3]float64
+}
+
+func srgbEncode(v float64) float64 {
+	if v <= 0.0031308 {
+		return 12.92 * v
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// invert returns the inverse of the matrix
+func invert(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) - m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	var inv [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// The cofactor of the transposed element
+			a, b := m[(j+1)%3], m[(j+2)%3]
+			inv[i][j] = (a[(i+1)%3]*b[(i+2)%3] - a[(i+2)%3]*b[(i+1)%3]) / det
+		}
+	}
+	return inv
+}
+
+func multiply(a [3][3]float64, b [3][3]float64) [3][3]float64 {
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return m
+}
+
+// s15Fixed16 reads a signed 15.16 fixed point number of ICC profiles
+func s15Fixed16(data []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(data))) / 65536
+}
+
+// iccTag returns the data of a tag of an ICC profile
+func iccTag(profile []byte, signature string) ([]byte, error) {
+	if len(profile) < 132 {
+		return nil, errors.New("truncated ICC profile")
+	}
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < count && 132+12*i+12 <= len(profile); i++ {
+		entry := profile[132+12*i:]
+		if string(entry[:4]) != signature {
+			continue
+		}
+		offset, size := int(binary.BigEndian.Uint32(entry[4:])), int(binary.BigEndian.Uint32(entry[8:]))
+		if offset < 0 || size < 12 || offset+size > len(profile) {
+			return nil, errors.New(fmt.Sprint("invalid ICC tag ", signature))
+		}
+		return profile[offset : offset+size], nil
+	}
+	return nil, errors.New(fmt.Sprint("ICC profile without ", signature, " tag"))
+}
+
+// iccCurve reads a curv or para tone curve, which maps the values to linear light
+func iccCurve(tag []byte) (func(v float64) float64, error) {
+	switch string(tag[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(tag[8:]))
+		if count == 0 {
+			return func(v float64) float64 { return v }, nil
+		}
+		if count == 1 {
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(v float64) float64 { return math.Pow(v, gamma) }, nil
+		}
+		if 12+2*count > len(tag) {
+			return nil, errors.New("truncated ICC curve")
+		}
+		table := make([]float64, count)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+		}
+		return func(v float64) float64 {
+			position := v * float64(count-1)
+			i := min(int(position), count-2)
+			return table[i] + (table[i+1]-table[i])*(position-float64(i))
+		}, nil
+	case "para":
+		kind := int(binary.BigEndian.Uint16(tag[8:]))
+		lengths := []int{1, 3, 4, 5, 7}
+		if kind >= len(lengths) || 12+4*lengths[kind] > len(tag) {
+			return nil, errors.New("invalid ICC parametric curve")
+		}
+		p := make([]float64, 7)
+		for i := 0; i < lengths[kind]; i++ {
+			p[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		return func(v float64) float64 {
+			switch kind {
+			case 0:
+				return math.Pow(v, g)
+			case 1:
+				if v >= -b/a {
+					return math.Pow(a*v+b, g)
+				}
+				return 0
+			case 2:
+				if v >= -b/a {
+					return math.Pow(a*v+b, g) + c
+				}
+				return c
+			case 3:
+				if v >= d {
+					return math.Pow(a*v+b, g)
+				}
+				return c * v
+			}
+			if v >= d {
+				return math.Pow(a*v+b, g) + e
+			}
+			return c*v + f
+		}, nil
+	}
+	return nil, errors.New(fmt.Sprint("unsupported ICC curve type ", string(tag[:4])))
+}
+
+// iccSpace reads the color space of a compressed iCCP chunk
+func iccSpace(chunk []byte) (colorSpace, error) {
+	var space colorSpace
+	name := bytes.IndexByte(chunk, 0)
+	if name < 0 || name+2 > len(chunk) {
+		return space, errors.New("invalid iCCP chunk")
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(chunk[name+2:]))
+	if err != nil {
+		return space, err
+	}
+	profile, err := io.ReadAll(zr)
+	if err != nil {
+		return space, err
+	}
+	if len(profile) < 132 || string(profile[16:20]) != "RGB " {
+		return space, errors.New("ICC profile isn't an RGB profile")
+	}
+	var colorants [3][3]float64
+	for i, signature := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		tag, err := iccTag(profile, signature)
+		if err != nil {
+			return space, err
+		}
+		if len(tag) < 20 {
+			return space, errors.New(fmt.Sprint("invalid ICC tag ", signature))
+		}
+		for j := 0; j < 3; j++ {
+			colorants[j][i] = s15Fixed16(tag[8+4*j:])
+		}
+	}
+	for i, signature := range []string{"rTRC", "gTRC", "bTRC"} {
+		tag, err := iccTag(profile, signature)
+		if err != nil {
+			return space, err
+		}
+		if space.curves[i], err = iccCurve(tag); err != nil {
+			return space, err
+		}
+	}
+	space.matrix = multiply(invert(srgbColorants), colorants)
+	return space, nil
+}
+
+// gammaSpace returns the color space of a gAMA chunk with the primaries of sRGB
+func gammaSpace(gamma float64) colorSpace {
+	curve := func(v float64) float64 { return math.Pow(v, 1/gamma) }
+	return colorSpace{
+		curves: [3]func(v float64) float64{curve, curve, curve},
+		matrix: [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}},
+	}
+}
+
+// toSRGB converts a color of the space to 8-bit sRGB
+func (space colorSpace) toSRGB(c color.Color) color.NRGBA {
+	n := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+	linear := [3]float64{
+		space.curves[0](float64(n.R) / 65535), space.curves[1](float64(n.G) / 65535), space.curves[2](float64(n.B) / 65535),
+	}
+	var srgb [3]uint8
+	for i, row := range space.matrix {
+		v := row[0]*linear[0] + row[1]*linear[1] + row[2]*linear[2]
+		srgb[i] = uint8(math.Round(srgbEncode(min(max(v, 0), 1)) * 255))
+	}
+	return color.NRGBA{R: srgb[0], G: srgb[1], B: srgb[2], A: uint8(n.A >> 8)}
+}
+
+// isSRGB tells if the space gives the same 8-bit values as sRGB
+func (space colorSpace) isSRGB() bool {
+	for v := 0; v < 256; v++ {
+		for _, c := range []color.NRGBA{{R: uint8(v), A: 255}, {G: uint8(v), A: 255}, {B: uint8(v), A: 255}, {R: uint8(v), G: uint8(v), B: uint8(v), A: 255}} {
+			if space.toSRGB(c) != c {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// srgbImage returns the image with the values of its color space converted to sRGB, the image itself if it is sRGB
+func srgbImage(img image.Image, chunks map[string][]byte) image.Image {
+	var space colorSpace
+	if chunk, ok := chunks["iCCP"]; ok {
+		var err error
+		if space, err = iccSpace(chunk); err != nil {
+			logWrapper(fmt.Sprint("Warning: Reading the values as sRGB, the color profile can't be converted: ", err, "."))
+			return img
+		}
+	} else if _, ok := chunks["sRGB"]; ok {
+		return img
+	} else if chunk, ok := chunks["gAMA"]; ok && len(chunk) == 4 && binary.BigEndian.Uint32(chunk) != 0 {
+		gamma := int(binary.BigEndian.Uint32(chunk))
+		if abs(gamma-srgbGamma) <= srgbGammaSlack {
+			// sRGB images approximate their curve with the gamma
+			return img
+		}
+		space = gammaSpace(float64(gamma) / 100000)
+	} else {
+		return img
+	}
+	if space.isSRGB() {
+		return img
+	}
+	logWrapper("Converting the image to sRGB.")
+	bounds := img.Bounds()
+	converted := image.NewNRGBA(bounds)
+	colors := make(map[color.Color]color.NRGBA)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.At(x, y)
+			srgb, ok := colors[c]
+			if !ok {
+				srgb = space.toSRGB(c)
+				colors[c] = srgb
+			}
+			converted.SetNRGBA(x, y, srgb)
+		}
+	}
+	return converted
+}
@@ -0,0 +1,177 @@
+package main
+
+// Includes
+//
+// A comment line #include "path.plk" inserts the lines of that file in place of the line, so a program can use
+// routines kept in other files. A relative path is searched next to the file with the #include first, then in
+// the -I directories in the order they are given. A file is included only once, the later #include lines of the
+// same file are skipped, and a file including itself through other files is a syntax error listing the chain.
+// The diagnostics of an included file start with its name and count its own lines.
+// Sources without a file name, those of pollock serve, can't include files. Remote includes are in remote.go.
+// The .hash files of pollock build list the included files with their hashes, so a change in them rebuilds the
+// image too.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sourceFile is a file of the compilation, the main file comes first
+type sourceFile struct {
+	name   string
+	source [][]byte
+	// The labels defined in the lines, by line number
+	labels map[int]string
+}
+
+// dirList is the value of a flag which may be given more than once, the environment variable separates the
+// directories with the path list separator
+type dirList []string
+
+func (d *dirList) String() string {
+	return strings.Join(*d, string(filepath.ListSeparator))
+}
+
+func (d *dirList) Set(value string) error {
+	for _, dir := range filepath.SplitList(value) {
+		if len(dir) > 0 {
+			*d = append(*d, dir)
+		}
+	}
+	return nil
+}
+
+// isInclude tells if the comment line is an include
+func isInclude(line []byte) bool {
+	fields := bytes.Fields(line)
+	return len(fields) > 0 && string(fields[0]) == "#include"
+}
+
+// setFile makes the diagnostics refer to the lines of a file of the compilation
+func (c *compiled) setFile(file int) {
+	c.file = file
+	c.source = c.files[file].source
+}
+
+// fileName returns the name of the current file for the diagnostics, empty for the main file
+func (c *compiled) fileName() string {
+	if c.file == 0 {
+		return ""
+	}
+	return c.files[c.file].name
+}
+
+// findInclude returns the path of an included file and the places it was searched in
+func (c *compiled) findInclude(name string) (string, []string) {
+	if filepath.IsAbs(name) {
+		return name, []string{name}
+	}
+	var searched []string
+	dirs := append([]string{filepath.Dir(c.files[c.file].name)}, c.opts.includeDirs...)
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		searched = append(searched, path)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, searched
+		}
+	}
+	return "", searched
+}
+
+// include lexes the file of an include line, stack holds the files including it, the current one last
+func (c *compiled) include(lineno int, line []byte, stack []int) ([]sourceLine, error) {
+	body := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(string(line)), "#include"))
+	name, err := strconv.Unquote(body)
+	if err != nil || len(name) == 0 || !strings.HasPrefix(body, "\"") {
+		return nil, c.syntaxError(lineno, wholeLine, "include-invalid", c.opts.message("include-invalid", body, lineno+1))
+	}
+	if len(c.opts.sourceName) == 0 {
+		return nil, c.syntaxError(lineno, wholeLine, "include-invalid", c.opts.message("include-nested", name, lineno+1))
+	}
+	if isRemote(name) {
+		path, err := fetchInclude(name, c.opts)
+		if err != nil {
+			return nil, c.syntaxError(lineno, wholeLine, "include-remote", c.opts.message("include-remote", name, lineno+1, err))
+		}
+		return c.includeFile(lineno, path, stack)
+	}
+	path, searched := c.findInclude(name)
+	if len(path) == 0 {
+		return nil, c.syntaxError(lineno, wholeLine, "include-missing", c.opts.message("include-missing", name, lineno+1, strings.Join(searched, ", ")))
+	}
+	return c.includeFile(lineno, path, stack)
+}
+
+// includeFile lexes the included file found at the path
+func (c *compiled) includeFile(lineno int, path string, stack []int) ([]sourceLine, error) {
+	for i, file := range c.files {
+		if !sameFile(file.name, path) {
+			continue
+		}
+		for j, including := range stack {
+			if including != i {
+				continue
+			}
+			var chain []string
+			for _, k := range stack[j:] {
+				chain = append(chain, c.files[k].name)
+			}
+			chain = append(chain, path)
+			return nil, c.syntaxError(lineno, wholeLine, "include-cycle", c.opts.message("include-cycle", strings.Join(chain, " -> "), lineno+1))
+		}
+		c.opts.logMsg(fmt.Sprint("File \"", path, "\" is already included, skipping it in line: ", lineno+1, "."))
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, c.syntaxError(lineno, wholeLine, "include-missing", c.opts.message("include-unreadable", path, lineno+1, err))
+	}
+	c.opts.logMsg(fmt.Sprint("Including \"", path, "\" in line: ", lineno+1, "."))
+	c.files = append(c.files, sourceFile{name: path})
+	file := c.file
+	lines := c.lexFile(len(c.files)-1, data, append(stack, len(c.files)-1))
+	c.setFile(file)
+	return lines, nil
+}
+
+// sameFile tells if the paths are the same file
+func sameFile(a string, b string) bool {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	if errA != nil || errB != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return os.SameFile(infoA, infoB)
+}
+
+// includeHashes returns the "include PATH HASH" lines of the included files for the .hash file
+func (c compiled) includeHashes() string {
+	var lines strings.Builder
+	for _, file := range c.files[min(1, len(c.files)):] {
+		sum := sha256.Sum256(bytes.Join(file.source, []byte("\n")))
+		fmt.Fprintln(&lines, "include", file.name, hex.EncodeToString(sum[:]))
+	}
+	return lines.String()
+}
+
+// includesUnchanged tells if the included files of the "include PATH HASH" lines didn't change
+func includesUnchanged(lines []string) bool {
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "include" {
+			return false
+		}
+		data, err := os.ReadFile(fields[1])
+		sum := sha256.Sum256(data)
+		if err != nil || hex.EncodeToString(sum[:]) != fields[2] {
+			return false
+		}
+	}
+	return true
+}
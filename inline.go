@@ -0,0 +1,178 @@
+package main
+
+// Inline images in the terminal
+//
+// -inline prints the compiled image in the terminal after the build, with one of the graphics protocols:
+// sixel (xterm -ti vt340, mlterm, foot, WezTerm...), iterm (iTerm2's OSC 1337 and the terminals copying it) or
+// kitty (the kitty graphics protocol). -inline auto picks the protocol from the environment: TERM_PROGRAM names
+// iTerm2 and WezTerm, KITTY_WINDOW_ID and TERM=xterm-kitty kitty, and a TERM mentioning sixel, mlterm or foot
+// sixel. Without any of them the grid is printed as ANSI colors, like -preview.
+// Sixel images have at most 256 colors, images with more are mapped to the Plan 9 palette.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+)
+
+// The graphics protocols of -inline
+var inlineProtocols = []string{"auto", "sixel", "iterm", "kitty"}
+
+// Length of the base64 payload of a kitty escape
+const kittyChunk = 4096
+
+// detectProtocol returns the graphics protocol of the terminal, empty if it has none
+func detectProtocol() string {
+	term := os.Getenv("TERM")
+	switch {
+	case os.Getenv("TERM_PROGRAM") == "iTerm.app" || os.Getenv("TERM_PROGRAM") == "WezTerm":
+		return "iterm"
+	case len(os.Getenv("KITTY_WINDOW_ID")) > 0 || term == "xterm-kitty":
+		return "kitty"
+	case strings.Contains(term, "sixel") || strings.HasPrefix(term, "mlterm") || strings.HasPrefix(term, "foot"):
+		return "sixel"
+	}
+	return ""
+}
+
+// inlineImage prints the image of the program in the terminal with the protocol
+func inlineImage(w io.Writer, c compiled, protocol string) error {
+	if protocol == "auto" {
+		protocol = detectProtocol()
+	}
+	if len(protocol) == 0 {
+		c.opts.logMsg("No terminal graphics protocol detected, printing the cells.")
+		preview(w, c, trueColor())
+		return nil
+	}
+	if streamed(c, c.opts.cellsize) {
+		c.opts.logMsg("Image is too large to print inline.")
+		return nil
+	}
+	img := render(c, c.opts.cellsize)
+	if protocol == "sixel" {
+		return writeSixel(w, img)
+	}
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		return err
+	}
+	payload := base64.StdEncoding.EncodeToString(encoded.Bytes())
+	if protocol == "iterm" {
+		_, err := fmt.Fprintf(w, "\x1b]1337;File=inline=1;size=%d;preserveAspectRatio=1:%s\a\n", encoded.Len(), payload)
+		return err
+	}
+	// kitty sends the payload in chunks, m=1 while more follow
+	for first := true; len(payload) > 0 || first; first = false {
+		chunk := payload[:min(len(payload), kittyChunk)]
+		payload = payload[len(chunk):]
+		more := 0
+		if len(payload) > 0 {
+			more = 1
+		}
+		control := fmt.Sprint("m=", more)
+		if first {
+			control = "a=T,f=100," + control
+		}
+		if _, err := fmt.Fprintf(w, "\x1b_G%s;%s\x1b\\", control, chunk); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// writeSixel prints the image as sixels, the transparent pixels are left unpainted
+func writeSixel(w io.Writer, img *image.RGBA) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	indexes := make(map[color.RGBA]int)
+	var colors []color.RGBA
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			pixel := img.RGBAAt(x, y)
+			if _, ok := indexes[pixel]; !ok && pixel.A != 0 {
+				indexes[pixel] = len(colors)
+				colors = append(colors, pixel)
+			}
+		}
+	}
+	index := func(pixel color.RGBA) int {
+		if pixel.A == 0 {
+			return -1
+		}
+		if len(colors) > 256 {
+			return color.Palette(palette.Plan9).Index(pixel)
+		}
+		return indexes[pixel]
+	}
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "\x1bP0;1;q\"1;1;%d;%d", width, height)
+	if len(colors) > 256 {
+		colors = colors[:0]
+		for _, c := range palette.Plan9 {
+			colors = append(colors, color.RGBAModel.Convert(c).(color.RGBA))
+		}
+	}
+	for i, c := range colors {
+		fmt.Fprintf(out, "#%d;2;%d;%d;%d", i, int(c.R)*100/255, int(c.G)*100/255, int(c.B)*100/255)
+	}
+	// A sixel is a column of 6 pixels, the image is printed in bands of 6 rows, one pass per color
+	band := make([]int, 6*width)
+	for top := 0; top < height; top += 6 {
+		used := make(map[int]bool)
+		for r := 0; r < 6; r++ {
+			for x := 0; x < width; x++ {
+				band[r*width+x] = -1
+				if top+r < height {
+					band[r*width+x] = index(img.RGBAAt(bounds.Min.X+x, bounds.Min.Y+top+r))
+					used[band[r*width+x]] = true
+				}
+			}
+		}
+		for i := range colors {
+			if !used[i] {
+				continue
+			}
+			fmt.Fprintf(out, "#%d", i)
+			var last byte
+			run := 0
+			flush := func() {
+				if run > 3 {
+					fmt.Fprintf(out, "!%d%c", run, last)
+				} else {
+					out.WriteString(strings.Repeat(string(last), run))
+				}
+			}
+			for x := 0; x < width; x++ {
+				bits := 0
+				for r := 0; r < 6; r++ {
+					if band[r*width+x] == i {
+						bits |= 1 << r
+					}
+				}
+				sixel := byte(63 + bits)
+				if sixel != last && run > 0 {
+					flush()
+					run = 0
+				}
+				last = sixel
+				run++
+			}
+			flush()
+			out.WriteByte('$')
+		}
+		out.WriteByte('-')
+	}
+	out.WriteString("\x1b\\\n")
+	return out.Flush()
+}
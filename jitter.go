@@ -0,0 +1,37 @@
+package main
+
+// Color jitter
+//
+// -jitter N paints the program cells of PNG images with noise instead of flat colors: every pixel of a cell but its
+// center one gets the cell color moved by up to N (1 to 255) in brightness and a little in hue, so the image looks
+// painted while it still runs (see paint.go). The noise is a hash of the cell and the pixel, so the same program
+// always makes the same image.
+
+import "image/color"
+
+// Largest amplitude of -jitter
+const maxJitter = 255
+
+// jitterInk returns the color of the pixel at x, y of the k-th cell, false for the center pixel
+func jitterInk(cell color.RGBA, k int, x int, y int, cellsize int, amount int) (color.RGBA, bool) {
+	if x == cellsize/2 && y == cellsize/2 {
+		return cell, false
+	}
+	noise := mix(uint64(k)<<32 | uint64(x)<<16 | uint64(y))
+	shift := int(noise%uint64(2*amount+1)) - amount
+	// The hue moves by a quarter of the brightness, each channel its own way
+	hue := max(amount/4, 1)
+	channel := func(value uint8, bits uint) uint8 {
+		moved := int(value) + shift + int((noise>>bits)%uint64(2*hue+1)) - hue
+		return uint8(min(max(moved, 0), 255))
+	}
+	return color.RGBA{R: channel(cell.R, 16), G: channel(cell.G, 32), B: channel(cell.B, 48), A: cell.A}, true
+}
+
+// mix is the finalizer of splitmix64, it spreads the bits of the pixel position over the noise
+func mix(z uint64) uint64 {
+	z += 0x9E3779B97F4A7C15
+	z = (z ^ z>>30) * 0xBF58476D1CE4E5B9
+	z = (z ^ z>>27) * 0x94D049BB133111EB
+	return z ^ z>>31
+}
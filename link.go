@@ -0,0 +1,232 @@
+package main
+
+// Linking of images, with "pollock link -o combined.png a.png b.png..."
+//
+// The program cells of the images are concatenated in the order of the arguments. The images after the first
+// move to higher addresses, so they must have a relocation table (images with .export or .extern, or compiled
+// with -reloc): the label addresses in their relocation tables, their exports and their entry points are rebased.
+// Then the external labels (.extern) of all the images are filled in from the exports, they must all be found.
+// The linked image keeps the exports and the relocations of all the images, so it can be linked again if the
+// first image was a library too. The images must have the same word size, the entry point of the first image
+// which has one is kept, the format version is the highest one and the cell size is that of the first image,
+// unless -c is given.
+// The inputs may be object files too (see object.go), a single object is linked into its image, and archives
+// (see archive.go), whose members are linked only if they are needed.
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// registerLink registers the flags of the link subcommand
+func registerLink(flags *flag.FlagSet, outputfile *string, cellsize *int, keyfile *string, shuffleKey *string) {
+	flags.StringVar(outputfile, "o", "", "Output file name, mandatory")
+	flags.StringVar(keyfile, "verify-key", "", "Ed25519 public key in PEM format the images must be signed with, archives are refused, default is no check")
+	flags.StringVar(shuffleKey, "shuffle-key", "", "Key of the shuffled images, default is none")
+	flags.IntVar(cellsize, "c", 0, "Cell size in pixels, 2 to 1024, default is that of the first image")
+	flags.BoolVar(&silent, "s", false, "Run in silent mode, default is false")
+}
+
+// extension returns the value of the first extension cell of the kind
+func (c compiled) extension(kind uint8) (int, bool) {
+	for _, ext := range c.extensions {
+		if ext[0] == kind {
+			return int(ext[1])<<8 | int(ext[2]), true
+		}
+	}
+	return 0, false
+}
+
+// wordsize returns the word size of the program, from its extension cell
+func (c compiled) wordsize() int {
+	if wordsize, ok := c.extension(extWordSize); ok {
+		return wordsize
+	}
+	return 8
+}
+
+// linkImages concatenates the programs of the images, the names are used in the errors
+func linkImages(images []compiled, names []string) (compiled, error) {
+	linked := images[0]
+	linked.program = progarray{
+		r: append([]uint8(nil), linked.program.r...),
+		g: append([]uint8(nil), linked.program.g...),
+		b: append([]uint8(nil), linked.program.b...),
+	}
+	linked.extensions = append([][3]uint8(nil), linked.extensions...)
+	linked.exports = append([]string(nil), linked.exports...)
+	linked.relocs = append([]reloc(nil), linked.relocs...)
+	linked.labels = maps.Clone(linked.labels)
+	// The symbol table and the signature of the first image don't cover the linked cells
+	linked.opts.symbols, linked.signature = false, nil
+	for i, img := range images[1:] {
+		name := names[i+1]
+		if !img.relocatable {
+			return linked, usageError(fmt.Sprint("Fatal error: \"", name, "\" has no relocation table, only images with .export or .extern or compiled with -reloc can follow the first image."))
+		}
+		if img.wordsize() != linked.wordsize() {
+			return linked, usageError(fmt.Sprint("Fatal error: Word size ", img.wordsize(), " of \"", name, "\" doesn't match word size ", linked.wordsize(), "."))
+		}
+		offset := linked.progline
+		program := progarray{
+			r: append([]uint8(nil), img.program.r...),
+			g: append([]uint8(nil), img.program.g...),
+			b: append([]uint8(nil), img.program.b...),
+		}
+		for _, r := range img.relocs {
+			if r.address == externAddress {
+				linked.relocs = append(linked.relocs, reloc{cell: r.cell + offset, channel: r.channel, part: r.part, address: externAddress, label: r.label})
+				continue
+			}
+			address := r.address + offset
+			if err := program.relocate(r, address); err != nil {
+				return linked, usageError(fmt.Sprint("Fatal error: ", err, " in \"", name, "\"."))
+			}
+			linked.relocs = append(linked.relocs, reloc{cell: r.cell + offset, channel: r.channel, part: r.part, address: address, label: r.label})
+		}
+		for _, export := range img.exports {
+			if _, ok := linked.labels[export]; ok {
+				return linked, usageError(fmt.Sprint("Fatal error: Label \"", export, "\" of \"", name, "\" is already exported."))
+			}
+			linked.exports = append(linked.exports, export)
+			linked.labels[export] = img.labels[export] + offset
+		}
+		if entry, ok := img.extension(extEntry); ok {
+			if _, linkedEntry := linked.extension(extEntry); !linkedEntry {
+				entry += offset
+				if entry > 0xFFFF {
+					return linked, usageError(fmt.Sprint("Fatal error: Entry point of \"", name, "\" doesn't fit in the entry cell after linking."))
+				}
+				linked.extensions = append(linked.extensions, [3]uint8{extEntry, uint8(entry >> 8), uint8(entry)})
+			}
+		}
+		linked.program.r = append(linked.program.r, program.r...)
+		linked.program.g = append(linked.program.g, program.g...)
+		linked.program.b = append(linked.program.b, program.b...)
+		linked.progline += img.progline
+		linked.minor = max(linked.minor, img.minor)
+		logWrapper(fmt.Sprint("Linked \"", name, "\" at address ", offset+2, " with ", len(img.relocs), " relocations."))
+	}
+	for i, r := range linked.relocs {
+		if r.address != externAddress {
+			continue
+		}
+		address, ok := linked.labels[r.label]
+		if !ok {
+			return linked, usageError(fmt.Sprint("Fatal error: External label \"", r.label, "\" is not exported by any image."))
+		}
+		if err := linked.program.relocate(r, address); err != nil {
+			return linked, usageError(fmt.Sprint("Fatal error: ", err, "."))
+		}
+		linked.relocs[i].address = address
+	}
+	return linked, nil
+}
+
+// relocate writes the address, or its 7-bit group, into the channel of the relocation
+func (p progarray) relocate(r reloc, address int) error {
+	value := address
+	if r.part > 0 {
+		value = (address >> (7 * (r.part - 1))) & 0b0111_1111
+	} else if address > 0b0111_1111 {
+		return errors.New(fmt.Sprint("Address ", address, " of label \"", r.label, "\" is out of the push range after linking"))
+	}
+	switch r.channel {
+	case 0:
+		p.r[r.cell] = uint8(value)
+	case 1:
+		p.g[r.cell] = uint8(value)
+	case 2:
+		p.b[r.cell] = uint8(value)
+	}
+	return nil
+}
+
+// link parses the flags of the link subcommand, links the images and returns the exit code
+func link(args []string) int {
+	var outputfile, keyfile, shuffleKey string
+	var cellsize int
+
+	flags := flag.NewFlagSet("link", flag.ExitOnError)
+	registerLink(flags, &outputfile, &cellsize, &keyfile, &shuffleKey)
+	flags.Parse(args)
+	err := applyEnv(flags)
+	if err == nil && len(outputfile) == 0 {
+		err = usageError("Fatal error: Output file is required.")
+	}
+	if err == nil && flags.NArg() < 1 {
+		err = usageError("Fatal error: At least one image or object file is needed.")
+	}
+	var key ed25519.PublicKey
+	if err == nil {
+		key, err = verifyKeyFlag(keyfile)
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+
+	var images []compiled
+	var names []string
+	var archives []archive
+	for _, name := range flags.Args() {
+		if strings.EqualFold(filepath.Ext(name), archiveExt) {
+			logWrapper(fmt.Sprint("Reading archive: ", name))
+			data, err := os.ReadFile(name)
+			var a archive
+			if key != nil {
+				err = verifyError(fmt.Sprint("Fatal error: Untrusted archive \"", name, "\": archive members are not signed."))
+			} else if err != nil {
+				err = ioError(fmt.Sprint("Fatal error: \"", err, "\""))
+			} else {
+				a, err = readArchive(name, data)
+			}
+			if err != nil {
+				log.Println(err)
+				return exitCode(err)
+			}
+			archives = append(archives, a)
+			continue
+		}
+		logWrapper(fmt.Sprint("Reading image: ", name))
+		img, err := decodeVerified(name, key, shuffleKey)
+		if err != nil {
+			log.Println(err)
+			return exitCode(err)
+		}
+		images = append(images, img)
+		names = append(names, name)
+	}
+	if len(images) == 0 {
+		err := usageError("Fatal error: At least one image or object file is needed besides the archives.")
+		log.Println(err)
+		return exitCode(err)
+	}
+	pulled, pulledNames := pullMembers(images, archives)
+	images, names = append(images, pulled...), append(names, pulledNames...)
+	linked, err := linkImages(images, names)
+	if err == nil && cellsize != 0 {
+		var opts options
+		if opts, err = newOptions(cellsize, "1.0", 8); err == nil {
+			linked.opts.cellsize = opts.cellsize
+		} else {
+			err = usageError(fmt.Sprint("Fatal error: ", err))
+		}
+	}
+	if err == nil {
+		err = writeImage(linked, outputfile, linked.opts)
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+	logWrapper(fmt.Sprint("Linked ", len(images), " images into ", outputfile, ", ", linked.progline, " cells."))
+	return exitOK
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testKeys writes a new Ed25519 key pair into the directory and returns the files of the private and public key
+func testKeys(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateFile, publicFile := filepath.Join(dir, "key.pem"), filepath.Join(dir, "pub.pem")
+	for file, block := range map[string]*pem.Block{
+		privateFile: {Type: "PRIVATE KEY", Bytes: privateDER},
+		publicFile:  {Type: "PUBLIC KEY", Bytes: publicDER},
+	} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return privateFile, publicFile
+}
+
+// testWrite compiles the source into the file of the directory, signed if signKey isn't empty, and returns its path
+func testWrite(t *testing.T, dir string, name string, source string, signKey string) string {
+	t.Helper()
+	c, err := testCompile(t, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signKey) > 0 {
+		if c.opts.signKey, err = loadSigningKey(signKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, name)
+	if err := writeImage(c, path, c.opts); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLinkVerify(t *testing.T) {
+	const (
+		mainSource = ".extern FOO\npush 1; push FOO; jmpnz\nhalt; nop; nop\n"
+		libSource  = ".export FOO\n.export BAR\nFOO: halt; nop; nop\nBAR: halt; nop; nop\n"
+	)
+	dir := t.TempDir()
+	signKey, verifyKey := testKeys(t, dir)
+	signedMain := testWrite(t, dir, "main.png", mainSource, signKey)
+	signedLib := testWrite(t, dir, "lib.png", libSource, signKey)
+	unsignedLib := testWrite(t, dir, "unsigned.png", libSource, "")
+	tamperedMain := testWrite(t, dir, "tampered.png", mainSource, signKey)
+	testTamper(t, tamperedMain, "plRl", "FOO", "BAR")
+	object := testWrite(t, dir, "lib.plko", libSource, "")
+	library := filepath.Join(dir, "lib.plka")
+	if status := ar([]string{"-s", "-o", library, object}); status != exitOK {
+		t.Fatalf("ar exited with %d", status)
+	}
+	output := filepath.Join(dir, "linked.png")
+	tests := []struct {
+		name   string
+		args   []string
+		status int
+	}{
+		{"signed images", []string{"-verify-key", verifyKey, signedMain, signedLib}, exitOK},
+		{"unsigned image", []string{"-verify-key", verifyKey, signedMain, unsignedLib}, exitVerify},
+		{"changed relocation table", []string{tamperedMain, signedLib}, exitOK},
+		{"changed relocation table with a key", []string{"-verify-key", verifyKey, tamperedMain, signedLib}, exitVerify},
+		{"object file", []string{"-verify-key", verifyKey, signedMain, object}, exitVerify},
+		{"archive", []string{signedMain, library}, exitOK},
+		{"archive with a key", []string{"-verify-key", verifyKey, signedMain, library}, exitVerify},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status := link(append([]string{"-s", "-o", output}, test.args...)); status != test.status {
+				t.Errorf("link exited with %d, want %d", status, test.status)
+			}
+		})
+	}
+}
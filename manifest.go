@@ -0,0 +1,195 @@
+package main
+
+// Project manifest, pollock.toml, with the build targets of "pollock build"
+//
+// The manifest is a small subset of TOML: comments, the name of the project and a [[target]] table per image, with
+// the keys name, entry (the source file, relative to the manifest), cellsize, palette and format. A target without
+// one of the last three keys gets the value of the build flags. pollock build without arguments builds every target
+// of the pollock.toml in the current directory, or of the manifest given as its argument, into NAME.FORMAT next to
+// the manifest or in -outdir, so one command can write both a small image for the machines and a large poster.
+//
+//	name = "demo"
+//
+//	[[target]]
+//	name = "main"
+//	entry = "src/main.plk"
+//	cellsize = 4
+//
+//	[[target]]
+//	name = "poster"
+//	entry = "src/main.plk"
+//	cellsize = 64
+//	palette = "contrast"
+//	format = "pdf"
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// manifestTarget is a build target of the manifest
+type manifestTarget struct {
+	name     string
+	entry    string
+	cellsize int
+	palette  string
+	format   string
+}
+
+// manifest is a parsed pollock.toml
+type manifest struct {
+	name    string
+	targets []manifestTarget
+}
+
+// manifestValue parses the value of a key, a string or an integer, followed by an optional comment
+func manifestValue(value string) (any, error) {
+	if strings.HasPrefix(value, "\"") {
+		end := 1
+		for ; end < len(value) && value[end] != '"'; end++ {
+			if value[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(value) {
+			return nil, errors.New("unterminated string")
+		}
+		rest := strings.TrimSpace(value[end+1:])
+		if len(rest) > 0 && rest[0] != '#' {
+			return nil, errors.New(fmt.Sprint("unexpected \"", rest, "\" after the string"))
+		}
+		return strconv.Unquote(value[:end+1])
+	}
+	value, _, _ = strings.Cut(value, "#")
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return nil, errors.New("value must be a string or an integer")
+	}
+	return n, nil
+}
+
+// parseManifest parses the manifest, it fails at the first line it doesn't understand
+func parseManifest(data []byte, filename string) (manifest, error) {
+	var m manifest
+	var target *manifestTarget
+	for i, line := range strings.Split(string(data), "\n") {
+		fail := func(msg string) (manifest, error) {
+			return manifest{}, usageError(fmt.Sprint("Fatal error: ", filename, ":", i+1, ": ", msg, "."))
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case len(line) == 0 || line[0] == '#':
+			continue
+		case line == "[[target]]":
+			m.targets = append(m.targets, manifestTarget{})
+			target = &m.targets[len(m.targets)-1]
+			continue
+		case line[0] == '[':
+			return fail(fmt.Sprint("Unknown table ", line, ", must be [[target]]"))
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fail("Expected key = value")
+		}
+		key = strings.TrimSpace(key)
+		v, err := manifestValue(strings.TrimSpace(value))
+		if err != nil {
+			return fail(fmt.Sprint("Invalid value of ", key, ": ", err))
+		}
+		s, isString := v.(string)
+		n, isInt := v.(int)
+		switch {
+		case target == nil && key == "name" && isString:
+			m.name = s
+		case target != nil && key == "name" && isString:
+			target.name = s
+		case target != nil && key == "entry" && isString:
+			target.entry = s
+		case target != nil && key == "cellsize" && isInt:
+			target.cellsize = n
+		case target != nil && key == "palette" && isString:
+			target.palette = s
+		case target != nil && key == "format" && isString:
+			target.format = s
+		default:
+			return fail(fmt.Sprint("Unknown key ", key, " or wrong type of its value"))
+		}
+	}
+	if len(m.targets) == 0 {
+		return manifest{}, usageError(fmt.Sprint("Fatal error: ", filename, " has no [[target]]."))
+	}
+	names := make(map[string]bool)
+	for _, t := range m.targets {
+		switch {
+		case len(t.name) == 0 || len(t.entry) == 0:
+			return manifest{}, usageError(fmt.Sprint("Fatal error: ", filename, ": Every target needs a name and an entry."))
+		case strings.ContainsAny(t.name, `/\`):
+			return manifest{}, usageError(fmt.Sprint("Fatal error: ", filename, ": Invalid target name \"", t.name, "\"."))
+		case names[t.name]:
+			return manifest{}, usageError(fmt.Sprint("Fatal error: ", filename, ": Duplicate target \"", t.name, "\"."))
+		}
+		names[t.name] = true
+	}
+	return m, nil
+}
+
+// buildManifest compiles every target of the manifest, the flags give the values the targets don't set
+func buildManifest(filename string, bf buildFlags) int {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		err = ioError(fmt.Sprint("Fatal error: \"", err, "\""))
+		log.Println(err)
+		return exitCode(err)
+	}
+	m, err := parseManifest(data, filename)
+	if err == nil {
+		err = bf.makeOutdir()
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+	if len(m.name) > 0 {
+		logWrapper(fmt.Sprint("Building project ", m.name, ", ", len(m.targets), " targets"))
+	}
+
+	dir := filepath.Dir(filename)
+	var jobs []buildJob
+	for _, t := range m.targets {
+		tf := bf
+		if t.cellsize > 0 {
+			tf.cellsize = t.cellsize
+		}
+		if len(t.palette) > 0 {
+			tf.palette = t.palette
+		}
+		if len(t.format) > 0 {
+			tf.format = t.format
+		}
+		opts, err := newOptions(tf.cellsize, tf.target, tf.wordsize)
+		if err != nil {
+			log.Println(fmt.Sprint("Fatal error: Target \"", t.name, "\": ", err))
+			return exitCode(err)
+		}
+		if err := tf.apply(&opts); err != nil {
+			log.Println(err)
+			return exitCode(err)
+		}
+		outputfile := filepath.Join(dir, t.name+"."+tf.format)
+		if len(bf.outdir) > 0 {
+			outputfile = filepath.Join(bf.outdir, t.name+"."+tf.format)
+		}
+		jobs = append(jobs, buildJob{
+			label:      fmt.Sprint(t.name, " (", filepath.Join(dir, t.entry), ")"),
+			filename:   filepath.Join(dir, t.entry),
+			outputfile: outputfile,
+			opts:       opts,
+		})
+	}
+	return buildJobs(jobs, bf)
+}
@@ -0,0 +1,158 @@
+package main
+
+// Message catalog of the diagnostics, with "pollock -lang hu -f prog.plk"
+//
+// The warnings and syntax errors of the compiler are looked up by their message ID in the catalog of the language of
+// -lang, English (en) or Hungarian (hu), so students can read them in their own language. The IDs are stable, and so
+// are the diagnostic codes and the levels of the JSON and SARIF outputs, only the texts change with the language.
+// A message missing in a language is printed in English. The other messages of the commands are English.
+//
+// A format is filled with fmt.Sprintf, the translations may take the arguments in another order with %[n]v.
+
+import (
+	"fmt"
+)
+
+// Languages of the catalog, the first one is complete and is the default
+var languages = []string{"en", "hu"}
+
+// catalog holds the formats of the messages by language and message ID
+var catalog = map[string]map[string]string{
+	"en": {
+		"kind-warning":          "warning:",
+		"kind-error":            "error:",
+		"in-label":              "(in %v)",
+		"line-ref-file":         "%v of %v",
+		"cell-line":             "line %v",
+		"cell-address":          "cell %v",
+		"label-multiple":        "Syntax error. Multiple labels detected in line: %v.",
+		"label-empty":           "Syntax error. Empty label detected in line: %v.",
+		"label-invalid":         "Syntax error. Invalid label detected: \"%v\" in line: %v.",
+		"label-duplicate":       "Syntax error. Duplicate label detected: \"%v\" in line: %v.",
+		"label-undefined":       "Syntax error. Undefined label \"%v\" in line: %v.",
+		"label-undefined-pusha": "Syntax error. Undefined label \"%v\" in line: %v, pusha needs a label of the program.",
+		"label-range":           "Syntax error. Address %v of label \"%v\" is out of the 0-127 range of push in line: %v, position: %v. %v",
+		"label-range-pusha":     "Syntax error. Label \"%v\" is %v cells from pusha, out of the 0-127 range of push in line: %v, position: %v.",
+		"push-groups":           "Push its 7-bit groups instead: %v.",
+		"push-groups-wordsize":  "Push its 7-bit groups with -wordsize %v or more: %v.",
+		"extra-text":            "Dropped extra text \"%v\" in line: %v.",
+		"empty-instr":           "Empty instruction in line: %v, position: %v. Using nop.",
+		"missing-instr":         "Missing instruction in line: %v, position: %v. Using nop.",
+		"unknown-op":            "Unknown instruction \"%v\" in line: %v, position: %v. Replacing with nop.",
+		"string-invalid":        "String literal is invalid in line: %v, position: %v. Using nop.",
+		"string-range":          "String literal is out of range in line: %v, position: %v. Using nop.",
+		"push-no-arg":           "Push operation without argument in line: %v, position: %v. Using zero as a value.",
+		"push-range":            "Push operation argument is out of range in line: %v, position: %v. Using zero as a value.",
+		"push-invalid":          "Push operation argument is invalid in line: %v, position: %v. Using zero as a value.",
+		"directive-unknown":     "Syntax error. Unknown directive \"%v\" in line: %v.",
+		"directive-count":       "Syntax error. Invalid count \"%v\" of %v in line: %v.",
+		"directive-filler":      "Syntax error. Invalid filler \"%v\" of %v in line: %v.",
+		"start-invalid":         "Syntax error. Invalid label \"%v\" of .start in line: %v.",
+		"start-second":          "Syntax error. Second .start in line: %v, the first is in line: %v.",
+		"start-range":           "Syntax error. Address of label \"%v\" doesn't fit in the entry cell in line: %v.",
+		"export-invalid":        "Syntax error. Invalid label \"%v\" of .export in line: %v.",
+		"export-twice":          "Syntax error. Label \"%v\" is exported twice in line: %v.",
+		"extern-invalid":        "Syntax error. Invalid label \"%v\" of .extern in line: %v.",
+		"include-invalid":       "Syntax error. Invalid include \"%v\" in line: %v, the path must be in double quotes.",
+		"include-nested":        "Syntax error. Include \"%v\" in line: %v, only source files can include files.",
+		"include-remote":        "Syntax error. Remote include \"%v\" in line: %v: %v.",
+		"include-missing":       "Syntax error. Included file \"%v\" not found in line: %v, searched %v.",
+		"include-cycle":         "Syntax error. Include cycle %v in line: %v.",
+		"include-unreadable":    "Syntax error. Included file \"%v\" can't be read in line: %v: %v.",
+		"pragma-unknown":        "Unknown pragma \"%v\" in line: %v. Ignoring it.",
+		"pragma-value-count":    "Pragma \"%v\" needs one value in line: %v. Ignoring it.",
+		"pragma-late":           "Pragma \"%v\" must come before the first instruction in line: %v. Ignoring it.",
+		"pragma-value":          "Invalid value \"%v\" of pragma \"%v\" in line: %v. Ignoring it.",
+		"pragma-warning":        "Pragma warning must be disable or enable in line: %v. Ignoring it.",
+		"pragma-warning-code":   "Unknown warning \"%v\" in pragma in line: %v. Ignoring it.",
+		"contract-invalid":      "Invalid stack contract \"%v\" in line: %v, must be IN -> OUT. Ignoring it.",
+		"contract-misplaced":    "Stack contract in line: %v is not right above a labeled line. Ignoring it.",
+		"stack-contract":        "Stack contract %v -> %v of %v is broken, %v, in line: %v.",
+		"contract-call-short":   "%v is reached with %v values, its routine takes %v",
+		"contract-call-result":  "the path into %v returns %v values",
+		"contract-join":         "%v is reached with %v and %v values",
+		"contract-underflow":    "%v pops values below the inputs",
+		"contract-return":       "the return in %v leaves %v values",
+		"fault-div-zero":        "Division by zero",
+		"fault-address":         "Jump to address %v outside the program, which has the addresses 2 to %v",
+		"fault-data":            "Jump to address %v into the data cells of a .space",
+		"fault":                 "Syntax error. %v in line: %v.",
+		"fault-origin":          "Syntax error. %v in line: %v, the values come from line %v.",
+		"fault-origins":         "Syntax error. %v in line: %v, the values come from lines %v.",
+		"werror":                "Syntax error. %v warnings treated as errors.",
+		"werror-one":            "Syntax error. %v warning treated as an error.",
+	},
+	"hu": {
+		"kind-warning":          "figyelmeztetés:",
+		"kind-error":            "hiba:",
+		"in-label":              "(itt: %v)",
+		"line-ref-file":         "%[2]v %[1]v",
+		"cell-line":             "%v. sor",
+		"cell-address":          "%v. cella",
+		"label-multiple":        "Szintaktikai hiba. Több címke ebben a sorban: %v.",
+		"label-empty":           "Szintaktikai hiba. Üres címke ebben a sorban: %v.",
+		"label-invalid":         "Szintaktikai hiba. Érvénytelen címke: \"%v\" ebben a sorban: %v.",
+		"label-duplicate":       "Szintaktikai hiba. Ismétlődő címke: \"%v\" ebben a sorban: %v.",
+		"label-undefined":       "Szintaktikai hiba. Nem definiált címke: \"%v\" ebben a sorban: %v.",
+		"label-undefined-pusha": "Szintaktikai hiba. Nem definiált címke: \"%v\" ebben a sorban: %v, a pusha a program egy címkéjét várja.",
+		"label-range":           "Szintaktikai hiba. A(z) \"%[2]v\" címke %[1]v címe kívül esik a push 0-127 tartományán ebben a sorban: %[3]v, pozíció: %[4]v. %[5]v",
+		"label-range-pusha":     "Szintaktikai hiba. A(z) \"%v\" címke %v cellára van a pusha-tól, kívül a push 0-127 tartományán, ebben a sorban: %v, pozíció: %v.",
+		"push-groups":           "Tedd a verembe a 7 bites csoportjait: %v.",
+		"push-groups-wordsize":  "Tedd a verembe a 7 bites csoportjait legalább %v bites -wordsize mellett: %v.",
+		"extra-text":            "Fölösleges szöveg elhagyva: \"%v\" ebben a sorban: %v.",
+		"empty-instr":           "Üres utasítás ebben a sorban: %v, pozíció: %v. A helyére nop kerül.",
+		"missing-instr":         "Hiányzó utasítás ebben a sorban: %v, pozíció: %v. A helyére nop kerül.",
+		"unknown-op":            "Ismeretlen utasítás: \"%v\" ebben a sorban: %v, pozíció: %v. A helyére nop kerül.",
+		"string-invalid":        "Érvénytelen szövegliterál ebben a sorban: %v, pozíció: %v. A helyére nop kerül.",
+		"string-range":          "A szövegliterál kívül esik a tartományon ebben a sorban: %v, pozíció: %v. A helyére nop kerül.",
+		"push-no-arg":           "push argumentum nélkül ebben a sorban: %v, pozíció: %v. Az értéke nulla lesz.",
+		"push-range":            "A push argumentuma kívül esik a tartományon ebben a sorban: %v, pozíció: %v. Az értéke nulla lesz.",
+		"push-invalid":          "A push argumentuma érvénytelen ebben a sorban: %v, pozíció: %v. Az értéke nulla lesz.",
+		"directive-unknown":     "Szintaktikai hiba. Ismeretlen direktíva: \"%v\" ebben a sorban: %v.",
+		"directive-count":       "Szintaktikai hiba. A(z) %[2]v érvénytelen darabszáma: \"%[1]v\" ebben a sorban: %[3]v.",
+		"directive-filler":      "Szintaktikai hiba. A(z) %[2]v érvénytelen kitöltője: \"%[1]v\" ebben a sorban: %[3]v.",
+		"start-invalid":         "Szintaktikai hiba. A .start érvénytelen címkéje: \"%v\" ebben a sorban: %v.",
+		"start-second":          "Szintaktikai hiba. Második .start ebben a sorban: %v, az első ebben a sorban van: %v.",
+		"start-range":           "Szintaktikai hiba. A(z) \"%v\" címke címe nem fér el a belépési cellában, ebben a sorban: %v.",
+		"export-invalid":        "Szintaktikai hiba. Az .export érvénytelen címkéje: \"%v\" ebben a sorban: %v.",
+		"export-twice":          "Szintaktikai hiba. A(z) \"%v\" címke kétszer van exportálva ebben a sorban: %v.",
+		"extern-invalid":        "Szintaktikai hiba. Az .extern érvénytelen címkéje: \"%v\" ebben a sorban: %v.",
+		"include-invalid":       "Szintaktikai hiba. Érvénytelen include: \"%v\" ebben a sorban: %v, az útvonalnak idézőjelek között kell lennie.",
+		"include-nested":        "Szintaktikai hiba. Include: \"%v\" ebben a sorban: %v, csak forrásfájlok illeszthetnek be fájlokat.",
+		"include-remote":        "Szintaktikai hiba. Távoli include: \"%v\" ebben a sorban: %v: %v.",
+		"include-missing":       "Szintaktikai hiba. A beillesztett fájl nem található: \"%v\" ebben a sorban: %v, keresve itt: %v.",
+		"include-cycle":         "Szintaktikai hiba. Körkörös include: %v ebben a sorban: %v.",
+		"include-unreadable":    "Szintaktikai hiba. A beillesztett fájl nem olvasható: \"%v\" ebben a sorban: %v: %v.",
+		"pragma-unknown":        "Ismeretlen pragma: \"%v\" ebben a sorban: %v. Figyelmen kívül marad.",
+		"pragma-value-count":    "A(z) \"%v\" pragmának egy érték kell ebben a sorban: %v. Figyelmen kívül marad.",
+		"pragma-late":           "A(z) \"%v\" pragmának az első utasítás előtt kell állnia ebben a sorban: %v. Figyelmen kívül marad.",
+		"pragma-value":          "A(z) \"%[2]v\" pragma érvénytelen értéke: \"%[1]v\" ebben a sorban: %[3]v. Figyelmen kívül marad.",
+		"pragma-warning":        "A warning pragma disable vagy enable lehet, ebben a sorban: %v. Figyelmen kívül marad.",
+		"pragma-warning-code":   "Ismeretlen figyelmeztetés: \"%v\" a pragmában ebben a sorban: %v. Figyelmen kívül marad.",
+		"contract-invalid":      "Érvénytelen veremszerződés: \"%v\" ebben a sorban: %v, a formája IN -> OUT. Figyelmen kívül marad.",
+		"contract-misplaced":    "A veremszerződés ebben a sorban: %v nem közvetlenül egy címkézett sor fölött áll. Figyelmen kívül marad.",
+		"stack-contract":        "A(z) %[3]v %[1]v -> %[2]v veremszerződése sérül, %[4]v, ebben a sorban: %[5]v.",
+		"contract-call-short":   "a(z) %v elérésekor %v érték van a veremben, a rutinja %v értéket vár",
+		"contract-call-result":  "a(z) %v felé vezető út %v értéket ad vissza",
+		"contract-join":         "a(z) %v elérésekor egyszer %v, máskor %v érték van a veremben",
+		"contract-underflow":    "a(z) %v a bemeneteknél mélyebbről vesz le értékeket",
+		"contract-return":       "a(z) %v visszatérése %v értéket hagy a veremben",
+		"fault-div-zero":        "Osztás nullával",
+		"fault-address":         "Ugrás a programon kívüli %v címre, a program címei 2 és %v között vannak",
+		"fault-data":            "Ugrás a(z) %v címre, egy .space adatcelláiba",
+		"fault":                 "Szintaktikai hiba. %v ebben a sorban: %v.",
+		"fault-origin":          "Szintaktikai hiba. %v ebben a sorban: %v, az értékek ebből a sorból származnak: %v.",
+		"fault-origins":         "Szintaktikai hiba. %v ebben a sorban: %v, az értékek ezekből a sorokból származnak: %v.",
+		"werror":                "Szintaktikai hiba. %v figyelmeztetés hibaként kezelve.",
+		"werror-one":            "Szintaktikai hiba. %v figyelmeztetés hibaként kezelve.",
+	},
+}
+
+// message returns the message of the ID in the language of the options, filled with the arguments
+func (opts options) message(id string, args ...any) string {
+	format, ok := catalog[opts.lang][id]
+	if !ok {
+		format = catalog[languages[0]][id]
+	}
+	return fmt.Sprintf(format, args...)
+}
@@ -0,0 +1,173 @@
+package main
+
+// Object files, with "pollock -f lib.plk -o lib.plko" or "pollock build -format plko"
+//
+// An object file holds a compiled module without drawing it, so pollock link can combine the modules of a large
+// project and only the changed ones are compiled again. It is the 8-byte signature "\x89PLK\r\n\x1a\n" followed by
+// chunks in the layout of PNG chunks, length, name, data and CRC:
+// plHd: the header cell, [major version, minor version, cell size % 256], followed by cell size / 256 for cell sizes
+// over 255
+// plPg: the program cells, three tokens per cell
+// plXt: the extension cells, three bytes per cell
+// plEx, plRl, plSy: the export, relocation and symbol tables of chunks.go, an object always has all the labels
+// and the relocation table, so it can be placed anywhere when linked
+// plSm: the source map, one "CELL LINE\n" line per program cell which starts a source line, both counted from 1,
+// "CELL LINE FILE\n" for the lines of included files
+// Objects are never shuffled or signed, those apply to the linked image. pollock link reads objects like images and
+// writes an object when its output is a .plko file, without a source map, whose lines would be of several files.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// File extension of object files
+const objectExt = ".plko"
+
+var objectSignature = []byte("\x89PLK\r\n\x1a\n")
+
+// objectChunks returns the chunks of the object file of the compiled program
+func (c compiled) objectChunks() []pngChunk {
+	var program, extensions bytes.Buffer
+	for i := 0; i < c.progline; i++ {
+		program.Write([]byte{c.program.r[i], c.program.g[i], c.program.b[i]})
+	}
+	for _, ext := range c.extensions {
+		extensions.Write(ext[:])
+	}
+	header := []byte{VMAJOR, uint8(c.minor), uint8(c.opts.cellsize)}
+	if c.opts.cellsize > maxHeaderCellsize {
+		header = append(header, uint8(c.opts.cellsize>>8))
+	}
+	chunks := []pngChunk{
+		{name: "plHd", data: header},
+		{name: "plPg", data: program.Bytes()},
+		{name: "plXt", data: extensions.Bytes()},
+	}
+	tables := c
+	tables.relocatable, tables.opts.symbols, tables.opts.signKey = true, true, nil
+	chunks = append(chunks, tables.chunks()...)
+	if c.debugPrints() {
+		// The chunks have the source map already
+		return chunks
+	}
+	return append(chunks, pngChunk{name: "plSm", data: c.sourceMap()})
+}
+
+// sourceMap returns the plSm chunk data of the program
+func (c compiled) sourceMap() []byte {
+	var sourceMap bytes.Buffer
+	if len(c.cellLines) == c.progline && len(c.cellFiles) == c.progline {
+		for i, line := range c.cellLines {
+			if i > 0 && line == c.cellLines[i-1] && c.cellFiles[i] == c.cellFiles[i-1] {
+				continue
+			}
+			if c.cellFiles[i] > 0 {
+				fmt.Fprintln(&sourceMap, i+1, line+1, c.files[c.cellFiles[i]].name)
+			} else {
+				fmt.Fprintln(&sourceMap, i+1, line+1)
+			}
+		}
+	}
+	return sourceMap.Bytes()
+}
+
+// writeObject writes the object file of the compiled program
+func writeObject(c compiled, outputfile string, opts options) error {
+	if len(opts.shuffleKey) > 0 || opts.signKey != nil {
+		return usageError("Fatal error: Object files can't be shuffled or signed, shuffle or sign the linked image.")
+	}
+	var buf bytes.Buffer
+	buf.Write(objectSignature)
+	for _, chunk := range c.objectChunks() {
+		writeChunk(&buf, chunk)
+	}
+	opts.logMsg(fmt.Sprint("Creating object file: ", outputfile))
+	if err := os.WriteFile(outputfile, buf.Bytes(), 0o644); err != nil {
+		return ioError(fmt.Sprint("Fatal create error: \"", err, "\""))
+	}
+	return nil
+}
+
+// decodeObject reads the chunks of an object file
+func decodeObject(data []byte) (compiled, error) {
+	var c compiled
+	if !bytes.HasPrefix(data, objectSignature) {
+		return c, errors.New("not an object file")
+	}
+	chunks, err := chunkMap(data)
+	if err != nil {
+		return c, err
+	}
+	header, program := chunks["plHd"], chunks["plPg"]
+	if len(header) < 3 || len(header) > 4 || len(program)%3 != 0 || len(chunks["plXt"])%3 != 0 {
+		return c, errors.New("invalid object header")
+	}
+	if header[0] != VMAJOR {
+		return c, errors.New(fmt.Sprint("unsupported format version ", header[0], ".", header[1]))
+	}
+	c.minor, c.opts.cellsize = int(header[1]), int(header[2])
+	if len(header) == 4 {
+		c.opts.cellsize |= int(header[3]) << 8
+	}
+	for i := 0; i < len(program); i += 3 {
+		c.program.r = append(c.program.r, program[i])
+		c.program.g = append(c.program.g, program[i+1])
+		c.program.b = append(c.program.b, program[i+2])
+	}
+	c.progline = len(c.program.r)
+	for ext := chunks["plXt"]; len(ext) > 0; ext = ext[3:] {
+		c.extensions = append(c.extensions, [3]uint8{ext[0], ext[1], ext[2]})
+	}
+	if err := c.readTables(chunks); err != nil {
+		return c, err
+	}
+	c.relocatable = true
+	return c, c.readSourceMap(chunks["plSm"])
+}
+
+// readSourceMap reads the plSm chunk into the source lines and the files of the cells, the main file has no name
+func (c *compiled) readSourceMap(data []byte) error {
+	c.files = []sourceFile{{}}
+	line, next := 0, 1
+	for _, entry := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.SplitN(strings.TrimSpace(entry), " ", 3)
+		if len(entry) == 0 {
+			continue
+		}
+		cell, err := strconv.Atoi(fields[0])
+		if err == nil && len(fields) >= 2 {
+			line, err = strconv.Atoi(fields[1])
+		}
+		if len(fields) < 2 || err != nil || cell < next || next == 1 && cell != 1 || cell > c.progline || line < 1 {
+			return errors.New(fmt.Sprint("invalid source map \"", entry, "\""))
+		}
+		file := 0
+		if len(fields) == 3 {
+			file = slices.IndexFunc(c.files, func(f sourceFile) bool { return f.name == fields[2] })
+			if file < 0 {
+				c.files = append(c.files, sourceFile{name: fields[2]})
+				file = len(c.files) - 1
+			}
+		}
+		for len(c.cellLines) < cell-1 {
+			c.cellLines = append(c.cellLines, c.cellLines[len(c.cellLines)-1])
+			c.cellFiles = append(c.cellFiles, c.cellFiles[len(c.cellFiles)-1])
+		}
+		c.cellLines = append(c.cellLines, line-1)
+		c.cellFiles = append(c.cellFiles, file)
+		next = cell + 1
+	}
+	if len(c.cellLines) > 0 {
+		for len(c.cellLines) < c.progline {
+			c.cellLines = append(c.cellLines, c.cellLines[len(c.cellLines)-1])
+			c.cellFiles = append(c.cellFiles, c.cellFiles[len(c.cellFiles)-1])
+		}
+	}
+	return nil
+}
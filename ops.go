@@ -0,0 +1,68 @@
+package main
+
+// Instruction reference, with "pollock ops [MNEMONIC...]"
+//
+// The reference is printed from the opcodes table the compiler tokenizes with, so it can't drift from the
+// instruction set: the token, the source form, the stack effect, the format version the token needs and a short
+// description of every instruction, in token order, or of the instructions named on the command line.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+// The push literals, the tokens with the top bit clear
+var pushLiteral = opcode{name: "push", operand: "N", effect: "( -- N )", doc: "Push N, 0 to 127, the token is N"}
+
+// opNames returns the mnemonics of the instructions
+func opNames() []string {
+	names := []string{pushLiteral.name}
+	for _, op := range opcodes {
+		names = append(names, op.name)
+	}
+	return names
+}
+
+// printOp prints a line of the reference
+func printOp(w io.Writer, op opcode) {
+	token := fmt.Sprintf("0x%02X", op.token)
+	if op == pushLiteral {
+		token = "0x00-7F"
+	}
+	form := strings.TrimSpace(op.name + " " + op.operand)
+	version := fmt.Sprint(VMAJOR, ".", tokenMinor(op.token))
+	fmt.Fprintf(w, "%-8s %-14s %-36s %-7s %s\n", token, form, op.effect, version, op.doc)
+}
+
+// ops prints the instruction reference and returns the exit code
+func ops(args []string) int {
+	flags := flag.NewFlagSet("ops", flag.ExitOnError)
+	flags.Parse(args)
+	table := append([]opcode{pushLiteral}, opcodes...)
+	slices.SortStableFunc(table, func(a, b opcode) int {
+		return int(a.token) - int(b.token)
+	})
+	if flags.NArg() > 0 {
+		var selected []opcode
+		for _, name := range flags.Args() {
+			i := slices.IndexFunc(table, func(op opcode) bool { return op.name == strings.ToLower(name) })
+			if i < 0 {
+				err := usageError(fmt.Sprint("Fatal error: Unknown instruction \"", name, "\"."))
+				log.Println(err)
+				return exitCode(err)
+			}
+			selected = append(selected, table[i])
+		}
+		table = selected
+	}
+	fmt.Printf("%-8s %-14s %-36s %-7s %s\n", "TOKEN", "FORM", "STACK EFFECT", "VERSION", "DESCRIPTION")
+	for _, op := range table {
+		printOp(os.Stdout, op)
+	}
+	return exitOK
+}
@@ -0,0 +1,466 @@
+package main
+
+// Optimization, with -O
+//
+// The passes run over the statements between parse and place, where labels are still names. The program is cut
+// into regions at the labeled lines, the .align lines and the .space lines. When every jump goes to a label pushed
+// right before it, by push LABEL or pusha LABEL, a region is only entered at its first cell, and the tokens of a
+// region can be rewritten and packed into fewer cells as long as they do the same. A jump to a push literal, to an
+// address computed by arithmetic or to one taken from the stack, e.g. a return address, may land in the middle of
+// a region, or behind it once the cells moved, so such a program is left as it is. The cells of .space are left as they are. The tokens of a
+// region are packed again after every pass, a cell keeps the source line of its first token, so the source map of
+// object files still points at the lines the instructions came from. A region whose tokens are all deleted keeps
+// its label on an empty statement, the label then goes to the cell after it.
+//
+// Strength reduction replaces the multiplications by a push literal power of two with left shifts, e.g.
+// push 8; mul with push 3; shl, which a VM on small hardware runs faster. A division becomes a right shift only if
+// the dividend can't be negative, when it was pushed by a push literal, pusha, depth or a comparison right before,
+// as shifting a negative value right doesn't round like a division. Multiplying or dividing by 1 is removed.
+//
+// Push and pop elimination deletes a value pushed and dropped right away: a push, pusha, depth, dup or over
+// followed by pop, both go. dup; swap becomes dup, as it swaps two copies of the same value, and swap; swap goes
+// away. The instructions left keep their source lines, so the debuggers still find the line of every cell.
+//
+// Jump threading makes the jumps to a trampoline, a labeled cell which starts with a jump that is always taken
+// (e.g. push 1; push NEXT; jmpnz) after nops or not, jump to where the trampoline goes instead, following chains
+// of trampolines. Only the push LABEL right before a jump is rewritten, a label pushed for something else, e.g. a
+// return address, stays. A trampoline whose label isn't used any more and which can't be reached by running
+// into it from the cell before is deleted.
+//
+// Constant folding replaces the push literals followed by arithmetic with the push of the result, e.g.
+// push 3; push 4; mul; push 1; add with push 13. The nops in between are skipped. Only results in the 0-127 range
+// of push are folded, and nothing which could overflow, underflow or divide by 0, so the folded program computes
+// the same with every word size. Label arguments are not constants, their addresses are known only after place.
+
+import (
+	"fmt"
+	"math/bits"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// optToken is a token of a region, with the statement it comes from and its label argument
+type optToken struct {
+	token uint8
+	stmt  int
+	ref   *labelRef
+}
+
+// optPass is an optimization over the tokens of each region, or over the whole program if program is set, it
+// returns the rewritten tokens or statements and the number of rewrites
+type optPass struct {
+	name    string
+	region  func(c *compiled, tokens []optToken) ([]optToken, int)
+	program func(c *compiled, statements []statement) ([]statement, int)
+}
+
+// optPasses are the passes of -O, in the order they run
+var optPasses = []optPass{
+	{name: "Constant folding", region: (*compiled).foldConstants},
+	{name: "Strength reduction", region: (*compiled).reduceStrength},
+	{name: "Push and pop elimination", region: (*compiled).dropUnused},
+	{name: "Jump threading", program: (*compiled).threadJumps},
+}
+
+// optimize runs the passes over the statements and logs what they saved
+func (c *compiled) optimize(statements []statement) []statement {
+	if !c.opts.optimize {
+		return statements
+	}
+	if lineno, ok := unlabeledJump(statements); ok {
+		c.opts.logMsg(fmt.Sprint("The jump in line: ", lineno+1, " doesn't go to a label, the program is not optimized."))
+		return statements
+	}
+	before := statementCells(statements)
+	for _, pass := range optPasses {
+		cells, rewrites := statementCells(statements), 0
+		if pass.program != nil {
+			statements, rewrites = pass.program(c, statements)
+		} else {
+			statements, rewrites = c.optimizeRegions(statements, pass.region)
+		}
+		c.opts.logMsg(fmt.Sprint(pass.name, ": ", rewrites, " rewrites, ", cells-statementCells(statements), " cells saved."))
+	}
+	c.opts.logMsg(fmt.Sprint("Optimized the program from ", before, " to ", statementCells(statements), " cells."))
+	return statements
+}
+
+// optimizeRegions runs a pass over the tokens of each region but those of .space
+func (c *compiled) optimizeRegions(statements []statement, pass func(c *compiled, tokens []optToken) ([]optToken, int)) ([]statement, int) {
+	var optimized []statement
+	rewrites := 0
+	for _, region := range optRegions(statements) {
+		if region[0].reserved {
+			optimized = append(optimized, region...)
+			continue
+		}
+		tokens, n := pass(c, regionTokens(region))
+		rewrites += n
+		optimized = append(optimized, packRegion(region, tokens)...)
+	}
+	return optimized, rewrites
+}
+
+// statementCells returns the number of cells of the statements, without the padding of .align
+func statementCells(statements []statement) int {
+	cells := 0
+	for _, s := range statements {
+		cells += len(s.tokens) / 3
+	}
+	return cells
+}
+
+// optRegions cuts the statements into regions, which start at labeled lines, .align lines and .space lines
+func optRegions(statements []statement) [][]statement {
+	var regions [][]statement
+	for i, s := range statements {
+		if i == 0 || len(s.label) > 0 || s.align > 0 || s.reserved || statements[i-1].reserved {
+			regions = append(regions, nil)
+		}
+		regions[len(regions)-1] = append(regions[len(regions)-1], s)
+	}
+	return regions
+}
+
+// regionTokens returns the tokens of the statements of a region in order
+func regionTokens(region []statement) []optToken {
+	var tokens []optToken
+	for i, s := range region {
+		first := len(tokens)
+		for _, token := range s.tokens {
+			tokens = append(tokens, optToken{token: token, stmt: i})
+		}
+		for _, ref := range s.refs {
+			tokens[first+ref.index].ref = &ref
+		}
+	}
+	return tokens
+}
+
+// packRegion lays the tokens of a region out in whole cells, a cell belongs to the statement of its first token
+// and the last one is filled with nop. The statements without tokens come first, the label and the alignment of
+// the region stay on its first cell, or on an empty statement if no token is left.
+func packRegion(region []statement, tokens []optToken) []statement {
+	nop, _ := tokenize([]byte("nop"))
+	var packed []statement
+	for _, s := range region {
+		if len(s.tokens) == 0 {
+			packed = append(packed, s)
+		}
+	}
+	empty := len(packed)
+	for i := 0; i < len(tokens); i += 3 {
+		origin := region[tokens[i].stmt]
+		if len(packed) == empty || packed[len(packed)-1].lineno != origin.lineno || packed[len(packed)-1].file != origin.file {
+			packed = append(packed, statement{file: origin.file, lineno: origin.lineno})
+		}
+		s := &packed[len(packed)-1]
+		for j := i; j < i+3; j++ {
+			if j >= len(tokens) {
+				s.tokens = append(s.tokens, nop)
+				continue
+			}
+			if ref := tokens[j].ref; ref != nil {
+				moved := *ref
+				moved.index = len(s.tokens)
+				s.refs = append(s.refs, moved)
+			}
+			s.tokens = append(s.tokens, tokens[j].token)
+		}
+	}
+	if len(region[0].tokens) > 0 {
+		if len(packed) == empty {
+			packed = append(packed, statement{file: region[0].file, lineno: region[0].lineno})
+		}
+		packed[empty].label, packed[empty].align, packed[empty].filler = region[0].label, region[0].align, region[0].filler
+	}
+	return packed
+}
+
+// unlabeledJump returns the line of the first jump whose address isn't pushed right before it by push LABEL or
+// pusha LABEL
+func unlabeledJump(statements []statement) (int, bool) {
+	for _, region := range optRegions(statements) {
+		if region[0].reserved {
+			continue
+		}
+		tokens := regionTokens(region)
+		for i, t := range tokens {
+			name := mnemonic(t.token)
+			if t.token&0b1000_0000 == 0 || !condJumps[name] && !fusedJumps[name] {
+				continue
+			}
+			address := previousToken(tokens, i)
+			if address >= 0 && labelAddress(tokens, address) {
+				continue
+			}
+			return region[t.stmt].lineno, true
+		}
+	}
+	return 0, false
+}
+
+// labelAddress tells if the value the token at index i pushes is the address of a label, by push LABEL or by the
+// pusha, push DISTANCE, add of pusha LABEL
+func labelAddress(tokens []optToken, i int) bool {
+	if ref := tokens[i].ref; ref != nil {
+		return !ref.relative && ref.part == 0
+	}
+	distance := previousToken(tokens, i)
+	name := mnemonic(tokens[i].token)
+	return (name == "add" || name == "sub") && distance >= 0 && tokens[distance].ref != nil && tokens[distance].ref.relative
+}
+
+// constant returns the value of a push literal token, false for other tokens and for label arguments
+func (t optToken) constant() (int, bool) {
+	return int(t.token), t.token&0b1000_0000 == 0 && t.ref == nil
+}
+
+// previousToken returns the index of the token before index i, skipping the nops, or -1
+func previousToken(tokens []optToken, i int) int {
+	nop, _ := tokenize([]byte("nop"))
+	for i--; i >= 0 && tokens[i].token == nop; i-- {
+	}
+	return i
+}
+
+// nextToken returns the index of the token after index i, skipping the nops, or len(tokens)
+func nextToken(tokens []optToken, i int) int {
+	nop, _ := tokenize([]byte("nop"))
+	for i++; i < len(tokens) && tokens[i].token == nop; i++ {
+	}
+	return i
+}
+
+// jumpLabel returns the label a push LABEL token is, if it is the address of a jump right after it
+func jumpLabel(tokens []optToken, i int) (*labelRef, bool) {
+	ref := tokens[i].ref
+	if ref == nil || ref.relative || ref.part > 0 {
+		return nil, false
+	}
+	next := nextToken(tokens, i)
+	if next == len(tokens) {
+		return nil, false
+	}
+	name := mnemonic(tokens[next].token)
+	return ref, condJumps[name] || fusedJumps[name]
+}
+
+// alwaysJumps tells if the token at index i is a jmpz or jmpnz with a push literal condition which always jumps,
+// and returns the label it jumps to
+func alwaysJumps(tokens []optToken, i int) (string, bool) {
+	name := mnemonic(tokens[i].token)
+	address := previousToken(tokens, i)
+	if !condJumps[name] || address < 0 {
+		return "", false
+	}
+	ref, ok := jumpLabel(tokens, address)
+	condition := previousToken(tokens, address)
+	if !ok || condition < 0 {
+		return "", false
+	}
+	value, ok := tokens[condition].constant()
+	return ref.label, ok && (value == 0) == (name == "jmpz")
+}
+
+// foldConstants replaces the arithmetic on push literals with the push of its result
+func (c *compiled) foldConstants(tokens []optToken) ([]optToken, int) {
+	folded := 0
+	for i := 0; i < len(tokens); i++ {
+		name := mnemonic(tokens[i].token)
+		b := previousToken(tokens, i)
+		if b < 0 {
+			continue
+		}
+		right, ok := tokens[b].constant()
+		if !ok {
+			continue
+		}
+		// The fused immediate instructions take their argument from the token
+		if op, arg, fused := strings.Cut(name, "i"); fused && len(arg) == 1 && slices.Contains([]string{"add", "sub", "mul"}, op) {
+			immediate, _ := strconv.Atoi(arg)
+			if value, ok := c.fold(op, right, immediate); ok {
+				tokens[b].token = uint8(value)
+				tokens = slices.Delete(tokens, i, i+1)
+				folded++
+				i = b
+			}
+			continue
+		}
+		a := previousToken(tokens, b)
+		if a < 0 {
+			continue
+		}
+		left, ok := tokens[a].constant()
+		if !ok {
+			continue
+		}
+		if value, ok := c.fold(name, left, right); ok {
+			tokens[a].token = uint8(value)
+			tokens = slices.Delete(tokens, i, i+1)
+			tokens = slices.Delete(tokens, b, b+1)
+			folded++
+			i = a
+		}
+	}
+	return tokens, folded
+}
+
+// reduceStrength replaces the multiplications and divisions by powers of two with shifts
+func (c *compiled) reduceStrength(tokens []optToken) ([]optToken, int) {
+	reduced := 0
+	for i := 0; i < len(tokens); i++ {
+		name := mnemonic(tokens[i].token)
+		b := previousToken(tokens, i)
+		if name != "mul" && name != "div" || b < 0 {
+			continue
+		}
+		divisor, ok := tokens[b].constant()
+		shift := bits.TrailingZeros(uint(divisor))
+		if !ok || divisor == 0 || divisor != 1<<shift {
+			continue
+		}
+		if name == "div" {
+			a := previousToken(tokens, b)
+			if a < 0 {
+				continue
+			}
+			if _, ok := tokens[a].constant(); !ok && !slices.Contains([]string{"pusha", "depth", "gt", "eq", "lt"}, mnemonic(tokens[a].token)) {
+				continue
+			}
+		}
+		reduced++
+		if shift == 0 {
+			tokens = slices.Delete(tokens, i, i+1)
+			tokens = slices.Delete(tokens, b, b+1)
+			i = b - 1
+			continue
+		}
+		shiftOp := map[string]string{"mul": "shl", "div": "shr"}[name]
+		tokens[b].token = uint8(shift)
+		tokens[i].token, _ = tokenize([]byte(shiftOp))
+	}
+	return tokens, reduced
+}
+
+// dropUnused deletes the values pushed and popped right away and the swaps of equal values
+func (c *compiled) dropUnused(tokens []optToken) ([]optToken, int) {
+	dropped := 0
+	for i := 0; i < len(tokens); i++ {
+		name := mnemonic(tokens[i].token)
+		b := previousToken(tokens, i)
+		if b < 0 {
+			continue
+		}
+		_, literal := tokens[b].constant()
+		previous := mnemonic(tokens[b].token)
+		switch {
+		case name == "pop" && (literal || tokens[b].ref != nil && !tokens[b].ref.relative || slices.Contains([]string{"pusha", "depth", "dup", "over"}, previous)),
+			name == "swap" && previous == "swap":
+			tokens = slices.Delete(tokens, i, i+1)
+			tokens = slices.Delete(tokens, b, b+1)
+		case name == "swap" && previous == "dup":
+			tokens = slices.Delete(tokens, i, i+1)
+		default:
+			continue
+		}
+		dropped++
+		i = b - 1
+	}
+	return tokens, dropped
+}
+
+// fold returns the result of a binary instruction on two push literals, false if it isn't a push literal too
+func (c *compiled) fold(name string, a int, b int) (int, bool) {
+	value, ok := c.evaluate(name, a, b)
+	return value, ok && value >= 0 && value <= 0b0111_1111
+}
+
+// truth returns the value of a comparison, 1 or 0
+func truth(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// threadJumps points the jumps to trampolines to where they go, and deletes the trampolines nothing goes to
+func (c *compiled) threadJumps(statements []statement) ([]statement, int) {
+	regions := optRegions(statements)
+	trampolines := make(map[string]string)
+	for _, region := range regions {
+		tokens := regionTokens(region)
+		first := nextToken(tokens, -1)
+		if len(region[0].label) == 0 || region[0].reserved || first == len(tokens) {
+			continue
+		}
+		jump := nextToken(tokens, nextToken(tokens, first))
+		if jump < len(tokens) {
+			if target, ok := alwaysJumps(tokens, jump); ok {
+				trampolines[region[0].label] = target
+			}
+		}
+	}
+	// The chains end at the first label which isn't a trampoline, cycles are left alone
+	final := func(label string) string {
+		seen := map[string]bool{label: true}
+		for {
+			next, ok := trampolines[label]
+			if !ok {
+				return label
+			}
+			if seen[next] {
+				return ""
+			}
+			seen[next] = true
+			label = next
+		}
+	}
+	threaded := 0
+	used := map[string]bool{c.start: true}
+	for _, export := range c.exports {
+		used[export] = true
+	}
+	for i, region := range regions {
+		if region[0].reserved {
+			continue
+		}
+		tokens := regionTokens(region)
+		for j := range tokens {
+			ref, ok := jumpLabel(tokens, j)
+			if !ok {
+				continue
+			}
+			if target := final(ref.label); len(target) > 0 && target != ref.label {
+				c.opts.logMsg(fmt.Sprint("Jump to \"", ref.label, "\" threaded to \"", target, "\" in line: ", region[tokens[j].stmt].lineno+1, "."))
+				ref.label = target
+				threaded++
+			}
+		}
+		regions[i] = packRegion(region, tokens)
+	}
+	for _, region := range regions {
+		for _, s := range region {
+			for _, ref := range s.refs {
+				used[ref.label] = true
+			}
+		}
+	}
+	var threadedStatements []statement
+	falls := true
+	for i, region := range regions {
+		label := region[0].label
+		if _, ok := trampolines[label]; ok && i > 0 && !falls && !used[label] {
+			c.opts.logMsg(fmt.Sprint("Deleted the trampoline \"", label, "\" in line: ", region[0].lineno+1, "."))
+			continue
+		}
+		threadedStatements = append(threadedStatements, region...)
+		tokens := regionTokens(region)
+		if last := previousToken(tokens, len(tokens)); last >= 0 {
+			_, always := alwaysJumps(tokens, last)
+			falls = !always && !stops[mnemonic(tokens[last].token)]
+		}
+	}
+	return threadedStatements, threaded
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"constant folding", "push 3; push 4; mul\nouti; halt; nop\n", "push 12; outi; halt\nnop; nop; nop\n"},
+		{"strength reduction", "ini; push 8; mul\nouti; halt; nop\n", "ini; push 3; shl\nouti; halt; nop\n"},
+		{"push and pop elimination", "ini; push 5; pop\nouti; halt; nop\n", "ini; outi; halt\nnop; nop; nop\n"},
+		{"jump threading", "push 1; push A; jmpnz\nA: push 1; push B; jmpnz\nB: halt; nop; nop\n", "push 1; push B; jmpnz\nB: halt; nop; nop\n"},
+		{"return address", "push 1; push R; jmpnz\nR: push 1; swap; jmpnz\npush 2; push 3; add\nouti; halt; nop\n", "push 1; push R; jmpnz\nR: push 1; swap; jmpnz\npush 2; push 3; add\nouti; halt; nop\n"},
+		{"jump to an address moved on the stack", "push 5; push 1; swap\njmpnz\npush 2; push 3; add\nouti\nhalt\n", "push 5; push 1; swap\njmpnz\npush 2; push 3; add\nouti\nhalt\n"},
+		{"jump to a push literal", "push 1; push 5; jmpnz\npush 2; push 3; add\nouti; nop; nop\nhalt; nop; nop\n", "push 1; push 5; jmpnz\npush 2; push 3; add\nouti; nop; nop\nhalt; nop; nop\n"},
+		{"jump to a computed address", "push 1; push 2; push 3\nadd; jmpnz; nop\npush 2; push 3; add\nouti; nop; nop\nhalt; nop; nop\n", "push 1; push 2; push 3\nadd; jmpnz; nop\npush 2; push 3; add\nouti; nop; nop\nhalt; nop; nop\n"},
+		{"labeled cells which are all deleted", "push 1; push L; jmpnz\nL: push 1; push 2; push 3\npop; pop; pop\nM: halt; nop; nop\n", "push 1; push L; jmpnz\nL: halt; nop; nop\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			optimized, err := testCompile(t, test.source, func(opts *options) { opts.optimize = true })
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := testCompile(t, test.want, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cell := firstDiff(testDecode(t, optimized).tokenStream(), want.tokenStream()); cell >= 0 {
+				t.Errorf("optimized program differs in cell %d:\n%s", cell, disassemble(optimized))
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+// Orientation cell (v1.1)
+//
+// Photo tools rotate and mirror images, e.g. to apply the EXIF orientation of a camera, which moves the header cell
+// out of the top left corner or swaps the rows and the columns of the grid, so the cells read are garbage. With
+// -orient the image gets an orientation extension cell (kind 7): [7, 'P', 'L']. Readers look for it in the 8
+// orientations of the image, as it is first, and read the image in the orientation where the header cell, the
+// program size cell and the extension cells lead to it, with a warning. Images without the cell are read as they
+// are.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Value of the orientation extension cell, "PL"
+const orientationMark = 0x504C
+
+// orientedImage is an image read back from a copy which was mirrored left to right, then turned clockwise by
+// quarter turns
+type orientedImage struct {
+	image.Image
+	turns    int
+	mirrored bool
+}
+
+// Bounds returns the bounds of the image in its original orientation
+func (o orientedImage) Bounds() image.Rectangle {
+	bounds := o.Image.Bounds()
+	if o.turns%2 == 1 {
+		return image.Rect(0, 0, bounds.Dy(), bounds.Dx())
+	}
+	return image.Rect(0, 0, bounds.Dx(), bounds.Dy())
+}
+
+// At returns the pixel the tool moved from x, y
+func (o orientedImage) At(x int, y int) color.Color {
+	w, h := o.Bounds().Dx(), o.Bounds().Dy()
+	if o.mirrored {
+		x = w - 1 - x
+	}
+	switch o.turns {
+	case 1:
+		x, y = h-1-y, x
+	case 2:
+		x, y = w-1-x, h-1-y
+	case 3:
+		x, y = y, w-1-x
+	}
+	origin := o.Image.Bounds().Min
+	return o.Image.At(origin.X+x, origin.Y+y)
+}
+
+// String describes what the tool did to the image
+func (o orientedImage) String() string {
+	rotated := fmt.Sprint("rotated by ", 90*o.turns, " degrees clockwise")
+	switch {
+	case o.turns == 0:
+		return "mirrored"
+	case o.mirrored:
+		return "mirrored and " + rotated
+	}
+	return rotated
+}
+
+// oriented tells if the image has the orientation cell, read with its first pixel as the top left corner
+func oriented(img image.Image) bool {
+	bounds := img.Bounds()
+	header := color.NRGBAModel.Convert(img.At(bounds.Min.X, bounds.Min.Y)).(color.NRGBA)
+	if header.R != VMAJOR || header.G < 1 {
+		return false
+	}
+	cellsize := measureCellsize(img, int(header.B))
+	if header.B == 0 {
+		_, cellsize = extendedCellsize(img)
+	}
+	if cellsize == 0 {
+		return false
+	}
+	maxX, cells := bounds.Dx()/cellsize, bounds.Dx()/cellsize*(bounds.Dy()/cellsize)
+	if cells < 2 {
+		return false
+	}
+	size := cellAt(img, 1, maxX, cellsize)
+	for k := int(size.R)<<16 | int(size.G)<<8 | int(size.B) + 2; k < cells; k++ {
+		cell := cellAt(img, k, maxX, cellsize)
+		if cell.A == 0 || cell.R == 0 {
+			break
+		}
+		if cell.R == extOrientation && int(cell.G)<<8|int(cell.B) == orientationMark {
+			return true
+		}
+	}
+	return false
+}
+
+// orient returns the image in the orientation of its orientation cell and what was done to it, the image as it is
+// and "" if it has no orientation cell or is in its original orientation
+func orient(img image.Image) (image.Image, string) {
+	if oriented(img) {
+		return img, ""
+	}
+	for i := 1; i < 8; i++ {
+		o := orientedImage{Image: img, turns: i % 4, mirrored: i >= 4}
+		if oriented(o) {
+			return o, o.String()
+		}
+	}
+	return img, ""
+}
@@ -0,0 +1,96 @@
+package main
+
+// Painted cells
+//
+// -jitter, -background and -filler paint the pixels of the cells of PNG images instead of filling them with the
+// cell colors. Only the center pixel of a cell keeps its exact color, the pixel 1.1 decoders sample, so painted
+// images need format 1.1, and they get an extension cell (kind 4) whose value has the bits of the painting modes,
+// 1 for -jitter, 2 for -background and 4 for -filler, which tells readers that the other pixels are no code. The
+// header cells and the extension cells stay flat, the cell size is measured on the header cell. The empty cells at
+// the end of the grid keep a transparent center. The grid lines and the patterns of -palette are drawn over the
+// paint.
+
+import "image/color"
+
+// The bits of the painting modes in the art extension cell
+const (
+	artJitter     = 1
+	artBackground = 2
+	artFiller     = 4
+)
+
+// artModes returns the bits of the painting modes of the options, 0 if the cells are flat
+func (opts options) artModes() int {
+	modes := 0
+	if opts.jitter > 0 {
+		modes |= artJitter
+	}
+	if opts.background != nil {
+		modes |= artBackground
+	}
+	if len(opts.filler) > 0 {
+		modes |= artFiller
+	}
+	return modes
+}
+
+// painter paints the pixels of the cells of an image of maxX by maxY cells
+type painter struct {
+	opts     options
+	colors   []color.RGBA
+	progline int
+	maxX     int
+	cellsize int
+	width    int
+	height   int
+	filler   *filler
+}
+
+// newPainter returns the painter of the image of the cell colors, nil if the cells are flat
+func newPainter(c compiled, colors []color.RGBA, maxX int, maxY int, cellsize int) *painter {
+	if c.opts.artModes() == 0 {
+		return nil
+	}
+	p := &painter{opts: c.opts, colors: colors, progline: c.progline, maxX: maxX, cellsize: cellsize, width: maxX * cellsize, height: maxY * cellsize}
+	if len(c.opts.filler) > 0 {
+		p.filler = newFiller(c.opts.filler, colors, c.progline, maxX, maxY, cellsize)
+	}
+	return p
+}
+
+// ink returns the color of the pixel at x, y of the k-th cell, false if it keeps the cell color
+func (p *painter) ink(k int, x int, y int) (color.RGBA, bool) {
+	program, empty := k >= 2 && k < p.progline+2, k >= len(p.colors)
+	if !program && !empty || x == p.cellsize/2 && y == p.cellsize/2 {
+		return color.RGBA{}, false
+	}
+	px, py := (k%p.maxX)*p.cellsize+x, (k/p.maxX)*p.cellsize+y
+	// The empty cells are transparent
+	var ink color.RGBA
+	if program {
+		ink = p.colors[k]
+	}
+	splashed := false
+	if p.filler != nil && (empty || isNopCell(ink)) {
+		if splash, ok := p.filler.ink(px, py); ok {
+			ink, splashed = splash, true
+		}
+	}
+	if empty && !splashed {
+		// The artwork shows unblended in the empty cells
+		if p.opts.background == nil {
+			return color.RGBA{}, false
+		}
+		return color.RGBAModel.Convert(p.opts.background.at(px, py, p.width, p.height)).(color.RGBA), true
+	}
+	if !splashed && p.opts.jitter == 0 && p.opts.background == nil {
+		return ink, false
+	}
+	if p.opts.jitter > 0 && program {
+		ink, _ = jitterInk(ink, k, x, y, p.cellsize, p.opts.jitter)
+	}
+	if p.opts.background != nil {
+		ink = p.opts.background.over(ink, px, py, p.width, p.height)
+	}
+	return ink, true
+}
@@ -0,0 +1,65 @@
+package main
+
+// Patched images
+//
+// Jitter and filler art are drawn from the whole program, so a change of one instruction repaints every cell and a
+// printed series of versions of a program shows no difference that means anything. With -patch the PNG image is
+// drawn as usual, then every cell whose color is the same as in the existing output file, and every empty cell that
+// was empty already, gets the pixels of the old image back, so only the changed cells are painted again. The old
+// image must have the same size in pixels and cells, otherwise all the cells are drawn.
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+)
+
+// usedCells returns the number of cells of the header, the program and the extension cells in a decoded image
+func usedCells(img image.Image, maxX int, cellsize int) int {
+	size := cellAt(img, 1, maxX, cellsize)
+	k := int(size.R)<<16 | int(size.G)<<8 | int(size.B) + 2
+	for cells := img.Bounds().Dx() / cellsize * (img.Bounds().Dy() / cellsize); k < cells; k++ {
+		if cell := cellAt(img, k, maxX, cellsize); cell.A == 0 || cell.R == 0 {
+			break
+		}
+	}
+	return k
+}
+
+// patchImage copies the unchanged cells of the old image in the output file into the image of the cells
+func patchImage(imagePix *image.RGBA, cells compiled, outputfile string, opts options) {
+	data, err := os.ReadFile(outputfile)
+	if err != nil {
+		opts.logMsg(fmt.Sprint("No previous image \"", outputfile, "\" to patch, drawing all the cells."))
+		return
+	}
+	colors := cells.cellColors(opts.cellsize)
+	cellsize := opts.cellsize
+	maxX, maxY := imagePix.Bounds().Dx()/cellsize, imagePix.Bounds().Dy()/cellsize
+	old, err := png.Decode(bytes.NewReader(data))
+	// The header cell tells the format version and the cell size
+	if err != nil || old.Bounds().Size() != imagePix.Bounds().Size() || cellAt(old, 0, maxX, cellsize) != color.NRGBAModel.Convert(colors[0]) {
+		opts.logMsg(fmt.Sprint("The cells of \"", outputfile, "\" don't line up with the new ones, drawing all the cells."))
+		return
+	}
+	used := usedCells(old, maxX, cellsize)
+	kept := 0
+	for k := 0; k < maxX*maxY; k++ {
+		if k < len(colors) {
+			cell := color.NRGBAModel.Convert(colors[k]).(color.NRGBA)
+			if k >= used || cellAt(old, k, maxX, cellsize) != cell {
+				continue
+			}
+		} else if k < used {
+			continue
+		}
+		cellRect := image.Rect(k%maxX*cellsize, k/maxX*cellsize, (k%maxX+1)*cellsize, (k/maxX+1)*cellsize)
+		draw.Draw(imagePix, cellRect, old, old.Bounds().Min.Add(cellRect.Min), draw.Src)
+		kept++
+	}
+	opts.logMsg(fmt.Sprint("Patched ", maxX*maxY-kept, " of ", maxX*maxY, " cells of \"", outputfile, "\"."))
+}
@@ -0,0 +1,101 @@
+package main
+
+// Print-ready PDF output
+//
+// An output file ending in .pdf (or -format pdf) gets the program as a one page PDF for print shops: every cell is a
+// filled vector rectangle, so the grid prints sharp at any size. The art is -print-width millimeters wide, or as
+// wide as the PNG image would print at -dpi, and sits in the TrimBox of the page. Around it the page has a white
+// margin of pdfMargin millimeters with crop marks at the four corners, which stop pdfMarkGap millimeters before
+// the trim edge. The BleedBox is the TrimBox, the cells end exactly at the edge.
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// Default resolution of -dpi
+const defaultDPI = 300
+
+// Sizes of the page around the art in millimeters
+const (
+	pdfMargin  = 10.0
+	pdfMarkGap = 2.0
+	pdfMarkLen = 6.0
+)
+
+// Points of a millimeter, the unit of PDF
+const ptPerMM = 72 / 25.4
+
+// writePDF writes the cells of the program as a PDF page with crop marks
+func writePDF(w io.Writer, c compiled, opts options) error {
+	colors := c.cellColors(opts.cellsize)
+	maxX, maxY := layout(len(colors))
+	c.opts.logMsg(fmt.Sprint("X size: ", maxX, ", Y size: ", maxY))
+	widthMM := opts.printWidth
+	if widthMM == 0 {
+		widthMM = float64(maxX*opts.cellsize) / float64(opts.dpi) * 25.4
+	}
+	cell := widthMM * ptPerMM / float64(maxX)
+	margin := pdfMargin * ptPerMM
+	artW, artH := cell*float64(maxX), cell*float64(maxY)
+	pageW, pageH := artW+2*margin, artH+2*margin
+	c.opts.logMsg(fmt.Sprintf("Print size: %.1f x %.1f mm", widthMM, widthMM*float64(maxY)/float64(maxX)))
+
+	var content bytes.Buffer
+	for k, cellColor := range colors {
+		x, y := margin+float64(k%maxX)*cell, margin+float64(maxY-1-k/maxX)*cell
+		fmt.Fprintf(&content, "%.4f %.4f %.4f rg %.3f %.3f %.3f %.3f re f\n",
+			float64(cellColor.R)/255, float64(cellColor.G)/255, float64(cellColor.B)/255, x, y, cell, cell)
+	}
+	if opts.grid.A != 0 {
+		fmt.Fprintf(&content, "%.4f %.4f %.4f RG 0.5 w\n", float64(opts.grid.R)/255, float64(opts.grid.G)/255, float64(opts.grid.B)/255)
+		for k := range colors {
+			fmt.Fprintf(&content, "%.3f %.3f %.3f %.3f re S\n", margin+float64(k%maxX)*cell, margin+float64(maxY-1-k/maxX)*cell, cell, cell)
+		}
+	}
+	// Crop marks, a horizontal and a vertical line at each corner of the trim box
+	gap, length := pdfMarkGap*ptPerMM, pdfMarkLen*ptPerMM
+	fmt.Fprintln(&content, "0 0 0 RG 0.25 w")
+	for _, corner := range [][2]float64{{margin, margin}, {margin + artW, margin}, {margin, margin + artH}, {margin + artW, margin + artH}} {
+		dx, dy := -1.0, -1.0
+		if corner[0] > margin {
+			dx = 1
+		}
+		if corner[1] > margin {
+			dy = 1
+		}
+		fmt.Fprintf(&content, "%.3f %.3f m %.3f %.3f l S\n", corner[0]+dx*gap, corner[1], corner[0]+dx*(gap+length), corner[1])
+		fmt.Fprintf(&content, "%.3f %.3f m %.3f %.3f l S\n", corner[0], corner[1]+dy*gap, corner[0], corner[1]+dy*(gap+length))
+	}
+	var stream bytes.Buffer
+	zw := zlib.NewWriter(&stream)
+	zw.Write(content.Bytes())
+	zw.Close()
+
+	trim := fmt.Sprintf("[%.3f %.3f %.3f %.3f]", margin, margin, margin+artW, margin+artH)
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.3f %.3f] /TrimBox %s /BleedBox %s /Contents 4 0 R /Resources << >> >>",
+			pageW, pageH, trim, trim),
+		fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", stream.Len(), stream.Bytes()),
+		fmt.Sprintf("<< /Title (Pollock program) /Producer (Pollock %d.%d) >>", VMAJOR, VMINOR),
+	}
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = pdf.Len()
+		fmt.Fprintf(&pdf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := pdf.Len()
+	fmt.Fprintf(&pdf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&pdf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&pdf, "trailer\n<< /Size %d /Root 1 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, len(objects), xref)
+	_, err := w.Write(pdf.Bytes())
+	return err
+}
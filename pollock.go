@@ -6,37 +6,175 @@ package main
 // Pollock image format definition
 // First pixel of the first cell: [major version, minor version, cellsize]
 // First pixel of the second cell: [tnol % 16777216, tnol % 65536, tnol % 256], where tnol = total number of lines - 2
+// With -grid the last pixel row and column of every cell are grid lines, the first and the center pixels of the
+// cells keep their colors. With -jitter, -background and -filler (v1.1) only the center pixels of the cells keep
+// their colors.
 // We do not need to count the first two elements, since they are the metainfo
 //
 // If the number of lines is 0 or 1, we have a vertical image, due to flooring sqrt!
 // After acquiring the metadata, any pixel is good from the cell to get the 3 channel instructions (v1.0)
 //
+// Extension cells (v1.1)
+// After the tnol program cells, a 1.1 image may have extension cells: [kind, value / 256, value % 256].
+// The list ends at the first cell with kind 0, the unused cells at the end of the grid are transparent black.
+// Kind 1: word size of the stack cells in bits (16 or 32), written for -wordsize 16 and 32, 8 bits otherwise.
+// Kind 2: address of the entry cell, written for .start, execution begins at cell 2 otherwise.
+// Kind 3: key check and encrypted nonce of a shuffled program, written for -shuffle (see shuffle.go).
+// Kind 4: the painting modes of -jitter, -background and -filler, only the center pixels are code (see paint.go).
+// Kind 5: the features a reader needs to read the cells, written first, unknown ones fail (see features.go).
+// Kind 6: cell size over 255, when the header cell has 0 for it (see cellsize.go).
+// Kind 7: orientation mark "PL", written for -orient, so rotated and mirrored images can be read (see orient.go).
+// With -rle, runs of identical program cells are written as repeat cells (see rle.go), and tnol counts the cells
+// written.
+//
 // Pollock assembly allows the usage of labels of 7 chars, starting with a capital letter, followed by more capital letters and digits.
+// A label is defined as "LABEL: instructions" and its address is the index of the cell of that line, counting the two
+// metainfo cells too, so the first line of the program is at address 2.
+// push LABEL pushes the address of the label, which must fit in the 0-127 range of the push argument, a label
+// further in the program is an error, which suggests pushing the 7-bit groups of the address instead.
+// push LABEL_1 to push LABEL_4 push the 1st to 4th 7-bit group of the address, starting from the lowest bits.
+// Labels can be used before they are defined, they are filled in after the whole file is read.
+//
+// Cell addresses
+// pusha pushes the address of its own cell, a full word, not limited to the range of push.
+// pusha LABEL pushes the address of the label counted from there: it expands into pusha, push DISTANCE and add, or
+// sub for a label before the cell, so the distance must fit in 0-127 but the addresses don't. The code doesn't depend
+// on where it is placed, and it needs no relocation when images are linked.
+//
+// Compare and branch
+// jeq LABEL, jlt LABEL and jgt LABEL pop two values and jump to the label if the first is equal to, less than or
+// greater than the second. They lower to eq, lt or gt, push LABEL and jmpnz, where jmpnz pops the address first and
+// the tested value second. When targeting 1.1 they are encoded as push LABEL and a fused jeq, jlt or jgt instruction,
+// placed after eq, lt and gt, saving a third of the instructions.
+//
+// String literals
+// push "text" (or pushs "text") expands into a push of 0 followed by pushes of the characters in reverse order,
+// so the first character is on the top of the stack and the string is terminated by NUL.
+// pushl "text" pushes the characters in reverse order and then the length of the text instead of the terminator.
+// The escapes \n, \t, \r, \0, \\, \", \' and \xHH are allowed, every character must be in the 0-127 range.
+// Push arguments can be written in decimal, or with the 0x, 0b and 0o prefixes in hexadecimal, binary and octal.
+// Negative arguments are pushed as their magnitude followed by neg, e.g. push -5 is push 5; neg, with every word
+// size, so they keep their value. With -wordsize 16 or 32, wider arguments expand into pushes of their 7-bit groups
+// joined with push 7, shl and or, where shl pops the shift count first.
+// push 'c' pushes the value of a single character, with the same escapes, e.g. push '\n' or push '\0'.
+// The expanded instructions fill the channels of the line in order and continue in new cells if needed.
+//
+// Format versions
+// The 1.0 instruction set only uses multiples of four between 0x80 and 0xEC. Every other token with the top bit set
+// belongs to format 1.1, and the compiler writes minor version 1 into the header if the program uses any of them.
+//
+// Immediate arithmetic
+// addi N, subi N and muli N expand into push N and add, sub or mul. When targeting 1.1 (-t 1.1) and N is 1, 2 or 3,
+// they are encoded as a single fused instruction instead: the low two bits of the add, sub and mul tokens hold N.
+//
+// Stack instructions (v1.1), Forth style, with the stack effects written as ( before -- after ), top on the right
+// nip ( a b -- b ), tuck ( a b -- b a b ), over ( a b -- a b a )
+// pick ( xn ... x0 n -- xn ... x0 xn ), so 0 pick is dup and 1 pick is over
+// roll ( xn ... x0 n -- xn-1 ... x0 xn ), so 1 roll is swap and 2 roll is rot
+// depth ( -- n ) pushes the number of values on the stack before the instruction
+// They are placed next to their 1.0 relatives: nip after pop, tuck after swap, over, pick and depth after dup, roll after rot.
+//
+// Heap instructions (v1.1)
+// alloc: pops a size, reserves that many bytes in the RAM segment of the VM and pushes the address of the block (0 if it fails)
+// free: pops an address previously returned by alloc and releases the block
+// The allocator itself is part of the VM, the compiler only encodes the instructions.
+//
+// Unicode output (v1.1)
+// outu ( cp -- ) prints the character of the Unicode code point cp encoded in UTF-8, one to four bytes, where outc
+// prints a single byte. Surrogates and values over 0x10FFFF print U+FFFD. It is placed after outc. With -wordsize 16
+// or 32, push 'c' takes any character, e.g. push 'é' or push '€', and pushes its code point in 7-bit groups, so
+// push '€'; outu prints the euro sign. 8-bit words only hold the code points up to 255, the Latin-1 characters.
 //
-// Todo:
-// - Add support for labels
+// Debug prints (v1.1)
+// outd ( a -- a ) prints the top value, without popping it, along with the address of its cell and the source line
+// of the cell, when the VM runs in debug mode, and does nothing otherwise. With -release the compiler assembles it
+// to nop, so the prints can stay in the source. Images with outd get the source map of object files in a plSm
+// chunk (see object.go), which linked images don't keep. It is placed after outu.
+//
+// Number input
+// ini ( -- n ) skips the whitespace of the input, reads an optional + or - sign and the decimal digits after it, and
+// pushes the number, the first character after the digits is left for the next read. The VM traps (exit code 6) at
+// the end of the input, on a sign or another character without digits, and on a number out of the range of the
+// signed words, -128 to 127 with -wordsize 8. The reading itself is part of the VM.
+//
+// Input polling and timing (v1.1)
+// poll ( -- flag ) pushes 1 if inc would return a character right away, from the input or the key events of the
+// window of the VM, and 0 if it would wait, so interactive programs can keep drawing between key presses. At the
+// end of the input it pushes 0. It is placed after inc.
+// waita ( -- ) waits until a character can be read, until poll would push 1, and leaves the character for inc. It
+// returns at the end of the input too. Press-any-key pauses are waita; inc; pop.
+// sleep ( ms -- ) waits ms milliseconds, a negative count is 0, so demos can pace their output. In its deterministic
+// mode the VM advances a virtual clock instead of waiting, so tests run at full speed. It is placed after waita.
+//
+// Turtle graphics (v1.1)
+// The VM keeps a turtle on its framebuffer, which starts in the middle facing up, with its pen down and white.
+// fwd ( n -- ) moves it n pixels forward, a negative n backwards, and draws a line if the pen is down.
+// turn ( deg -- ) turns it deg degrees clockwise, a negative deg counterclockwise.
+// pen ( flag -- ) puts the pen down if flag is not 0 and lifts it otherwise.
+// tcolor ( r g b -- ) sets the color of the pen, each channel from 0 to 255.
+// They take the tokens 0xF8 to 0xFB, the turtle and the framebuffer are part of the VM.
+//
+// Sound (v1.1)
+// tone ( hz ms -- ) plays a square wave of hz hertz for ms milliseconds and returns when it ends, a frequency of 0
+// is a rest, so a melody is a list of pushes and tones. Where the sound goes, the terminal bell, a WAV file of the
+// run or an audio backend, is up to the VM. It takes the token 0xFC, after the turtle.
+//
+// Exit codes (v1.1)
+// haltc ( code -- ) stops the program like halt, and the VM exits with code instead of 0, so programs can tell
+// shell scripts and tests how they went. It is placed after halt.
+//
+// Program arguments (v1.1)
+// The arguments after -- on the command line of the VM, e.g. 12 and 7 of "pollock run prog.png -- 12 7", are read
+// with argc ( -- n ), their number, argn ( i -- n ), the i-th one counted from 0 read like ini reads a number, and
+// argb ( i j -- c ), its j-th byte, 0 past its end, for the arguments which are text. argn on an argument which is
+// no number and an i out of range trap. They are placed after ini.
+//
+// Host calls (v1.1)
+// hostcall ( ... n -- ... ) calls the function the program embedding the VM registered as number n, which works on
+// the stack as it sees fit, e.g. to read a sensor or look up a record. hostcall N expands into push N and hostcall.
+// A number without a function traps. It takes the token 0xFD, the registry of the functions is part of the VM.
 
 import (
-	"bytes"
+	"crypto/ed25519"
 	"errors"
 	"flag"
 	"fmt"
 	"image"
 	"image/color"
-	"image/png"
+	"io"
 	"log"
 	"math"
+	"math/bits"
 	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 var pushOpWOArg = errors.New("Push operation without argument")
 var pushOpArgOutOfRange = errors.New("Push operation argument out of range")
 var pushOpArgInvalid = errors.New("Push operation argument invalid")
+var pushOpLabel = errors.New("Push operation label argument")
+var pushOpRelative = errors.New("Push operation relative label argument")
 var unknownOp = errors.New("Unknown operation")
+var strLitInvalid = errors.New("String literal invalid")
+var strLitOutOfRange = errors.New("String literal out of range")
 var silent bool
 
+// Kinds of the extension cells following the program (v1.1)
+const (
+	extWordSize    = 1
+	extEntry       = 2
+	extShuffle     = 3
+	extArt         = 4
+	extFeatures    = 5
+	extCellsize    = 6
+	extOrientation = 7
+)
+
 func colChannel(channel int) string {
 	switch channel {
 	case 0:
@@ -50,16 +188,110 @@ func colChannel(channel int) string {
 	}
 }
 
+// Token of pusha, which pusha LABEL is relative to
+const pushaToken = 0b1101_1100
+
+// opcode is an instruction and its token, with the operand of its source form, its stack effect and its description
+type opcode struct {
+	name    string
+	token   uint8
+	operand string
+	effect  string
+	doc     string
+}
+
+// opcodes is the table of the instructions without arguments, pusha is matched before push in tokenize.
+// pollock ops prints it as the instruction reference.
+var opcodes = []opcode{
+	{"pusha", pushaToken, "[LABEL]", "( -- addr )", "Push the address of its own cell, or of LABEL counted from it"},
+	{"add", 0b1000_0000, "", "( a b -- a+b )", "Add"},
+	{"sub", 0b1000_0100, "", "( a b -- a-b )", "Subtract"},
+	{"mul", 0b1000_1000, "", "( a b -- a*b )", "Multiply"},
+	{"div", 0b1000_1100, "", "( a b -- a/b )", "Divide"},
+	{"rem", 0b1001_0000, "", "( a b -- a%b )", "Remainder of the division"},
+	{"pop", 0b1001_0100, "", "( a -- )", "Drop the top value"},
+	{"swap", 0b1001_1000, "", "( a b -- b a )", "Swap the top two values"},
+	{"dup", 0b1001_1100, "", "( a -- a a )", "Duplicate the top value"},
+	{"rot", 0b1010_0000, "", "( a b c -- b c a )", "Rotate the third value to the top"},
+	{"not", 0b1010_0100, "", "( a -- !a )", "Bitwise not"},
+	{"or", 0b1010_1000, "", "( a b -- a|b )", "Bitwise or"},
+	{"and", 0b1010_1100, "", "( a b -- a&b )", "Bitwise and"},
+	{"gt", 0b1011_0000, "", "( a b -- a>b )", "1 if a is greater than b, 0 otherwise"},
+	{"eq", 0b1011_0100, "", "( a b -- a=b )", "1 if a equals b, 0 otherwise"},
+	{"lt", 0b1011_1000, "", "( a b -- a<b )", "1 if a is less than b, 0 otherwise"},
+	{"jgt", 0b1011_0001, "LABEL", "( a b addr -- )", "Jump to addr if a is greater than b"},
+	{"jeq", 0b1011_0101, "LABEL", "( a b addr -- )", "Jump to addr if a equals b"},
+	{"jlt", 0b1011_1001, "LABEL", "( a b addr -- )", "Jump to addr if a is less than b"},
+	{"nop", 0b1011_1100, "", "( -- )", "Do nothing"},
+	{"halt", 0b1100_0000, "", "( -- )", "Stop the program"},
+	{"haltc", 0b1100_0001, "", "( code -- )", "Stop the program with the exit code code"},
+	{"jmpz", 0b1100_0100, "", "( a addr -- )", "Jump to addr if a is 0"},
+	{"jmpnz", 0b1100_1000, "", "( a addr -- )", "Jump to addr if a is not 0"},
+	{"outc", 0b1100_1100, "", "( c -- )", "Print the character c"},
+	{"outu", 0b1100_1101, "", "( cp -- )", "Print the Unicode character cp in UTF-8"},
+	{"outd", 0b1100_1110, "", "( a -- a )", "Print the top value and the source line in debug runs, nop with -release"},
+	{"inc", 0b1101_0000, "", "( -- c )", "Read a character"},
+	{"poll", 0b1101_0001, "", "( -- flag )", "1 if a character can be read without waiting, 0 otherwise"},
+	{"outi", 0b1101_0100, "", "( n -- )", "Print the number n"},
+	{"ini", 0b1101_1000, "", "( -- n )", "Read a signed decimal number, skipping the whitespace"},
+	{"argc", 0b1101_1001, "", "( -- n )", "Push the number of program arguments"},
+	{"argn", 0b1101_1010, "", "( i -- n )", "Push the i-th program argument as a number"},
+	{"argb", 0b1101_1011, "", "( i j -- c )", "Push the j-th byte of the i-th program argument, 0 past its end"},
+	{"waita", 0b1110_0000, "", "( -- )", "Wait until a character can be read, without reading it"},
+	{"sleep", 0b1110_0001, "", "( ms -- )", "Wait ms milliseconds"},
+	{"neg", 0b1110_0100, "", "( a -- -a )", "Negate"},
+	{"shl", 0b1110_1000, "", "( a n -- a<<n )", "Shift left by n bits"},
+	{"shr", 0b1110_1100, "", "( a n -- a>>n )", "Shift right by n bits"},
+	{"addi1", 0b1000_0001, "", "( a -- a+1 )", "Add 1, from addi 1"},
+	{"addi2", 0b1000_0010, "", "( a -- a+2 )", "Add 2, from addi 2"},
+	{"addi3", 0b1000_0011, "", "( a -- a+3 )", "Add 3, from addi 3"},
+	{"subi1", 0b1000_0101, "", "( a -- a-1 )", "Subtract 1, from subi 1"},
+	{"subi2", 0b1000_0110, "", "( a -- a-2 )", "Subtract 2, from subi 2"},
+	{"subi3", 0b1000_0111, "", "( a -- a-3 )", "Subtract 3, from subi 3"},
+	{"muli1", 0b1000_1001, "", "( a -- a )", "Multiply by 1, from muli 1"},
+	{"muli2", 0b1000_1010, "", "( a -- a*2 )", "Multiply by 2, from muli 2"},
+	{"muli3", 0b1000_1011, "", "( a -- a*3 )", "Multiply by 3, from muli 3"},
+	{"nip", 0b1001_0101, "", "( a b -- b )", "Drop the second value"},
+	{"tuck", 0b1001_1001, "", "( a b -- b a b )", "Copy the top value under the second"},
+	{"over", 0b1001_1101, "", "( a b -- a b a )", "Copy the second value to the top"},
+	{"pick", 0b1001_1110, "", "( xn ... x0 n -- xn ... x0 xn )", "Copy the n-th value to the top"},
+	{"depth", 0b1001_1111, "", "( -- n )", "Push the number of values on the stack"},
+	{"roll", 0b1010_0001, "", "( xn ... x0 n -- xn-1 ... x0 xn )", "Move the n-th value to the top"},
+	{"alloc", 0b1111_0000, "", "( size -- addr )", "Reserve size bytes of RAM, addr is 0 if it fails"},
+	{"free", 0b1111_0100, "", "( addr -- )", "Release a block of alloc"},
+	{"fwd", 0b1111_1000, "", "( n -- )", "Move the turtle n pixels forward, drawing if its pen is down"},
+	{"turn", 0b1111_1001, "", "( deg -- )", "Turn the turtle deg degrees clockwise"},
+	{"pen", 0b1111_1010, "", "( flag -- )", "Put the pen of the turtle down if flag is not 0, lift it otherwise"},
+	{"tcolor", 0b1111_1011, "", "( r g b -- )", "Set the color of the pen of the turtle"},
+	{"tone", 0b1111_1100, "", "( hz ms -- )", "Play a tone of hz hertz for ms milliseconds"},
+	{"hostcall", 0b1111_1101, "[N]", "( ... n -- ... )", "Call the host function n, or N, registered by the embedder"},
+}
+
+// mnemonic returns the name of the instruction of a token, or the number of a push literal
+func mnemonic(token uint8) string {
+	if token&0b1000_0000 == 0 {
+		return strconv.Itoa(int(token))
+	}
+	for _, op := range opcodes {
+		if op.token == token {
+			return op.name
+		}
+	}
+	return fmt.Sprintf("0x%02X", token)
+}
+
 func tokenize(instr []byte) (uint8, error) {
 	//fmt.Println("Tokenizing instruction:", string(instr))
 	// First catching the special case of "pusha" instruction
 	if string(instr) == "pusha" {
-		return 0b1101_1100, nil
+		return pushaToken, nil
 	}
 	// Then catching the special case of "push" instruction
 	// The push instruction must have an argument, so we need to check for it
 	pushOp, _ := regexp.Compile(`^push.*$`)
 	labelArg, _ := regexp.Compile(`^[A-Z][A-Z0-9]{0,6}(_[1234])?$`)
+	relativeArg, _ := regexp.Compile(`^@[A-Z][A-Z0-9]{0,6}$`)
+	charArg, _ := regexp.Compile(`^'.+'$`)
 
 	if pushOp.Match(instr) {
 		pushArg := instr[4:]
@@ -67,15 +299,32 @@ func tokenize(instr []byte) (uint8, error) {
 			// If there is no argument, we return an error
 			return 0b0000_0000, pushOpWOArg
 		} else {
-			if labelArg.Match(pushArg) {
-				fmt.Println("   Label argument detected:", string(pushArg))
+			if charArg.Match(pushArg) {
+				// Character literal, the value is the byte of the (possibly escaped) character
+				char, ok := unescape(pushArg[1 : len(pushArg)-1])
+				if _, size := utf8.DecodeRune(char); ok && len(char) > 1 && size == len(char) {
+					// A character out of ASCII, which needs wider words
+					return 0b0000_0000, pushOpArgOutOfRange
+				}
+				if !ok || len(char) != 1 {
+					return 0b0000_0000, pushOpArgInvalid
+				}
+				if char[0] > 0b0111_1111 {
+					return 0b0000_0000, pushOpArgOutOfRange
+				}
+				return char[0], nil
+			} else if labelArg.Match(pushArg) {
+				// The address is not known yet, the caller fills it in after all labels are collected
+				return 0b0000_0000, pushOpLabel
+			} else if relativeArg.Match(pushArg) {
+				// The distance of the label from the pusha before, filled in like the addresses
+				return 0b0000_0000, pushOpRelative
 			} else {
-				pushArgUint, err := strconv.ParseUint(string(pushArg), 10, 8)
+				pushArgInt, err := parseLiteral(string(pushArg))
 				if err == nil {
-					pushArgUint8 := uint8(pushArgUint)
-					if pushArgUint8 >= 0b0000_0000 && pushArgUint8 <= 0b0111_1111 {
+					if pushArgInt >= 0b0000_0000 && pushArgInt <= 0b0111_1111 {
 						// If the argument is a number in the range of 0-127, we return it
-						return pushArgUint8, nil
+						return uint8(pushArgInt), nil
 					} else {
 						// If the argument is out of range, we return an error
 						return 0b0000_0000, pushOpArgOutOfRange
@@ -88,67 +337,276 @@ func tokenize(instr []byte) (uint8, error) {
 			}
 		}
 	}
-	// Handling the rest of the instructions
-	// We use a switch statement to match the instruction and return the corresponding token
-	switch string(instr) {
-	case "add":
-		return 0b1000_0000, nil
-	case "sub":
-		return 0b1000_0100, nil
-	case "mul":
-		return 0b1000_1000, nil
-	case "div":
-		return 0b1000_1100, nil
-	case "rem":
-		return 0b1001_0000, nil
-	case "pop":
-		return 0b1001_0100, nil
-	case "swap":
-		return 0b1001_1000, nil
-	case "dup":
-		return 0b1001_1100, nil
-	case "rot":
-		return 0b1010_0000, nil
-	case "not":
-		return 0b1010_0100, nil
-	case "or":
-		return 0b1010_1000, nil
-	case "and":
-		return 0b1010_1100, nil
-	case "gt":
-		return 0b1011_0000, nil
-	case "eq":
-		return 0b1011_0100, nil
-	case "lt":
-		return 0b1011_1000, nil
-	case "nop":
-		return 0b1011_1100, nil
-	case "halt":
-		return 0b1100_0000, nil
-	case "jmpz":
-		return 0b1100_0100, nil
-	case "jmpnz":
-		return 0b1100_1000, nil
-	case "outc":
-		return 0b1100_1100, nil
-	case "inc":
-		return 0b1101_0000, nil
-	case "outi":
-		return 0b1101_0100, nil
-	case "ini":
-		return 0b1101_1000, nil
-	case "waita":
-		return 0b1110_0000, nil
-	case "neg":
-		return 0b1110_0100, nil
-	case "shl":
-		return 0b1110_1000, nil
-	case "shr":
-		return 0b1110_1100, nil
+	// Handling the rest of the instructions, looking them up in the opcode table
+	for _, op := range opcodes {
+		if op.name == string(instr) {
+			return op.token, nil
+		}
+	}
 	// Unknown instruction, replacing it with a nop and raising an error
-	default:
-		return 0b1011_1100, unknownOp
+	return 0b1011_1100, unknownOp
+}
+
+// parseLiteral parses a decimal, 0x hexadecimal, 0b binary or 0o octal number with an optional minus sign
+// The magnitude must fit in 32 bits
+func parseLiteral(arg string) (int64, error) {
+	negative := strings.HasPrefix(arg, "-")
+	digits := strings.TrimPrefix(arg, "-")
+	base := 10
+	if len(digits) > 2 && digits[0] == '0' {
+		switch digits[1] {
+		case 'x', 'X':
+			base = 16
+		case 'b', 'B':
+			base = 2
+		case 'o', 'O':
+			base = 8
+		}
+		if base != 10 {
+			digits = digits[2:]
+		}
+	}
+	value, err := strconv.ParseUint(digits, base, 32)
+	if err != nil {
+		return 0, err
+	}
+	if negative {
+		return -int64(value), nil
+	}
+	return int64(value), nil
+}
+
+// cleanLine removes the comment, the whitespace and a trailing ";" from a line, except inside quoted literals
+func cleanLine(line []byte) []byte {
+	cleaned := make([]byte, 0, len(line))
+	var quote byte
+	escaped := false
+	for _, c := range line {
+		if quote != 0 {
+			cleaned = append(cleaned, c)
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '#':
+			// The rest of the line is a comment
+			if len(cleaned) > 0 && cleaned[len(cleaned)-1] == ';' {
+				cleaned = cleaned[:len(cleaned)-1]
+			}
+			return cleaned
+		case ' ', '\t', '\n', '\v', '\f', '\r':
+			continue
+		case '"', '\'':
+			quote = c
+		}
+		cleaned = append(cleaned, c)
+	}
+	if len(cleaned) > 0 && cleaned[len(cleaned)-1] == ';' {
+		cleaned = cleaned[:len(cleaned)-1]
+	}
+	return cleaned
+}
+
+// splitOutsideQuotes splits a cleaned line at the separator, except inside quoted literals
+func splitOutsideQuotes(line []byte, sep byte) [][]byte {
+	var items [][]byte
+	var quote byte
+	escaped := false
+	start := 0
+	for i, c := range line {
+		if quote != 0 {
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if c == '"' || c == '\'' {
+			quote = c
+		} else if c == sep {
+			items = append(items, line[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, line[start:])
+}
+
+// unescape converts the body of a quoted literal to bytes, resolving the \n, \t, \r, \0, \\, \", \' and \xHH escapes
+func unescape(body []byte) ([]byte, bool) {
+	var value []byte
+	for i := 0; i < len(body); i++ {
+		if body[i] != '\\' {
+			value = append(value, body[i])
+			continue
+		}
+		i++
+		if i >= len(body) {
+			return nil, false
+		}
+		switch body[i] {
+		case 'n':
+			value = append(value, '\n')
+		case 't':
+			value = append(value, '\t')
+		case 'r':
+			value = append(value, '\r')
+		case '0':
+			value = append(value, 0)
+		case '\\', '"', '\'':
+			value = append(value, body[i])
+		case 'x':
+			if i+2 >= len(body) {
+				return nil, false
+			}
+			hex, err := strconv.ParseUint(string(body[i+1:i+3]), 16, 8)
+			if err != nil {
+				return nil, false
+			}
+			value = append(value, uint8(hex))
+			i += 2
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// expand turns a pseudo-instruction into the sequence of instructions it stands for
+// Any other instruction is returned as it is
+// targetMinor is the minor format version targeted, newer targets may get shorter sequences
+// wordsize is the word size of the stack cells in bits, wider words allow wider push arguments
+func expand(instr []byte, targetMinor int, wordsize int) ([][]byte, error) {
+	stringLit, _ := regexp.Compile(`^push([sl]?)"(.*)"$`)
+	immediateOp, _ := regexp.Compile(`^(add|sub|mul)i(.*)$`)
+	branchOp, _ := regexp.Compile(`^j(eq|lt|gt)(.*)$`)
+	numberArg, _ := regexp.Compile(`^push(-?[0-9].*)$`)
+	pushaLabel, _ := regexp.Compile(`^pusha([A-Z][A-Z0-9]{0,6})$`)
+	charArg, _ := regexp.Compile(`^push'(.+)'$`)
+	hostcallOp, _ := regexp.Compile(`^hostcall(.+)$`)
+
+	if match := numberArg.FindSubmatch(instr); match != nil {
+		value, err := parseLiteral(string(match[1]))
+		if err == nil && value < 0 && value >= -(1<<(wordsize-1)) {
+			return append(pushGroups(-value), []byte("neg")), nil
+		}
+		if err == nil && wordsize > 8 && value > 0b0111_1111 && value < 1<<wordsize {
+			return pushGroups(value), nil
+		}
+	}
+
+	if match := charArg.FindSubmatch(instr); match != nil && wordsize > 8 {
+		// A character out of ASCII pushes its code point, for outu
+		if char, size := utf8.DecodeRune(match[1]); char > 0b0111_1111 && size == len(match[1]) && int64(char) < 1<<wordsize {
+			return pushGroups(int64(char)), nil
+		}
+	}
+
+	if match := pushaLabel.FindSubmatch(instr); match != nil {
+		// The address of the pusha cell plus the distance, add becomes sub for a label before it
+		return [][]byte{[]byte("pusha"), append([]byte("push@"), match[1]...), []byte("add")}, nil
+	}
+
+	if match := branchOp.FindSubmatch(instr); match != nil {
+		push := append([]byte("push"), match[2]...)
+		if targetMinor >= 1 {
+			return [][]byte{push, []byte("j" + string(match[1]))}, nil
+		}
+		return [][]byte{match[1], push, []byte("jmpnz")}, nil
+	}
+
+	if match := immediateOp.FindSubmatch(instr); match != nil {
+		// Fused form (v1.1) for the immediates 1-3, push and operation otherwise
+		if value, err := parseLiteral(string(match[2])); err == nil && targetMinor >= 1 && value >= 1 && value <= 3 {
+			return [][]byte{[]byte(string(match[1]) + "i" + strconv.Itoa(int(value)))}, nil
+		}
+		pushes, err := expand(append([]byte("push"), match[2]...), targetMinor, wordsize)
+		return append(pushes, match[1]), err
+	}
+
+	if match := hostcallOp.FindSubmatch(instr); match != nil {
+		// The number of the function goes on the top
+		pushes, err := expand(append([]byte("push"), match[1]...), targetMinor, wordsize)
+		return append(pushes, []byte("hostcall")), err
+	}
+
+	if match := stringLit.FindSubmatch(instr); match != nil {
+		text, ok := unescape(match[2])
+		if !ok {
+			return [][]byte{[]byte("nop")}, strLitInvalid
+		}
+		var pushes [][]byte
+		if string(match[1]) != "l" {
+			// NUL terminated, the terminator goes to the bottom
+			pushes = append(pushes, []byte("push0"))
+		}
+		// Pushing in reverse order, so the first character ends up on the top of the stack
+		for i := len(text) - 1; i >= 0; i-- {
+			if text[i] > 0b0111_1111 {
+				return [][]byte{[]byte("nop")}, strLitOutOfRange
+			}
+			pushes = append(pushes, []byte("push"+strconv.Itoa(int(text[i]))))
+		}
+		if string(match[1]) == "l" {
+			// Length prefixed, the length goes to the top
+			if len(text) > 0b0111_1111 {
+				return [][]byte{[]byte("nop")}, strLitOutOfRange
+			}
+			pushes = append(pushes, []byte("push"+strconv.Itoa(len(text))))
+		}
+		return pushes, nil
+	}
+	return [][]byte{instr}, nil
+}
+
+// pushGroups builds a value wider than the push argument from its 7-bit groups, starting from the highest one
+// Each further group is joined by shifting the value left by 7 and or-ing the group in
+func pushGroups(value int64) [][]byte {
+	shift := 0
+	for value>>(shift+7) > 0 {
+		shift += 7
+	}
+	pushes := [][]byte{[]byte("push" + strconv.Itoa(int(value>>shift)))}
+	for shift -= 7; shift >= 0; shift -= 7 {
+		pushes = append(pushes, []byte("push7"), []byte("shl"))
+		if group := (value >> shift) & 0b0111_1111; group != 0 {
+			pushes = append(pushes, []byte("push"+strconv.Itoa(int(group))), []byte("or"))
+		}
+	}
+	return pushes
+}
+
+// tokenMinor returns the minor format version needed to execute the token
+func tokenMinor(token uint8) int {
+	if token&0b1000_0000 == 0 {
+		// Push literal
+		return 0
+	}
+	if token&0b0000_0011 != 0 || token >= 0b1111_0000 {
+		return 1
 	}
+	return 0
+}
+
+// groupPushes returns the fix of a label address out of the range of push, the instructions joining its 7-bit groups
+func groupPushes(opts options, label string, address int) string {
+	parts := (bits.Len(uint(address)) + 6) / 7
+	fix := fmt.Sprint("push ", label, "_", parts)
+	for part := parts - 1; part >= 1; part-- {
+		fix += fmt.Sprint("; push 7; shl; push ", label, "_", part, "; or")
+	}
+	if bits.Len(uint(address)) > opts.wordsize {
+		return opts.message("push-groups-wordsize", 2*opts.wordsize, fix)
+	}
+	return opts.message("push-groups", fix)
 }
 
 func logWrapper(msg string) {
@@ -157,254 +615,581 @@ func logWrapper(msg string) {
 	}
 }
 
-func main() {
-	var filename string
-	var dryrun bool
-	var bytearray bool
-	var cellsize int
-	var outputfile string
-	var progline int = 0
-	var token uint8
-	var maxX, maxY int
+// VMAJOR and VMINOR are the format version written by the compiler, VMINOR may be raised by the program
+const (
+	VMAJOR = 1
+	VMINOR = 0
+)
 
-	type progarray struct {
-		r []uint8
-		g []uint8
-		b []uint8
+// progarray holds the three channels of the program cells
+type progarray struct {
+	r []uint8
+	g []uint8
+	b []uint8
+}
+
+// A label argument waiting for the address of its label, or for its distance from the pusha cell base if base > 0
+type fixup struct {
+	cell    int
+	channel int
+	label   string
+	part    int
+	file    int
+	lineno  int
+	item    int
+	base    int
+}
+
+// relative fills in the distance of the address from the pusha cell of the fixup, and turns the add after it
+// into sub if the address is before the cell, it returns the distance and false if it is out of the range of push
+func (p progarray) relative(f fixup, address int) (int, bool) {
+	distance := address - f.base
+	opCell, opChannel := f.cell+(f.channel+1)/3, (f.channel+1)%3
+	if distance < 0 {
+		distance = -distance
+		sub, _ := tokenize([]byte("sub"))
+		p.set(opCell, opChannel, sub)
+	}
+	if distance > 0b0111_1111 {
+		return distance, false
 	}
+	p.set(f.cell, f.channel, uint8(distance))
+	return distance, true
+}
 
-	const (
-		VMAJOR = 1
-		VMINOR = 0
-	)
+// at returns a channel of a program cell
+func (p progarray) at(cell int, channel int) uint8 {
+	return [3][]uint8{p.r, p.g, p.b}[channel][cell]
+}
 
-	// Parsing command line flags
-	flag.StringVar(&filename, "f", "", "Path to the file, mandatory")
-	flag.BoolVar(&dryrun, "d", false, "Run in dry run mode, default is false")
-	flag.BoolVar(&silent, "s", false, "Run in silent mode, default is false")
-	flag.BoolVar(&bytearray, "b", false, "Output only a bytes in text format, default is false")
-	flag.StringVar(&outputfile, "o", "", "Output file name, default is same as input file")
-	flag.IntVar(&cellsize, "c", 10, "Cell size in bytes, must be between 2 and 50, default value is 10")
-	flag.Parse()
+// set sets a channel of a program cell
+func (p progarray) set(cell int, channel int, token uint8) {
+	switch channel {
+	case 0:
+		p.r[cell] = token
+	case 1:
+		p.g[cell] = token
+	case 2:
+		p.b[cell] = token
+	}
+}
 
-	logWrapper("Pollock started")
-	logWrapper("Flags parsed")
-	logWrapper(fmt.Sprint(" Version: ", VMAJOR, ".", VMINOR))
-	logWrapper(fmt.Sprint(" Filename: ", filename))
-	logWrapper(fmt.Sprint(" Cell size: ", cellsize))
-	logWrapper(fmt.Sprint(" Dry run: ", dryrun))
-	logWrapper(fmt.Sprint(" Silent: ", silent))
-	logWrapper(fmt.Sprint(" Byte array: ", bytearray))
-	logWrapper(fmt.Sprint(" Output file: ", outputfile))
+// Address of the relocations of external labels, which are resolved by the linker
+const externAddress = -1
 
-	// Filename must exist, must have a .plk extension, cellsize must be between 2 and 50, outputfile is optional
-	if len(filename) == 0 {
-		log.Fatalln("Fatal error: Filename is required.")
+// reloc is a channel of a program cell holding a label address, or a 7-bit group of it if part > 0
+type reloc struct {
+	cell    int
+	channel int
+	part    int
+	address int
+	label   string
+}
+
+// diagnostic is a warning found while compiling, or a syntax error, with the source line and channel position if
+// known, it is the model of the JSON and SARIF outputs
+type diagnostic struct {
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line"`
+	Position string `json:"position,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	Code     string `json:"code"`
+	Label    string `json:"label,omitempty"`
+	Level    string `json:"level"`
+	Message  string `json:"message"`
+}
+
+// options holds the settings of a compilation
+// logger and out receive the messages and the byte array output, the standard log and stdout if nil
+type options struct {
+	cellsize    int
+	targetMinor int
+	wordsize    int
+	logger      *log.Logger
+	out         io.Writer
+	progress    bool
+	color       bool
+	werror      bool
+	nowarn      map[string]bool
+	symbols     bool
+	reloc       bool
+	signKey     ed25519.PrivateKey
+	shuffleKey  string
+	rle         bool
+	orient      bool
+	patch       bool
+	optimize    bool
+	release     bool
+	stats       bool
+	grid        color.RGBA
+	dpi         int
+	printWidth  float64
+	teach       bool
+	palette     string
+	jitter      int
+	background  *background
+	filler      string
+	sourceName  string
+	includeDirs []string
+	cacheDir    string
+	offline     bool
+	lang        string
+}
+
+// compiled is the result of a compilation
+// cellLines and cellFiles are the 0 based source line and the file of every program cell, for the source map of
+// object files
+type compiled struct {
+	program     progarray
+	progline    int
+	extensions  [][3]uint8
+	minor       int
+	diagnostics []diagnostic
+	opts        options
+	source      [][]byte
+	labels      map[string]int
+	contracts   map[string]stackContract
+	start       string
+	startFile   int
+	startLine   int
+	exports     []string
+	exportFiles []int
+	exportLines []int
+	relocs      []reloc
+	relocatable bool
+	externs     []string
+	signature   []byte
+	cellLines   []int
+	cellFiles   []int
+	dataCells   map[int]bool
+	files       []sourceFile
+	file        int
+}
+
+// newOptions checks the settings of a compilation
+func newOptions(cellsize int, target string, wordsize int) (options, error) {
+	opts := options{cellsize: cellsize, wordsize: wordsize}
+	if cellsize < minCellsize || cellsize > maxCellsize {
+		return opts, usageError(fmt.Sprint("Cell size must be between ", minCellsize, " and ", maxCellsize, "."))
 	}
-	if filename[len(filename)-4:] != ".plk" {
-		log.Fatalln("Fatal error: File must have a .plk extension.")
+	switch target {
+	case "1.0":
+		opts.targetMinor = 0
+	case "1.1":
+		opts.targetMinor = 1
+	default:
+		return opts, usageError("Target must be 1.0 or 1.1.")
 	}
-	if cellsize < 2 || cellsize > 50 {
-		log.Fatalln("Fatal error: Cell size must be between 2 and 100.")
+	if wordsize != 8 && wordsize != 16 && wordsize != 32 {
+		return opts, usageError("Word size must be 8, 16 or 32.")
 	}
-	if len(outputfile) == 0 {
-		outputfile = filename[0:len(filename)-4] + ".png"
-		logWrapper(fmt.Sprint("Output file not specified, using default: ", outputfile))
+	return opts, nil
+}
+
+// logMsg logs a message of the compilation, unless in silent mode
+func (opts options) logMsg(msg string) {
+	if opts.logger == nil {
+		logWrapper(msg)
+	} else if !silent {
+		opts.logger.Println(msg)
 	}
-	logWrapper(fmt.Sprint("Reading file: ", filename))
-	file, err := os.ReadFile(filename)
+}
+
+// output returns where the byte array output of the compilation goes
+func (opts options) output() io.Writer {
+	if opts.out == nil {
+		return os.Stdout
+	}
+	return opts.out
+}
+
+// warn logs a warning with its source line and keeps it as a diagnostic with its code, lineno is 0 based
+// item is the index of the instruction in the line, or wholeLine
+func (c *compiled) warn(lineno int, position string, item int, code string, msg string) {
+	if c.opts.nowarn[code] {
+		return
+	}
+	level, kindColor := "warning", colorWarning
+	if c.opts.werror {
+		level, kindColor = "error", colorError
+	}
+	kind := c.opts.message("kind-" + level)
+	column, width, rendered := c.locate(lineno, item, kindColor)
+	label := c.labelContext(lineno)
+	if len(label) > 0 {
+		msg = fmt.Sprint(msg, " ", c.opts.message("in-label", label))
+	}
+	if file := c.fileName(); len(file) > 0 {
+		msg = fmt.Sprint(file, ": ", msg)
+	}
+	c.diagnostics = append(c.diagnostics, diagnostic{File: c.fileName(), Line: lineno + 1, Position: position, Column: column, Width: width, Code: code, Label: label, Level: level, Message: msg})
+	prefix := kind + " "
+	if c.opts.color {
+		prefix = kindColor + kind + colorReset + " "
+	}
+	c.opts.logMsg(fmt.Sprint(prefix, msg, " [", code, "]\n", strings.TrimSuffix(rendered, "\n")))
+}
+
+// compile assembles the source into program cells and extension cells, the phases are in assemble.go
+// Syntax errors stop the compilation and are returned as errors
+func compile(file []byte, opts options) (compiled, error) {
+	c := compiled{opts: opts}
+	// The header gets at least the target version, and more if the program needs it
+	c.minor = opts.targetMinor
+	c.labels = make(map[string]int)
+	c.contracts = make(map[string]stackContract)
+	c.dataCells = make(map[int]bool)
+	lines := c.lex(file)
+	statements, err := c.parse(lines)
 	if err != nil {
-		log.Fatalln("Fatal error:", "\"", err, "\"")
-	}
-
-	// Building regexps
-	commentLine, _ := regexp.Compile(`(?m)^\s*#.*$`)
-	whitespace, _ := regexp.Compile(`\s+`)
-	comment, _ := regexp.Compile(`;?(#.*)?$`)
-	emptyLine, _ := regexp.Compile(`(?m)^$`)
-	colon, _ := regexp.Compile(`:`)
-	label, err := regexp.Compile(`[A-Z][A-Z0-9]{0,6}`)
-
-	logWrapper("Initializing program array")
-	fileLines := bytes.Split(file, []byte("\n"))
-	fileLinesLen := len(fileLines)
-	// Initialize the program array (length of fileLines) with "nop" instructions
-	// fileLines size is enough to hold all the instructions even if there are no empty or comment lines
-	program := progarray{r: make([]uint8, fileLinesLen), g: make([]uint8, fileLinesLen), b: make([]uint8, fileLinesLen)}
-	for i := 0; i < fileLinesLen; i++ {
-		program.r[i] = 0b1011_1100
-		program.g[i] = 0b1011_1100
-		program.b[i] = 0b1011_1100
-	}
-	logWrapper(fmt.Sprint("Program array initialized with ", fileLinesLen, " nop instructions."))
-	for lineno, lineStr := range fileLines {
-		//fmt.Println("Line number:", lineno, "Line string:", string(lineStr))
-		if emptyLine.Match(lineStr) {
-			// This is an empty line, skipping it
-			logWrapper(fmt.Sprint("Empty line detected at line: ", lineno+1, ". Skipping."))
-			continue
-		}
-		if lineStr[0] != 13 {
-			if commentLine.Match(lineStr) {
-				// This is a comment line, skipping it
-				continue
-			} else {
-				lineStr = comment.ReplaceAll(lineStr, []byte(""))
-				lineStr = whitespace.ReplaceAll(lineStr, []byte(""))
-				if colon.Match(lineStr) {
-					colonMatches := colon.FindAllIndex(lineStr, -1)
-					if len(colonMatches) > 1 {
-						log.Fatalln("Syntax error. Multiple labels detected in line:", lineno+1, ".")
-					} else {
-						labeledItem := bytes.Split(lineStr, []byte(":"))
-						if len(labeledItem[0]) >= 1 && len(labeledItem[0]) <= 7 && label.Match(labeledItem[0]) {
-							fmt.Println("   Label detected:", string(labeledItem[0]), "in line:", lineno+1, ".")
-						} else {
-							if len(labeledItem[0]) == 0 {
-								log.Fatalln("Syntax error. Empty label detected in line:", lineno+1, ".")
-							} else {
-								log.Fatalln("Syntax error. Invalid label detected: \"", string(labeledItem[0]), "\" in line:", lineno+1, ".")
-							}
-						}
-						lineStr = labeledItem[1]
-					}
-				}
-				instrItems := bytes.Split(lineStr, []byte(";"))
-				//fmt.Println("Line:", lineno+1, "Instruction items:", instrItems)
-				//fmt.Println("Instruction items:", instrItems)
-				prevInstrNum := 0
-				for instrNum, instr := range instrItems {
-					prevInstrNum = instrNum
-					if instrNum <= 2 {
-						if len(instr) > 0 {
-							//fmt.Println("Line:", lineno+1, "Channel:", colChannel(instrNum), "Instruction:", string(instr))
-							token, err = tokenize(instr)
-							if err != nil {
-								switch err {
-								case unknownOp:
-									logWrapper(fmt.Sprint("Unknown instruction \"", string(instr), "\" in line: ", lineno+1, ", position: ", colChannel(instrNum), ". Replacing with nop."))
-								case pushOpWOArg:
-									logWrapper(fmt.Sprint("Push operation without argument in line: ", lineno+1, ", position: ", colChannel(instrNum), ". Using zero as a value."))
-								case pushOpArgOutOfRange:
-									logWrapper(fmt.Sprint("Push operation argument is out of range in line: ", lineno+1, ", position: ", colChannel(instrNum), ". Using zero as a value."))
-								case pushOpArgInvalid:
-									logWrapper(fmt.Sprint("Push operation argument is invalid in line: ", lineno+1, ", position: ", colChannel(instrNum), ". Using zero as a value."))
-								}
-							}
-						} else {
-							logWrapper(fmt.Sprint("Empty instruction in line: ", lineno+1, ", position: ", colChannel(instrNum), ". Using nop."))
-							token, _ = tokenize([]byte("nop"))
-						}
-						switch instrNum {
-						case 0:
-							program.r[progline] = token
-						case 1:
-							program.g[progline] = token
-						case 2:
-							program.b[progline] = token
-						}
-					} else {
-						if len(instr) > 0 {
-							// This is an extra instruction, we will skip it
-							logWrapper(fmt.Sprint("Dropped extra text \"", string(instr), "\" in line: ", lineno+1, "."))
-						}
-					}
-				}
-				// If we have only one or two instructions, we need to fill the other channels with nop
-				switch prevInstrNum {
-				case 0:
-					logWrapper(fmt.Sprint("Missing instruction in line: ", lineno+1, ", position: ", colChannel(prevInstrNum+1), ". Using nop."))
-					program.g[progline], _ = tokenize([]byte("nop"))
-					logWrapper(fmt.Sprint("Missing instruction in line: ", lineno+1, ", position: ", colChannel(prevInstrNum+2), ". Using nop."))
-					program.b[progline], _ = tokenize([]byte("nop"))
-				case 1:
-					logWrapper(fmt.Sprint("Missing instruction in line: ", lineno+1, ", position: ", colChannel(prevInstrNum+1), ". Using nop."))
-					program.b[progline], _ = tokenize([]byte("nop"))
-				}
-				progline++
-			}
+		return c, err
+	}
+	opts.logMsg("Initializing program array")
+	// Initialize the program array with room for one cell per line
+	// Lines with pseudo-instructions or directives may need more cells, those are appended
+	c.program = progarray{r: make([]uint8, 0, len(lines)), g: make([]uint8, 0, len(lines)), b: make([]uint8, 0, len(lines))}
+	opts.logMsg(fmt.Sprint("Program array initialized with room for ", len(lines), " instructions."))
+	statements = c.optimize(statements)
+	fixups := c.place(statements)
+	if err := c.resolve(fixups); err != nil {
+		return c, err
+	}
+	if err := c.checkFaults(); err != nil {
+		return c, err
+	}
+	c.checkContracts()
+	return c, c.encode()
+}
+
+// layout returns the size of the grid in cells for the given number of cells, filled row by row
+func layout(cells int) (int, int) {
+	var maxX, maxY int
+
+	switch cells {
+	case 3:
+		maxX = 1
+		maxY = 3
+	case 4:
+		maxX = 2
+		maxY = 2
+	default:
+		maxX = int(math.Floor(math.Sqrt(float64(cells))))
+		maxX2 := maxX * maxX
+		maxY = 0
+		if maxX2 == cells {
+			maxY = maxX
 		} else {
-			// This is an empty line, skipping it
-			logWrapper(fmt.Sprint("Empty line detected at line: ", lineno+1, ". Skipping."))
-		}
-	}
-	logWrapper(fmt.Sprint("Program array filled with ", progline, " instructions."))
-	if !dryrun {
-		switch progline {
-		case 1:
-			maxX = 1
-			maxY = 3
-		case 2:
-			maxX = 2
-			maxY = 2
-		default:
-			maxX = int(math.Floor(math.Sqrt(float64(progline + 2))))
-			maxX2 := maxX * maxX
-			maxY = 0
-			if maxX2 == progline {
-				maxY = maxX
+			maxY = int(math.Ceil(float64(cells) / float64(maxX)))
+		}
+	}
+	return maxX, maxY
+}
+
+// cellColors returns the colors of the cells in order: the version number, the total size, the program
+// instructions and the extension cells
+func (c compiled) cellColors(cellsize int) []color.RGBA {
+	colors := make([]color.RGBA, 0, c.progline+2+len(c.extensions))
+	colors = append(colors, color.RGBA{R: uint8(VMAJOR), G: uint8(c.minor), B: headerCellsize(cellsize), A: 255})
+	colors = append(colors, color.RGBA{R: uint8((c.progline >> 16) % 256), G: uint8((c.progline >> 8) % 256), B: uint8(c.progline % 256), A: 255})
+	for k := 0; k < c.progline; k++ {
+		colors = append(colors, color.RGBA{R: c.program.r[k], G: c.program.g[k], B: c.program.b[k], A: 255})
+	}
+	// The extension cells follow the program, the empty cells after them are transparent black (kind 0)
+	for _, ext := range c.extensions {
+		colors = append(colors, color.RGBA{R: ext[0], G: ext[1], B: ext[2], A: 255})
+	}
+	return colors
+}
+
+// render draws the compiled program as an image, a grid of cells with the metainfo cells first
+func render(c compiled, cellsize int) *image.RGBA {
+	colors := c.cellColors(cellsize)
+	maxX, maxY := layout(len(colors))
+	c.opts.logMsg(fmt.Sprint("X size: ", maxX, ", Y size: ", maxY))
+	imageRectangle := image.Rect(0, 0, maxX*cellsize, maxY*cellsize)
+	imagePix := image.NewRGBA(imageRectangle)
+	// A cell is cellsize copies of the same pixel row, so the row is built once per cell in a reused buffer
+	// and copied straight into the pixel slice, which is much faster than setting every pixel
+	row := make([]uint8, cellsize*4)
+	grid := c.opts.gridded(cellsize)
+	border := gridRow(c.opts.grid, cellsize)
+	patterned := c.opts.patterned(cellsize)
+	paint := newPainter(c, colors, maxX, maxY, cellsize)
+	for k, cellColor := range colors {
+		row[0], row[1], row[2], row[3] = cellColor.R, cellColor.G, cellColor.B, cellColor.A
+		for filled := 4; filled < len(row); filled *= 2 {
+			copy(row[filled:], row[:filled])
+		}
+		if grid {
+			copy(row[len(row)-4:], border)
+		}
+		xCoord, yCoord := k%maxX, k/maxX
+		for j := 0; j < cellsize; j++ {
+			offset := imagePix.PixOffset(xCoord*cellsize, yCoord*cellsize+j)
+			if grid && j == cellsize-1 {
+				copy(imagePix.Pix[offset:offset+len(row)], border)
 			} else {
-				maxY = int(math.Ceil(float64(progline+2) / float64(maxX)))
+				copy(imagePix.Pix[offset:offset+len(row)], row)
 			}
 		}
-		logWrapper(fmt.Sprint("X size: ", maxX, ", Y size: ", maxY))
-		imageRectangle := image.Rect(0, 0, maxX*cellsize, maxY*cellsize)
-		imagePix := image.NewRGBA(imageRectangle)
-		// Inserting the version number in the first cell
-		xCoord, yCoord := 0, 0
-		for i := 0; i < cellsize; i++ {
+		if paint != nil {
 			for j := 0; j < cellsize; j++ {
-				imagePix.Set(xCoord+i, yCoord+j, color.RGBA{R: uint8(VMAJOR), G: uint8(VMINOR), B: uint8(cellsize), A: 255})
+				for i := 0; i < cellsize; i++ {
+					if grid && (i == cellsize-1 || j == cellsize-1) {
+						continue
+					}
+					if ink, ok := paint.ink(k, i, j); ok {
+						imagePix.SetRGBA(xCoord*cellsize+i, yCoord*cellsize+j, ink)
+					}
+				}
 			}
 		}
-		xCoord++
-		if xCoord >= maxX {
-			xCoord = 0
-			yCoord++
-		}
-		// Inserting the total size in the second cell
-		for i := 0; i < cellsize; i++ {
+		if patterned && k >= 2 && k < c.progline+2 {
 			for j := 0; j < cellsize; j++ {
-				imagePix.Set(xCoord*cellsize+i, yCoord*cellsize+j, color.RGBA{R: uint8((progline >> 16) % 256), G: uint8((progline >> 8) % 256), B: uint8(progline % 256), A: 255})
+				for i := 0; i < cellsize; i++ {
+					if ink, ok := patternInk(c.opts.palette, cellColor, i, j, cellsize); ok {
+						imagePix.SetRGBA(xCoord*cellsize+i, yCoord*cellsize+j, ink)
+					}
+				}
 			}
 		}
-		xCoord++
-		if xCoord >= maxX {
-			xCoord = 0
-			yCoord++
-		}
-		// Now we can fill the rest of the cells with the program instructions
-		for k := 0; k < progline; k++ {
+	}
+	for k := len(colors); paint != nil && k < maxX*maxY; k++ {
+		xCoord, yCoord := k%maxX, k/maxX
+		for j := 0; j < cellsize; j++ {
 			for i := 0; i < cellsize; i++ {
-				for j := 0; j < cellsize; j++ {
-					imagePix.Set(xCoord*cellsize+i, yCoord*cellsize+j, color.RGBA{R: program.r[k], G: program.g[k], B: program.b[k], A: 255})
+				if ink, ok := paint.ink(k, i, j); ok {
+					imagePix.SetRGBA(xCoord*cellsize+i, yCoord*cellsize+j, ink)
 				}
 			}
-			xCoord++
-			if xCoord >= maxX {
-				xCoord = 0
-				yCoord++
-			}
 		}
-		// Creating the output file
-		logWrapper(fmt.Sprint("Creating img file: ", outputfile))
-		f, err := os.Create(outputfile)
-		if err == nil {
-			if err := png.Encode(f, imagePix); err != nil {
-				f.Close()
-				log.Fatalln("Fatal encode error:", "\"", err, "\"")
-			}
-			if err := f.Close(); err != nil {
-				log.Fatalln("Fatal close error:", "\"", err, "\"")
-			}
-		} else {
-			log.Fatalln("Fatal create error:", "\"", err, "\"")
+	}
+	return imagePix
+}
+
+// The output formats, by file extension
+var outputFormats = []string{"png", "svg", "pdf", "plko"}
+
+// writeImage encodes the image of the compiled program with opts.cellsize into the output file
+func writeImage(c compiled, outputfile string, opts options) error {
+	if strings.EqualFold(filepath.Ext(outputfile), objectExt) {
+		return writeObject(c, outputfile, opts)
+	}
+	// The chunks describe the program, the cells may be packed
+	cells := c.written(opts)
+	if opts.grid.A != 0 && !opts.gridded(opts.cellsize) {
+		opts.logMsg(fmt.Sprint("Cell size ", opts.cellsize, " is too small for grid lines, leaving them out."))
+	}
+	if len(opts.palette) > 0 && !opts.patterned(opts.cellsize) {
+		opts.logMsg(fmt.Sprint("Cell size ", opts.cellsize, " is too small for opcode patterns, leaving them out."))
+	}
+	var encode func(w io.Writer) error
+	switch format := strings.ToLower(filepath.Ext(outputfile)); {
+	case format == ".svg":
+		encode = func(w io.Writer) error {
+			return writeSVG(w, cells, opts)
+		}
+	case format == ".pdf":
+		encode = func(w io.Writer) error {
+			return writePDF(w, cells, opts)
+		}
+	case streamed(cells, opts.cellsize):
+		// Huge images are not drawn in memory, but encoded row by row
+		opts.logMsg("Image is too large to draw in memory, streaming it.")
+		streamedPix := newCellImage(cells, opts.cellsize)
+		if opts.progress {
+			streamedPix.progress = newProgress("Encoding rows", streamedPix.Bounds().Dy())
+			defer streamedPix.progress.finish()
+		}
+		encode = func(w io.Writer) error {
+			return encodePNG(w, streamedPix, c)
+		}
+	default:
+		imagePix := render(cells, opts.cellsize)
+		if opts.patch {
+			patchImage(imagePix, cells, outputfile, opts)
+		}
+		encode = func(w io.Writer) error {
+			return encodePNG(w, imagePix, c)
+		}
+	}
+	// Creating the output file
+	opts.logMsg(fmt.Sprint("Creating img file: ", outputfile))
+	f, err := os.Create(outputfile)
+	if err == nil {
+		if err := encode(f); err != nil {
+			f.Close()
+			return ioError(fmt.Sprint("Fatal encode error: \"", err, "\""))
+		}
+		if err := f.Close(); err != nil {
+			return ioError(fmt.Sprint("Fatal close error: \"", err, "\""))
 		}
-		// If we have a bytearray flag, we will print the program array in a text format
-		if bytearray {
-			for i := 0; i < progline; i++ {
-				fmt.Println("Line:", i+1, "R:", program.r[i], "G:", program.g[i], "B:", program.b[i])
+	} else {
+		return ioError(fmt.Sprint("Fatal create error: \"", err, "\""))
+	}
+	return nil
+}
+
+// compileFile compiles a .plk file into an image file, unless it is a dry run
+// The errors carry the same messages the command line used to exit with
+func compileFile(filename string, outputfile string, opts options, dryrun bool, bytearray bool) (compiled, error) {
+	opts.logMsg(fmt.Sprint("Reading file: ", filename))
+	file, err := os.ReadFile(filename)
+	if err != nil {
+		return compiled{}, ioError(fmt.Sprint("Fatal error: \"", err, "\""))
+	}
+	opts.sourceName = filename
+	if strings.EqualFold(filepath.Ext(outputfile), objectExt) {
+		// Objects are placed by the linker, their addresses may change
+		opts.reloc = true
+	}
+
+	c, err := compile(file, opts)
+	if err != nil || dryrun {
+		return c, err
+	}
+	// A pragma may have changed the cell size
+	opts.cellsize = c.opts.cellsize
+	if err := writeImage(c, outputfile, opts); err != nil {
+		return c, err
+	}
+	if opts.teach {
+		if err := writeTeaching(c, outputfile); err != nil {
+			return c, err
+		}
+	}
+	// If we have a bytearray flag, we will print the program array in a text format
+	if bytearray {
+		for i := 0; i < c.progline; i++ {
+			fmt.Fprintln(opts.output(), "Line:", i+1, "R:", c.program.r[i], "G:", c.program.g[i], "B:", c.program.b[i])
+		}
+		for _, ext := range c.extensions {
+			fmt.Fprintln(opts.output(), "Extension kind:", ext[0], "High:", ext[1], "Low:", ext[2])
+		}
+		for _, name := range c.exports {
+			fmt.Fprintln(opts.output(), "Export:", name, "Address:", c.labels[name])
+		}
+	}
+	return c, nil
+}
+
+// registerMain registers the flags of the default command, which compiles a file or a pattern
+func registerMain(flags *flag.FlagSet, filename *string, outputfile *string, showVersion *bool, bf *buildFlags) {
+	flags.StringVar(filename, "f", "", "Path to the file or a pattern of files (progs/*.plk, examples/...), mandatory")
+	flags.BoolVar(showVersion, "version", false, "Print the version, the supported formats and the fingerprint of the instruction set, default is false")
+	flags.StringVar(outputfile, "o", "", "Output file name, default is same as input file")
+	bf.register(flags)
+}
+
+func main() {
+	var filename string
+	var outputfile string
+	var showVersion bool
+	var bf buildFlags
+
+	// Subcommands come before the flags
+	if len(os.Args) > 1 {
+		for _, cmd := range subcommands() {
+			if os.Args[1] == cmd.name {
+				os.Exit(cmd.run(os.Args[2:]))
 			}
 		}
 	}
+
+	// Parsing command line flags
+	registerMain(flag.CommandLine, &filename, &outputfile, &showVersion, &bf)
+	flag.Parse()
+	if showVersion {
+		fmt.Print(versionText())
+		return
+	}
+	if err := applyEnv(flag.CommandLine); err != nil {
+		fatal(err)
+	}
+
+	logWrapper("Pollock started")
+	logWrapper("Flags parsed")
+	logWrapper(fmt.Sprint(" Version: ", VMAJOR, ".", VMINOR))
+	logWrapper(fmt.Sprint(" Filename: ", filename))
+	logWrapper(fmt.Sprint(" Cell size: ", bf.cellsize))
+	logWrapper(fmt.Sprint(" Dry run: ", bf.dryrun))
+	logWrapper(fmt.Sprint(" Silent: ", silent))
+	logWrapper(fmt.Sprint(" Byte array: ", bf.bytearray))
+	logWrapper(fmt.Sprint(" Output file: ", outputfile))
+	logWrapper(fmt.Sprint(" Output directory: ", bf.outdir))
+	logWrapper(fmt.Sprint(" Target: ", bf.target))
+	logWrapper(fmt.Sprint(" Word size: ", bf.wordsize))
+	logWrapper(fmt.Sprint(" Progress: ", bf.progress))
+	logWrapper(fmt.Sprint(" Warnings as errors: ", bf.werror))
+	logWrapper(fmt.Sprint(" Symbols: ", bf.symbols))
+	logWrapper(fmt.Sprint(" Relocations: ", bf.reloc))
+	logWrapper(fmt.Sprint(" Include directories: ", bf.includes.String()))
+	logWrapper(fmt.Sprint(" Remote include cache: ", bf.cache))
+	logWrapper(fmt.Sprint(" Offline: ", bf.offline))
+	logWrapper(fmt.Sprint(" Signing key: ", bf.sign))
+	logWrapper(fmt.Sprint(" Shuffled: ", len(bf.shuffle) > 0))
+	logWrapper(fmt.Sprint(" Run-length encoding: ", bf.rle))
+	logWrapper(fmt.Sprint(" Orientation cell: ", bf.orient))
+	logWrapper(fmt.Sprint(" Optimize: ", bf.optimize))
+	logWrapper(fmt.Sprint(" Release: ", bf.release))
+	logWrapper(fmt.Sprint(" Statistics: ", bf.stats))
+	logWrapper(fmt.Sprint(" Jitter: ", bf.jitter))
+	logWrapper(fmt.Sprint(" Background: ", bf.background))
+	logWrapper(fmt.Sprint(" Filler: ", bf.filler))
+	logWrapper(fmt.Sprint(" Patch: ", bf.patch))
+	logWrapper(fmt.Sprint(" SARIF log: ", bf.sarif))
+	logWrapper(fmt.Sprint(" Language: ", bf.lang))
+
+	// Filename must exist, must have a .plk extension, cellsize must be between 2 and 50, outputfile is optional
+	if len(filename) == 0 {
+		fatal(usageError("Fatal error: Filename is required."))
+	}
+	opts, err := newOptions(bf.cellsize, bf.target, bf.wordsize)
+	if err != nil {
+		fatal(usageError(fmt.Sprint("Fatal error: ", err)))
+	}
+	if err := bf.apply(&opts); err != nil {
+		fatal(err)
+	}
+	if isPattern(filename) {
+		// Batch mode, every file gets its default output name
+		if len(outputfile) != 0 {
+			fatal(usageError("Fatal error: Output file can't be used with a pattern."))
+		}
+		os.Exit(buildPatterns([]string{filename}, opts, bf))
+	}
+	if !strings.HasSuffix(filename, ".plk") {
+		fatal(usageError("Fatal error: File must have a .plk extension."))
+	}
+	if len(bf.inline) > 0 && !slices.Contains(inlineProtocols, bf.inline) {
+		fatal(usageError(fmt.Sprint("Fatal error: Unknown graphics protocol \"", bf.inline, "\", must be auto, sixel, iterm or kitty.")))
+	}
+	if len(outputfile) == 0 {
+		outputfile = bf.outputName(filename)
+		logWrapper(fmt.Sprint("Output file not specified, using default: ", outputfile))
+		if err := bf.makeOutdir(); err != nil {
+			fatal(err)
+		}
+	}
+	// A batch shows the files done instead
+	opts.progress = bf.progress
+	opts.color = colorEnabled(os.Stderr)
+	c, err := compileFile(filename, outputfile, opts, bf.dryrun, bf.bytearray)
+	if len(bf.sarif) > 0 {
+		if err := writeSarif(bf.sarif, []string{filename}, [][]diagnostic{fileDiagnostics(c, err)}); err != nil {
+			fatal(err)
+		}
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if bf.preview {
+		preview(os.Stdout, c.written(opts), trueColor())
+	}
+	if len(bf.inline) > 0 {
+		if err := inlineImage(os.Stdout, c.written(opts), bf.inline); err != nil {
+			fatal(ioError(fmt.Sprint("Fatal error: \"", err, "\"")))
+		}
+	}
 }
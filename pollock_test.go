@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testCompile compiles the source in silent mode with the default options, changed by edit unless it is nil
+func testCompile(t testing.TB, source string, edit func(opts *options)) (compiled, error) {
+	t.Helper()
+	silent = true
+	opts, err := newOptions(10, "1.0", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.nowarn = make(map[string]bool)
+	if edit != nil {
+		edit(&opts)
+	}
+	return compile([]byte(source), opts)
+}
+
+// testDecode encodes the image of a compiled program and decodes it again
+func testDecode(t *testing.T, c compiled) compiled {
+	t.Helper()
+	var img bytes.Buffer
+	if err := encodePNG(&img, render(c.written(c.opts), c.opts.cellsize), c); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeImage(img.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+// testValue returns the value the expanded push instructions leave on the stack with the word size
+func testValue(t *testing.T, instrs [][]byte, wordsize int) int64 {
+	t.Helper()
+	var stack []int64
+	for _, instr := range instrs {
+		name := string(instr)
+		if value, ok := strings.CutPrefix(name, "push"); ok {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 || n > 0b0111_1111 {
+				t.Fatalf("%q is not a push literal", name)
+			}
+			stack = append(stack, n)
+			continue
+		}
+		top := len(stack) - 1
+		switch name {
+		case "neg":
+			stack[top] = -stack[top]
+		case "shl":
+			stack = append(stack[:top-1], stack[top-1]<<stack[top])
+		case "or":
+			stack = append(stack[:top-1], stack[top-1]|stack[top])
+		default:
+			t.Fatalf("unexpected instruction %q", name)
+		}
+		// Wrap around like a word of the VM
+		top = len(stack) - 1
+		stack[top] = stack[top] << (64 - wordsize) >> (64 - wordsize)
+	}
+	if len(stack) != 1 {
+		t.Fatalf("%q leaves %d values", instrs, len(stack))
+	}
+	return stack[0]
+}
+
+func TestNegativePush(t *testing.T) {
+	for _, value := range []int64{-1, -5, -64, -65, -127, -128} {
+		for _, wordsize := range []int{8, 16, 32} {
+			instrs, err := expand([]byte(fmt.Sprint("push", value)), 0, wordsize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := testValue(t, instrs, wordsize); got != value {
+				t.Errorf("push %d with word size %d expands into %q, which pushes %d", value, wordsize, instrs, got)
+			}
+		}
+	}
+}
+
+// BenchmarkRender draws a program of 10,000 cells, which render fills with row copies
+func BenchmarkRender(b *testing.B) {
+	c, err := testCompile(b, generate(1, 10000, "1.0"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	written := c.written(c.opts)
+	for _, cellsize := range []int{10, 40} {
+		b.Run(fmt.Sprint("cellsize ", cellsize), func(b *testing.B) {
+			for b.Loop() {
+				render(written, cellsize)
+			}
+		})
+	}
+}
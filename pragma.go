@@ -0,0 +1,94 @@
+package main
+
+// Pragma comments
+//
+// A comment line starting with #pragma tunes the compilation of its file, without changing the build command:
+//   #pragma warning(disable: extra-text, unknown-op)   disables the warnings from the next line on
+//   #pragma warning(enable: extra-text)                enables them again
+//   #pragma cellsize 4, #pragma target 1.1 and #pragma wordsize 16 override the -c, -t and -wordsize flags
+// The option pragmas must come before the first instruction. Unknown or invalid pragmas are ignored with a
+// pragma-unknown or pragma-invalid warning.
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// isPragma tells if the comment line is a pragma
+func isPragma(line []byte) bool {
+	fields := bytes.Fields(line)
+	return len(fields) > 0 && string(fields[0]) == "#pragma"
+}
+
+// pragma applies the pragma of the line to the options of the compilation, lineno is 0 based
+// started tells if program cells come before the line
+func (c *compiled) pragma(lineno int, line []byte, started bool) {
+	body := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(string(line)), "#pragma"))
+	if inner, ok := strings.CutPrefix(body, "warning("); ok && strings.HasSuffix(inner, ")") {
+		c.warningPragma(lineno, strings.TrimSuffix(inner, ")"))
+		return
+	}
+	fields := strings.Fields(body)
+	if len(fields) == 0 || (fields[0] != "cellsize" && fields[0] != "target" && fields[0] != "wordsize") {
+		c.warn(lineno, "", wholeLine, "pragma-unknown", c.opts.message("pragma-unknown", body, lineno+1))
+		return
+	}
+	if len(fields) != 2 {
+		c.warn(lineno, "", wholeLine, "pragma-invalid", c.opts.message("pragma-value-count", fields[0], lineno+1))
+		return
+	}
+	if started {
+		c.warn(lineno, "", wholeLine, "pragma-invalid", c.opts.message("pragma-late", fields[0], lineno+1))
+		return
+	}
+	cellsize, target, wordsize := c.opts.cellsize, fmt.Sprint(VMAJOR, ".", c.opts.targetMinor), c.opts.wordsize
+	var err error
+	switch fields[0] {
+	case "cellsize":
+		cellsize, err = strconv.Atoi(fields[1])
+	case "target":
+		target = fields[1]
+	case "wordsize":
+		wordsize, err = strconv.Atoi(fields[1])
+	}
+	if err == nil {
+		var checked options
+		if checked, err = newOptions(cellsize, target, wordsize); err == nil {
+			c.opts.cellsize, c.opts.targetMinor, c.opts.wordsize = checked.cellsize, checked.targetMinor, checked.wordsize
+			c.minor = checked.targetMinor
+			c.opts.logMsg(fmt.Sprint("Pragma ", fields[0], " ", fields[1], " in line: ", lineno+1, "."))
+			return
+		}
+	}
+	c.warn(lineno, "", wholeLine, "pragma-invalid", c.opts.message("pragma-value", fields[1], fields[0], lineno+1))
+}
+
+// warningPragma disables or enables the warnings listed in the pragma
+func (c *compiled) warningPragma(lineno int, inner string) {
+	action, list, ok := strings.Cut(inner, ":")
+	action = strings.TrimSpace(action)
+	if !ok || (action != "disable" && action != "enable") {
+		c.warn(lineno, "", wholeLine, "pragma-invalid", c.opts.message("pragma-warning", lineno+1))
+		return
+	}
+	// The map may be shared with the other files of a batch, so it is copied before the change
+	nowarn := make(map[string]bool)
+	for code, disabled := range c.opts.nowarn {
+		nowarn[code] = disabled
+	}
+	for _, code := range strings.Split(list, ",") {
+		code = strings.TrimSpace(code)
+		known := false
+		for _, w := range warningCodes {
+			known = known || w.code == code
+		}
+		if !known {
+			c.warn(lineno, "", wholeLine, "pragma-invalid", c.opts.message("pragma-warning-code", code, lineno+1))
+			continue
+		}
+		nowarn[code] = action == "disable"
+	}
+	c.opts.nowarn = nowarn
+}
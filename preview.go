@@ -0,0 +1,56 @@
+package main
+
+// Terminal preview
+//
+// -preview prints the cell grid of the image on stdout, every cell as two spaces with the cell color as background,
+// so the output can be checked over SSH without opening the PNG. Terminals announcing 24-bit colors in COLORTERM
+// (truecolor or 24bit) get the exact colors, the others the nearest color of the 256-color palette.
+// Large grids are cut at previewMax cells in both directions.
+
+import (
+	"fmt"
+	"image/color"
+	"io"
+	"os"
+)
+
+// Most cells of a preview row and column
+const previewMax = 128
+
+// trueColor tells if the terminal shows 24-bit colors
+func trueColor() bool {
+	colorterm := os.Getenv("COLORTERM")
+	return colorterm == "truecolor" || colorterm == "24bit"
+}
+
+// ansi256 returns the nearest color of the 6x6x6 cube of the 256-color palette
+func ansi256(c color.RGBA) int {
+	level := func(v uint8) int {
+		return (int(v)*5 + 127) / 255
+	}
+	return 16 + 36*level(c.R) + 6*level(c.G) + level(c.B)
+}
+
+// preview prints the cells of the image as colored blocks
+func preview(w io.Writer, c compiled, truecolor bool) {
+	colors := c.cellColors(c.opts.cellsize)
+	maxX, maxY := layout(len(colors))
+	for y := 0; y < min(maxY, previewMax); y++ {
+		for x := 0; x < min(maxX, previewMax); x++ {
+			k := y*maxX + x
+			switch {
+			case k >= len(colors):
+				// Empty cells at the end of the grid
+				fmt.Fprint(w, colorReset, "  ")
+			case truecolor:
+				fmt.Fprintf(w, "\x1b[48;2;%d;%d;%dm  ", colors[k].R, colors[k].G, colors[k].B)
+			default:
+				fmt.Fprintf(w, "\x1b[48;5;%dm  ", ansi256(colors[k]))
+			}
+		}
+		fmt.Fprintln(w, colorReset)
+	}
+	if maxX > previewMax || maxY > previewMax {
+		fmt.Fprintln(w, "Preview cut at", previewMax, "x", previewMax, "of", maxX, "x", maxY, "cells.")
+	}
+}
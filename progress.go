@@ -0,0 +1,68 @@
+package main
+
+// Progress reporting for long compiles, enabled with -progress
+//
+// The status line is written to stderr, so it does not mix with the byte array output on stdout, and it is
+// rewritten in place at most a few times per second. It works best together with -s.
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Shortest time between two status lines
+const progressInterval = 200 * time.Millisecond
+
+// progress is the status line of one long task, the methods do nothing on a nil progress
+type progress struct {
+	mu    sync.Mutex
+	label string
+	total int
+	done  int
+	start time.Time
+	last  time.Time
+}
+
+func newProgress(label string, total int) *progress {
+	return &progress{label: label, total: total, start: time.Now()}
+}
+
+// add counts finished items and prints the status line if it is due
+func (p *progress) add(items int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += items
+	if time.Since(p.last) >= progressInterval || p.done == p.total {
+		p.last = time.Now()
+		p.print()
+	}
+}
+
+// finish prints the final status line and ends it
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.print()
+	fmt.Fprintln(os.Stderr)
+}
+
+func (p *progress) print() {
+	elapsed := time.Since(p.start)
+	percent := 100
+	eta := time.Duration(0)
+	if p.total > 0 {
+		percent = p.done * 100 / p.total
+	}
+	if p.done > 0 && p.done < p.total {
+		eta = elapsed / time.Duration(p.done) * time.Duration(p.total-p.done)
+	}
+	fmt.Fprintf(os.Stderr, "\r%s: %d/%d (%d%%), elapsed %s, ETA %s   ", p.label, p.done, p.total, percent, elapsed.Round(time.Second), eta.Round(time.Second))
+}
@@ -0,0 +1,201 @@
+package main
+
+// Remote includes
+//
+// An include of a path which starts with a host name and ends with a version, #include "github.com/user/lib/math.plk@v1",
+// is fetched from the git repository https://github.com/user/lib at the tag or branch v1, and an include of an https
+// URL is downloaded as is. The fetched files are kept in the cache directory, -cache or pollock in the user cache
+// directory, so the later compilations don't fetch them again, and the files they include with relative paths come
+// from the same repository. The sha256 sums of the remote files are kept in pollock.sum, in the directory of the
+// pollock.toml above the including source or else next to it, which should be committed with the project: a file
+// whose sum is not the one recorded is an error, so a moved tag or a changed URL can't change it unnoticed.
+// With -offline nothing is fetched, the remote files must be in the cache already.
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File name of the sums of the remote includes
+const sumName = "pollock.sum"
+
+// Longest wait for a download
+const fetchTimeout = 30 * time.Second
+
+// remoteMu serializes the fetches and the updates of pollock.sum of the parallel builds
+var remoteMu sync.Mutex
+
+// isRemote tells if the include is a URL or a versioned repository path
+func isRemote(name string) bool {
+	if strings.HasPrefix(name, "https://") {
+		return true
+	}
+	host, _, _ := strings.Cut(name, "/")
+	return strings.Contains(host, ".") && strings.Contains(name, "@") && !filepath.IsAbs(name)
+}
+
+// remoteCache returns the cache directory of the remote includes
+func remoteCache(opts options) (string, error) {
+	if len(opts.cacheDir) > 0 {
+		return opts.cacheDir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "pollock"), nil
+}
+
+// fetchURL downloads the URL into the cache unless it is there, and returns the path of the file
+func fetchURL(url string, cache string, opts options) (string, error) {
+	sum := sha256.Sum256([]byte(url))
+	path := filepath.Join(cache, "url", hex.EncodeToString(sum[:8])+"-"+filepath.Base(url))
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if opts.offline {
+		return "", errors.New("not in the cache and fetching is disabled by -offline")
+	}
+	opts.logMsg(fmt.Sprint("Downloading ", url))
+	client := http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(fmt.Sprint("download failed: ", resp.Status))
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0o755)
+	}
+	if err == nil {
+		// Written under another name first, so an interrupted download isn't taken for the file
+		err = os.WriteFile(path+".tmp", data, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	return path, err
+}
+
+// fetchRepository clones the repository at the version into the cache unless it is there, and returns the path of
+// the file in it
+func fetchRepository(name string, cache string, opts options) (string, error) {
+	at := strings.LastIndex(name, "@")
+	path, version := name[:at], name[at+1:]
+	parts := strings.Split(path, "/")
+	if len(parts) < 4 || len(version) == 0 || strings.HasPrefix(version, "-") || strings.Contains(version, "..") {
+		return "", errors.New("must be host/user/repository/file.plk@version")
+	}
+	repository := strings.Join(parts[:3], "/")
+	dir := filepath.Join(cache, filepath.FromSlash(repository)+"@"+version)
+	if _, err := os.Stat(dir); err != nil {
+		if opts.offline {
+			return "", errors.New("not in the cache and fetching is disabled by -offline")
+		}
+		opts.logMsg(fmt.Sprint("Fetching ", repository, " at ", version))
+		if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+			return "", err
+		}
+		// Cloned under another name first, so an interrupted clone isn't taken for the repository
+		tmp := dir + ".tmp"
+		os.RemoveAll(tmp)
+		out, err := exec.Command("git", "clone", "--quiet", "--depth", "1", "--branch", version, "https://"+repository, tmp).CombinedOutput()
+		if err != nil {
+			os.RemoveAll(tmp)
+			message, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+			return "", errors.New(fmt.Sprint("git clone failed: ", message))
+		}
+		if err := os.Rename(tmp, dir); err != nil {
+			return "", err
+		}
+	}
+	file := filepath.Join(dir, filepath.FromSlash(strings.Join(parts[3:], "/")))
+	if info, err := os.Stat(file); err != nil || info.IsDir() {
+		return "", errors.New(fmt.Sprint("no file ", strings.Join(parts[3:], "/"), " in ", repository, " at ", version))
+	}
+	return file, nil
+}
+
+// sumFile returns the pollock.sum of a source, in the project directory of its pollock.toml or next to it
+func sumFile(sourceName string) string {
+	start, err := filepath.Abs(filepath.Dir(sourceName))
+	if err != nil {
+		return filepath.Join(filepath.Dir(sourceName), sumName)
+	}
+	for dir := start; ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, manifestName)); err == nil {
+			return filepath.Join(dir, sumName)
+		}
+		if filepath.Dir(dir) == dir {
+			return filepath.Join(start, sumName)
+		}
+	}
+}
+
+// checkSum compares the sum of the fetched file with the one recorded in the sum file, or records it
+func checkSum(name string, path string, sums string, opts options) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	want := "sha256:" + hex.EncodeToString(sum[:])
+	if f, err := os.Open(sums); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 2 && fields[0] == name {
+				f.Close()
+				if fields[1] != want {
+					return errors.New(fmt.Sprint("checksum mismatch, ", sums, " has ", fields[1], ", the file has ", want))
+				}
+				return nil
+			}
+		}
+		f.Close()
+	}
+	f, err := os.OpenFile(sums, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, name, want)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	opts.logMsg(fmt.Sprint("Added the checksum of \"", name, "\" to ", sums))
+	return err
+}
+
+// fetchInclude returns the path of the cached copy of a remote include, fetching it if needed, and checks its sum
+func fetchInclude(name string, opts options) (string, error) {
+	remoteMu.Lock()
+	defer remoteMu.Unlock()
+	cache, err := remoteCache(opts)
+	if err != nil {
+		return "", err
+	}
+	var path string
+	if strings.HasPrefix(name, "https://") {
+		path, err = fetchURL(name, cache, opts)
+	} else {
+		path, err = fetchRepository(name, cache, opts)
+	}
+	if err != nil {
+		return "", err
+	}
+	return path, checkSum(name, path, sumFile(opts.sourceName), opts)
+}
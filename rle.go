@@ -0,0 +1,85 @@
+package main
+
+// Run-length encoded images (v1.1)
+//
+// With -rle, runs of 3 or more identical program cells, like the nop filler of .space and .align, are written as
+// the first cell followed by a repeat cell: [0xFF, count / 256, count % 256], which stands for count more copies of
+// the last program cell. Runs longer than 65536 cells take more repeat cells. 0xFF is never an instruction token
+// and push arguments stay below 0x80, so a repeat cell can't be mistaken for a program cell.
+// The second header cell holds the number of cells written, the decoder expands the runs before anything else, so
+// label addresses, the relocation table, the signature and the shuffle order all refer to the expanded program.
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Red channel of the repeat cells
+const repeatToken = 0xFF
+
+// Most copies a single repeat cell stands for
+const maxRepeat = 0xFFFF
+
+// packRuns returns the program with its runs replaced by repeat cells
+func (c compiled) packRuns() compiled {
+	packed := c
+	packed.program = progarray{}
+	for k := 0; k < c.progline; {
+		run := 1
+		for k+run < c.progline && c.program.r[k+run] == c.program.r[k] && c.program.g[k+run] == c.program.g[k] && c.program.b[k+run] == c.program.b[k] {
+			run++
+		}
+		packed.program.r = append(packed.program.r, c.program.r[k])
+		packed.program.g = append(packed.program.g, c.program.g[k])
+		packed.program.b = append(packed.program.b, c.program.b[k])
+		if run < 3 {
+			// A repeat cell would save nothing
+			k++
+			continue
+		}
+		for copies := run - 1; copies > 0; copies -= min(copies, maxRepeat) {
+			count := min(copies, maxRepeat)
+			packed.program.r = append(packed.program.r, repeatToken)
+			packed.program.g = append(packed.program.g, uint8(count>>8))
+			packed.program.b = append(packed.program.b, uint8(count))
+		}
+		k += run
+	}
+	packed.progline = len(packed.program.r)
+	c.opts.logMsg(fmt.Sprint("Packed ", c.progline, " program cells into ", packed.progline, "."))
+	return packed
+}
+
+// written returns the program as its cells are written into the image, packed with -rle, with the cell size and
+// features cells
+func (c compiled) written(opts options) compiled {
+	if opts.rle {
+		c = c.packRuns()
+	}
+	return c.withCellsize(opts.cellsize).withFeatures()
+}
+
+// expandRuns replaces the repeat cells of a decoded program with the copies they stand for
+func (p *progarray) expandRuns() error {
+	var expanded progarray
+	for k := range p.r {
+		if p.r[k] != repeatToken {
+			expanded.r = append(expanded.r, p.r[k])
+			expanded.g = append(expanded.g, p.g[k])
+			expanded.b = append(expanded.b, p.b[k])
+			continue
+		}
+		count := int(p.g[k])<<8 | int(p.b[k])
+		last := len(expanded.r) - 1
+		if last < 0 || count == 0 {
+			return errors.New(fmt.Sprint("invalid repeat cell ", k+2))
+		}
+		for i := 0; i < count; i++ {
+			expanded.r = append(expanded.r, expanded.r[last])
+			expanded.g = append(expanded.g, expanded.g[last])
+			expanded.b = append(expanded.b, expanded.b[last])
+		}
+	}
+	*p = expanded
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+// Round trips, with "pollock roundtrip [-gen N] files.plk..."
+//
+// A program must come through its image unchanged: it is compiled, encoded into a PNG image in memory, decoded,
+// disassembled into a listing and the listing is compiled again, and the tokens of the cells must be the same at
+// every step. pollock roundtrip checks the files, N random programs of pollock gen for both targets, and a table of
+// cases: a program for every instruction of the opcodes table, the grids of 1 and 2 program cells and the square
+// grids, wide words and run-length encoded cells. The listing has a line per cell with push N for the literals and
+// the resolved addresses, a fused jump joins the line of the cell before, which holds its push.
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// roundTripCase is a program of pollock roundtrip, with the options it is compiled with and its file, which
+// includes are found from
+type roundTripCase struct {
+	name     string
+	file     string
+	source   string
+	target   string
+	wordsize int
+	rle      bool
+}
+
+// Label of the entry cell in the listings
+const entryLabel = "ENTRY"
+
+// disassemble returns the listing of the program cells of a decoded image, which compiles into the same cells
+func disassemble(c compiled) []byte {
+	var listing bytes.Buffer
+	entry, hasEntry := c.extension(extEntry)
+	if hasEntry {
+		fmt.Fprintln(&listing, ".start", entryLabel)
+	}
+	var line []string
+	start := 0
+	for k := 0; k < c.progline; k++ {
+		if len(line) == 0 {
+			start = k
+		}
+		for channel := 0; channel < 3; channel++ {
+			token := c.program.at(k, channel)
+			name := mnemonic(token)
+			switch last := len(line) - 1; {
+			case token&0b1000_0000 == 0:
+				line = append(line, "push "+name)
+			case (name == "jeq" || name == "jlt" || name == "jgt") && last >= 0 && strings.HasPrefix(line[last], "push "):
+				// The fused jump expands into the push of its address and itself
+				line[last] = name + " " + strings.TrimPrefix(line[last], "push ")
+			default:
+				line = append(line, name)
+			}
+		}
+		if k+1 < c.progline {
+			if next := mnemonic(c.program.at(k+1, 0)); next == "jeq" || next == "jlt" || next == "jgt" {
+				continue
+			}
+		}
+		if hasEntry && entry == start+2 {
+			fmt.Fprint(&listing, entryLabel, ": ")
+		}
+		fmt.Fprintln(&listing, strings.Join(line, "; "))
+		line = nil
+	}
+	return listing.Bytes()
+}
+
+// firstDiff returns the cell where two token streams differ, -1 if they are the same
+func firstDiff(a []byte, b []byte) int {
+	for i := 0; i < min(len(a), len(b)); i++ {
+		if a[i] != b[i] {
+			return i / 3
+		}
+	}
+	if len(a) != len(b) {
+		return min(len(a), len(b)) / 3
+	}
+	return -1
+}
+
+// roundTrip compiles the source, encodes, decodes and disassembles its image and compiles the listing, it fails at
+// the first step which changes the cells
+func roundTrip(source []byte, opts options) error {
+	c, err := compile(source, opts)
+	if err != nil {
+		return errors.New(fmt.Sprint("source doesn't compile: ", err))
+	}
+	// A pragma may have changed the options
+	opts = c.opts
+	var img bytes.Buffer
+	if err := encodePNG(&img, render(c.written(opts), opts.cellsize), c); err != nil {
+		return err
+	}
+	decoded, err := decodeImage(img.Bytes())
+	if err != nil {
+		return errors.New(fmt.Sprint("image doesn't decode: ", err))
+	}
+	if cell := firstDiff(c.tokenStream(), decoded.tokenStream()); cell >= 0 {
+		return errors.New(fmt.Sprint("decoded image differs in cell ", cell))
+	}
+	listing := disassemble(decoded)
+	again, err := compile(listing, opts)
+	if err != nil {
+		return errors.New(fmt.Sprint("listing doesn't compile: ", err, "\n", string(listing)))
+	}
+	if cell := firstDiff(c.tokenStream(), again.tokenStream()); cell >= 0 {
+		return errors.New(fmt.Sprint("listing differs in cell ", cell, "\n", string(listing)))
+	}
+	return nil
+}
+
+// roundTripCases returns the table of programs of pollock roundtrip
+func roundTripCases() []roundTripCase {
+	var cases []roundTripCase
+	for _, op := range opcodes {
+		target := "1.0"
+		if tokenMinor(op.token) > 0 {
+			target = "1.1"
+		}
+		pops, _ := stackEffect(op.name)
+		instr := op.name
+		switch op.name {
+		case "jeq", "jlt", "jgt":
+			// The address is pushed by the jump
+			instr, pops = op.name+" END", pops-1
+		case "jmpz", "jmpnz":
+			instr, pops = "push END; "+op.name, pops-1
+		}
+		source := strings.Repeat("push 1; ", pops) + instr + "\nEND: halt\n"
+		cases = append(cases, roundTripCase{name: op.name, source: source, target: target, wordsize: 8})
+	}
+	jumps := "START: push 3\nLOOP: subi 1; dup; outi\ndup; push 0; jgt LOOP\npush 1; jeq START\nhalt\n"
+	// Squares of 3, 4 and 5 cells, with the header cells
+	for _, cells := range []int{1, 2, 7, 8, 14, 23} {
+		source := "halt\n"
+		if cells > 1 {
+			source = fmt.Sprint(".space ", cells-1, "\nhalt\n")
+		}
+		cases = append(cases, roundTripCase{name: fmt.Sprint(cells, " cells"), source: source, target: "1.0", wordsize: 8})
+	}
+	cases = append(cases,
+		roundTripCase{name: "jumps", source: jumps, target: "1.0", wordsize: 8},
+		roundTripCase{name: "fused jumps", source: jumps, target: "1.1", wordsize: 8},
+		roundTripCase{name: "entry", source: ".start MAIN\nhalt\nMAIN: push 'a'; outc; halt\n", target: "1.1", wordsize: 8},
+		roundTripCase{name: "wide words", source: "push 1000; push -70000; add\noutu; push 'é'; outu\nhalt\n", target: "1.1", wordsize: 32},
+		roundTripCase{name: "repeat cells", source: ".space 300\n.space 5, halt\nhalt\n", target: "1.1", wordsize: 8, rle: true},
+	)
+	return cases
+}
+
+// registerRoundtrip registers the flags of the roundtrip subcommand
+func registerRoundtrip(flags *flag.FlagSet, programs *int) {
+	flags.IntVar(programs, "gen", 20, "Number of random programs of pollock gen to check for each target, default is 20")
+	flags.BoolVar(&silent, "s", false, "Run in silent mode, default is false")
+}
+
+// roundtrip parses the flags of the roundtrip subcommand, checks the programs and returns the exit code
+func roundtrip(args []string) int {
+	var programs int
+
+	flags := flag.NewFlagSet("roundtrip", flag.ExitOnError)
+	registerRoundtrip(flags, &programs)
+	flags.Parse(args)
+	err := applyEnv(flags)
+	if err == nil && programs < 0 {
+		err = usageError("Fatal error: The number of random programs can't be negative.")
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+
+	cases := roundTripCases()
+	for _, target := range []string{"1.0", "1.1"} {
+		for seed := 1; seed <= programs; seed++ {
+			cells := 1 + seed*37%200
+			cases = append(cases, roundTripCase{name: fmt.Sprint("gen -seed ", seed, " -cells ", cells, " -t ", target), source: generate(uint64(seed), cells, target), target: target, wordsize: 8})
+		}
+	}
+	for _, name := range flags.Args() {
+		source, err := os.ReadFile(name)
+		if err != nil {
+			err = ioError(fmt.Sprint("Fatal error: \"", err, "\""))
+			log.Println(err)
+			return exitCode(err)
+		}
+		cases = append(cases, roundTripCase{name: name, file: name, source: string(source), target: "1.0", wordsize: 8})
+	}
+
+	failed := 0
+	for _, rt := range cases {
+		opts, err := newOptions(10, rt.target, rt.wordsize)
+		if err == nil {
+			opts.rle, opts.sourceName = rt.rle, rt.file
+			opts.logger = log.New(io.Discard, "", 0)
+			err = roundTrip([]byte(rt.source), opts)
+		}
+		if err != nil {
+			failed++
+			fmt.Println("FAIL", rt.name+":", err)
+		}
+	}
+	fmt.Println(len(cases)-failed, "of", len(cases), "round trips passed")
+	if failed > 0 {
+		err := verifyError(fmt.Sprint("Fatal error: ", failed, " round trips failed."))
+		log.Println(err)
+		return exitCode(err)
+	}
+	return exitOK
+}
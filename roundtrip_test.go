@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	silent = true
+	for _, rt := range roundTripCases() {
+		t.Run(rt.name, func(t *testing.T) {
+			opts, err := newOptions(10, rt.target, rt.wordsize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts.rle = rt.rle
+			if err := roundTrip([]byte(rt.source), opts); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
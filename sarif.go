@@ -0,0 +1,159 @@
+package main
+
+// SARIF logs of the diagnostics, with "pollock -f prog.plk -sarif out.sarif" or "pollock build -sarif out.sarif ..."
+//
+// The warnings and the error of every compiled file are written as the results of one run of the SARIF 2.1.0
+// format, which code scanning and review tools read to annotate the .plk files. The results are the diagnostics of
+// the JSON output of pollock serve: the rule is the diagnostic code, the level is warning, or error for the syntax
+// errors and the warnings of -Werror, and the region is the line with the columns of the caret, counted in UTF-16
+// code units as SARIF expects. With -sarif every file of a batch is compiled, even if it is up to date, so the log
+// has the warnings of all of them. The log is written even if a file fails.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unicode/utf16"
+)
+
+// Version and schema of the SARIF logs
+const (
+	sarifVersion = "2.1.0"
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+)
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool       sarifTool     `json:"tool"`
+	ColumnKind string        `json:"columnKind"`
+	Results    []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name    string      `json:"name"`
+	Version string      `json:"version"`
+	Rules   []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId,omitempty"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysical `json:"physicalLocation"`
+}
+
+type sarifPhysical struct {
+	ArtifactLocation sarifArtifact `json:"artifactLocation"`
+	Region           *sarifRegion  `json:"region,omitempty"`
+}
+
+type sarifArtifact struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+	EndColumn   int `json:"endColumn,omitempty"`
+}
+
+// fileDiagnostics returns the diagnostics of a compilation, with its error last if it failed
+func fileDiagnostics(c compiled, err error) []diagnostic {
+	diagnostics := c.diagnostics
+	if err == nil {
+		return diagnostics
+	}
+	var ce *codedError
+	if errors.As(err, &ce) && ce.at != nil {
+		return append(diagnostics, *ce.at)
+	}
+	return append(diagnostics, diagnostic{Code: errorCode(err), Level: "error", Message: err.Error()})
+}
+
+// utf16Column converts a 1 based column counted in bytes into one counted in UTF-16 code units
+func utf16Column(line []byte, column int) int {
+	if column-1 > len(line) {
+		return column
+	}
+	return len(utf16.Encode([]rune(string(line[:column-1])))) + 1
+}
+
+// sarifResults returns the results of the diagnostics of a source file, those of included files name their files
+func sarifResults(source string, diagnostics []diagnostic) []sarifResult {
+	results := make([]sarifResult, 0, len(diagnostics))
+	lines := make(map[string][][]byte)
+	for _, d := range diagnostics {
+		file := source
+		if len(d.File) > 0 {
+			file = d.File
+		}
+		physical := sarifPhysical{ArtifactLocation: sarifArtifact{URI: filepath.ToSlash(file)}}
+		if d.Line > 0 {
+			physical.Region = &sarifRegion{StartLine: d.Line}
+			if d.Column > 0 {
+				if _, ok := lines[file]; !ok {
+					data, _ := os.ReadFile(file)
+					lines[file] = bytes.Split(data, []byte("\n"))
+				}
+				start, end := d.Column, d.Column+d.Width
+				if d.Line <= len(lines[file]) {
+					line := lines[file][d.Line-1]
+					start, end = utf16Column(line, start), utf16Column(line, end)
+				}
+				physical.Region.StartColumn, physical.Region.EndColumn = start, end
+			}
+		}
+		results = append(results, sarifResult{
+			RuleID:    d.Code,
+			Level:     d.Level,
+			Message:   sarifMessage{Text: d.Message},
+			Locations: []sarifLocation{{PhysicalLocation: physical}},
+		})
+	}
+	return results
+}
+
+// writeSarif writes the SARIF log of the diagnostics of the source files
+func writeSarif(path string, sources []string, diagnostics [][]diagnostic) error {
+	driver := sarifDriver{Name: "pollock", Version: version, Rules: []sarifRule{}}
+	for _, w := range warningCodes {
+		driver.Rules = append(driver.Rules, sarifRule{ID: w.code, ShortDescription: sarifMessage{Text: w.help}})
+	}
+	run := sarifRun{Tool: sarifTool{Driver: driver}, ColumnKind: "utf16CodeUnits", Results: []sarifResult{}}
+	for i, source := range sources {
+		run.Results = append(run.Results, sarifResults(source, diagnostics[i])...)
+	}
+	data, err := json.MarshalIndent(sarifLog{Schema: sarifSchema, Version: sarifVersion, Runs: []sarifRun{run}}, "", "  ")
+	if err == nil {
+		err = os.WriteFile(path, append(data, '\n'), 0o644)
+	}
+	if err != nil {
+		return ioError(fmt.Sprint("Fatal error: \"", err, "\""))
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+// Project scaffolding, with "pollock init [DIR]" and "pollock new hello|fizzbuzz|snake"
+//
+// pollock init creates a project in DIR, the current directory by default: pollock.toml with the name of the project
+// and its main target, src/main.plk with the hello program, and testdata/examples/ with the fizzbuzz program and its
+// golden image for pollock examples verify. pollock new writes a starter program, NAME.plk by default or the -o file:
+// hello prints a text, fizzbuzz counts to 100, and snake is a terminal game steered with w, a, s and d, which needs
+// format 1.1 for the input polling and the timing. Existing files are never overwritten.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// File name of the project manifest
+const manifestName = "pollock.toml"
+
+// The starter programs of pollock new
+var templates = map[string]string{
+	"hello": `# Hello, world: prints the text character by character, up to its NUL terminator
+push "Hello, world!\n"
+LOOP: dup; push END; jmpz
+outc; push 0; push LOOP
+jmpz; nop; nop
+END: pop; halt; nop
+`,
+	"fizzbuzz": `# FizzBuzz: the numbers from 1 to 100, Fizz for the multiples of 3, Buzz for those of 5 and FizzBuzz for both
+push 1; nop; nop
+LOOP: dup; push 15; rem
+push FB; jmpz; nop
+dup; push 3; rem
+push FIZZ; jmpz; nop
+dup; push 5; rem
+push BUZZ; jmpz; nop
+dup; outi; push 0
+push NEXT; jmpz; nop
+# FizzBuzz prints Fizz and goes on with Buzz
+FB: push 'F'; outc; push 'i'
+outc; push 'z'; outc
+push 'z'; outc; push 0
+push BUZZ; jmpz; nop
+FIZZ: push 'F'; outc; push 'i'
+outc; push 'z'; outc
+push 'z'; outc; push 0
+push NEXT; jmpz; nop
+BUZZ: push 'B'; outc; push 'u'
+outc; push 'z'; outc
+push 'z'; outc; nop
+NEXT: push '\n'; outc; nop
+addi 1; dup
+push 101; lt; push LOOP
+jmpnz; pop; halt
+`,
+	"snake": `#pragma target 1.1
+# Snake: steer it with w, a, s and d, it leaves its trail and the game ends at the edge of the 40 by 20 field
+# The stack holds x, y and the direction: 0 up, 1 right, 2 down, 3 left
+push 27; outc; push '['
+outc; push '2'; outc
+push 'J'; outc; push 20
+push 10; push 1; nop
+LOOP: push 100; sleep; poll
+push MOVE; jmpz; inc
+dup; push 'w'; eq
+push UP; jmpnz; dup
+push 'd'; eq; push RIGHT
+jmpnz; dup; push 's'
+eq; push DOWN; jmpnz
+dup; push 'a'; eq
+push LEFT; jmpnz; pop
+push 0; push MOVE; jmpz
+UP: pop; pop; push 0
+push 0; push MOVE; jmpz
+RIGHT: pop; pop; push 1
+push 0; push MOVE; jmpz
+DOWN: pop; pop; push 2
+push 0; push MOVE; jmpz
+LEFT: pop; pop; push 3
+MOVE: dup; push 0; eq
+push GOUP; jmpnz; dup
+push 1; eq; push GORIGHT
+jmpnz; dup; push 2
+eq; push GODOWN; jmpnz
+# Left
+rot; subi 1; rot
+rot; push 0; push WALLS
+jmpz; nop; nop
+GOUP: swap; subi 1; swap
+push 0; push WALLS; jmpz
+GORIGHT: rot; addi 1; rot
+rot; push 0; push WALLS
+jmpz; nop; nop
+GODOWN: swap; addi 1; swap
+WALLS: over; push END; jmpz
+over; push 21; eq
+push END; jmpnz; push 2
+pick; push END; jmpz
+push 2; pick; push 41
+jeq END; nop
+# Draws the head at ESC [ y ; x H
+push 27; outc; push '['
+outc; over; outi
+push ';'; outc; push 2
+pick; outi; push 'H'
+outc; push '#'; outc
+push 0; push LOOP; jmpz
+END: push 27; outc; push '['
+outc; push 22; outi
+push ';'; outc; push 1
+outi; push 'H'; outc
+push "Game over\n"; nop
+PRINT: dup; push DONE; jmpz
+outc; push 0; push PRINT
+jmpz; nop; nop
+DONE: pop; halt; nop
+`,
+}
+
+// The names of the starter programs
+func templateNames() []string {
+	var names []string
+	for name := range templates {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// writeNew writes the file, unless it exists
+func writeNew(filename string, content []byte) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		return usageError(fmt.Sprint("Fatal error: \"", filename, "\" exists already."))
+	}
+	if err == nil {
+		_, err = f.Write(content)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return ioError(fmt.Sprint("Fatal create error: \"", err, "\""))
+	}
+	logWrapper(fmt.Sprint("Created ", filename))
+	return nil
+}
+
+// registerNew registers the flags of the new subcommand
+func registerNew(flags *flag.FlagSet, outputfile *string) {
+	flags.StringVar(outputfile, "o", "", "Output file name, default is NAME.plk")
+	flags.BoolVar(&silent, "s", false, "Run in silent mode, default is false")
+}
+
+// newProgram parses the flags of the new subcommand, writes the starter program and returns the exit code
+func newProgram(args []string) int {
+	var outputfile string
+
+	flags := flag.NewFlagSet("new", flag.ExitOnError)
+	registerNew(flags, &outputfile)
+	flags.Parse(args)
+	err := applyEnv(flags)
+	if err == nil && flags.NArg() != 1 {
+		err = usageError(fmt.Sprint("Fatal error: Exactly one starter program is needed, ", strings.Join(templateNames(), ", "), "."))
+	}
+	if err == nil {
+		name := flags.Arg(0)
+		if _, ok := templates[name]; !ok {
+			err = usageError(fmt.Sprint("Fatal error: Unknown starter program \"", name, "\", must be ", strings.Join(templateNames(), ", "), "."))
+		} else {
+			if len(outputfile) == 0 {
+				outputfile = name + ".plk"
+			}
+			err = writeNew(outputfile, []byte(templates[name]))
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+	return exitOK
+}
+
+// registerInit registers the flags of the init subcommand
+func registerInit(flags *flag.FlagSet) {
+	flags.BoolVar(&silent, "s", false, "Run in silent mode, default is false")
+}
+
+// initProject parses the flags of the init subcommand, creates the project and returns the exit code
+func initProject(args []string) int {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	registerInit(flags)
+	flags.Parse(args)
+	err := applyEnv(flags)
+	if err == nil && flags.NArg() > 1 {
+		err = usageError("Fatal error: At most one project directory is allowed.")
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+
+	dir := "."
+	if flags.NArg() == 1 {
+		dir = flags.Arg(0)
+	}
+	abs, err := filepath.Abs(dir)
+	if err == nil {
+		err = os.MkdirAll(filepath.Join(dir, "src"), 0o755)
+	}
+	if err == nil {
+		err = os.MkdirAll(filepath.Join(dir, "testdata", "examples"), 0o755)
+	}
+	if err != nil {
+		err = ioError(fmt.Sprint("Fatal create error: \"", err, "\""))
+		log.Println(err)
+		return exitCode(err)
+	}
+	manifest := fmt.Sprint("# Pollock project, pollock build writes the image of every target\nname = \"", filepath.Base(abs), "\"\n\n",
+		"[[target]]\nname = \"main\"\nentry = \"src/main.plk\"\ncellsize = 10\nformat = \"png\"\n")
+	err = writeNew(filepath.Join(dir, manifestName), []byte(manifest))
+	if err == nil {
+		err = writeNew(filepath.Join(dir, "src", "main.plk"), []byte(templates["hello"]))
+	}
+	example := filepath.Join(dir, "testdata", "examples", "fizzbuzz.plk")
+	if err == nil {
+		err = writeNew(example, []byte(templates["fizzbuzz"]))
+	}
+	if err == nil {
+		// The golden image of the example
+		opts, _ := newOptions(10, "1.0", 8)
+		opts.logger = log.New(io.Discard, "", 0)
+		var c compiled
+		if c, err = compile([]byte(templates["fizzbuzz"]), opts); err == nil {
+			err = writeImage(c, strings.TrimSuffix(example, ".plk")+".png", opts)
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+	return exitOK
+}
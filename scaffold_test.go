@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testClean compiles the scaffolded file and fails on any diagnostic
+func testClean(t *testing.T, filename string) {
+	t.Helper()
+	source, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := testCompile(t, string(source), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range c.diagnostics {
+		t.Errorf("%s line %d: [%s] %s", filepath.Base(filename), d.Line, d.Code, d.Message)
+	}
+}
+
+func TestNewTemplates(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range templateNames() {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(dir, name+".plk")
+			if code := newProgram([]string{"-s", "-o", filename, name}); code != exitOK {
+				t.Fatalf("exit code %d", code)
+			}
+			testClean(t, filename)
+		})
+	}
+}
+
+func TestInitProject(t *testing.T) {
+	dir := t.TempDir()
+	if code := initProject([]string{"-s", dir}); code != exitOK {
+		t.Fatalf("exit code %d", code)
+	}
+	testClean(t, filepath.Join(dir, "src", "main.plk"))
+	testClean(t, filepath.Join(dir, "testdata", "examples", "fizzbuzz.plk"))
+}
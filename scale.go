@@ -0,0 +1,120 @@
+package main
+
+// Scaling of images, with "pollock scale -c 20 -o big.png in.png"
+//
+// Resizing an image in an editor blurs the cells or leaves their size at odds with the header cell. pollock scale
+// decodes the image and encodes the same cells again at another cell size, so the instruction stream stays
+// identical: the program and extension cells, shuffled or not, the Pollock chunks and the signature, which doesn't
+// cover the cell size, unless a cell size over 255 turns a format 1.0 image into 1.1. -grid draws cell borders and
+// -rle packs the runs of identical cells of format 1.1 images. The painting of the art cells isn't stored in the
+// image, the scaled cells are flat. The written image is decoded again and compared to the input before the
+// command succeeds.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// registerScale registers the flags of the scale subcommand
+func registerScale(flags *flag.FlagSet, outputfile *string, cellsize *int, grid *string, rle *bool, keyfile *string) {
+	flags.StringVar(outputfile, "o", "", "Output file name, mandatory")
+	flags.IntVar(cellsize, "c", 0, "Cell size in pixels, 2 to 1024, mandatory")
+	flags.StringVar(grid, "grid", "", "Color of the cell borders, RRGGBB, drawn in PNG images with a cell size of 4 or more, default is none")
+	flags.BoolVar(rle, "rle", false, "Run-length encode the runs of identical cells of format 1.1 images, default is false")
+	flags.StringVar(keyfile, "verify-key", "", "Ed25519 public key in PEM format the image must be signed with, default is no check")
+	flags.BoolVar(&silent, "s", false, "Run in silent mode, default is false")
+}
+
+// checkScaled decodes the written image and fails unless its cells are those of the input
+func checkScaled(c compiled, outputfile string) error {
+	switch strings.ToLower(filepath.Ext(outputfile)) {
+	case ".svg", ".pdf":
+		// Not read back by pollock
+		return nil
+	}
+	written, err := decodeFile(outputfile)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(written.tokenStream(), c.tokenStream()) {
+		return verifyError(fmt.Sprint("Fatal error: The cells of \"", outputfile, "\" don't match the input image."))
+	}
+	return nil
+}
+
+// scale parses the flags of the scale subcommand, encodes the image at the new cell size and returns the exit code
+func scale(args []string) int {
+	var outputfile, grid, keyfile string
+	var cellsize int
+	var rle bool
+
+	flags := flag.NewFlagSet("scale", flag.ExitOnError)
+	registerScale(flags, &outputfile, &cellsize, &grid, &rle, &keyfile)
+	flags.Parse(args)
+	err := applyEnv(flags)
+	if err == nil && len(outputfile) == 0 {
+		err = usageError("Fatal error: Output file is required.")
+	}
+	if err == nil && cellsize == 0 {
+		err = usageError("Fatal error: The cell size is required.")
+	}
+	if err == nil && flags.NArg() != 1 {
+		err = usageError("Fatal error: Exactly one image is needed.")
+	}
+	var opts options
+	if err == nil {
+		if opts, err = newOptions(cellsize, "1.0", 8); err != nil {
+			err = usageError(fmt.Sprint("Fatal error: ", err))
+		}
+	}
+	if err == nil && len(grid) > 0 {
+		if opts.grid, err = parseColor(grid); err != nil {
+			err = usageError(fmt.Sprint("Fatal error: ", err))
+		}
+	}
+	var key ed25519.PublicKey
+	if err == nil {
+		key, err = verifyKeyFlag(keyfile)
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+
+	name := flags.Arg(0)
+	logWrapper(fmt.Sprint("Reading image: ", name))
+	c, err := decodeFile(name)
+	if err == nil {
+		err = checkSignature(c, name, key)
+	}
+	if err == nil && rle && c.minor < 1 {
+		err = usageError(fmt.Sprint("Fatal error: Run-length encoding needs format version ", VMAJOR, ".1, \"", name, "\" is ", VMAJOR, ".", c.minor, "."))
+	}
+	if err == nil {
+		logWrapper(fmt.Sprint("Scaling ", c.progline, " cells from ", c.opts.cellsize, " to ", cellsize, " pixels."))
+		opts.symbols, opts.rle = c.opts.symbols, rle
+		c.opts = opts
+		if cellsize > maxHeaderCellsize && c.minor < 1 {
+			// The cell size extension cell changes the version of the header cell, which is signed
+			c.minor = 1
+			if len(c.signature) > 0 {
+				logWrapper(fmt.Sprint("Warning: Cell size ", cellsize, " needs format version ", VMAJOR, ".1, the signature is dropped."))
+				c.signature = nil
+			}
+		}
+		err = writeImage(c, outputfile, opts)
+	}
+	if err == nil {
+		err = checkScaled(c, outputfile)
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+	return exitOK
+}
@@ -0,0 +1,166 @@
+package main
+
+// HTTP compile service, started with "pollock serve -listen :8080"
+//
+// POST /compile compiles the .plk source in the request body. The options can be given as query parameters
+// with the same names as the command line flags: c (cell size, up to 50), t (target), wordsize and lang. The cell
+// size of a pragma is limited the same way, and images over 16M pixels, e.g. of a large .space, are refused.
+// The response is JSON: {"image": base64 PNG, "diagnostics": [{"line", "position", "code", "level", "message"}], "error": text, "code": text}
+// with status 200 if the program compiled, 422 on syntax errors, 400 on invalid options and 413 on too large
+// sources and images.
+// Every diagnostic has a short code, and a failed compilation has the code of its error in "code".
+//
+// GET / serves the playground, an editor which compiles on every change and shows the image and the diagnostics.
+// Its files are in the playground directory and are embedded into the binary.
+//
+// POST /run would execute an image, but there is no VM in this build, so it answers 501 Not Implemented.
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+//go:embed playground
+var playground embed.FS
+
+// Largest accepted request body in bytes
+const maxBodySize = 1 << 20
+
+// Largest cell size and number of pixels of the service, whose images are drawn in memory
+const (
+	maxServeCellsize = 50
+	maxServePixels   = 1 << 24
+)
+
+type compileResponse struct {
+	Image       []byte       `json:"image,omitempty"`
+	Diagnostics []diagnostic `json:"diagnostics"`
+	Error       string       `json:"error,omitempty"`
+	Code        string       `json:"code,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, response compileResponse) {
+	if response.Diagnostics == nil {
+		response.Diagnostics = []diagnostic{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logWrapper(fmt.Sprint("Response write error: ", err))
+	}
+}
+
+// queryInt returns the integer query parameter, or the default if it is missing
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if len(value) == 0 {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func handleCompile(w http.ResponseWriter, r *http.Request) {
+	cellsize, err := queryInt(r, "c", 10)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, compileResponse{Error: "Cell size must be a number."})
+		return
+	}
+	wordsize, err := queryInt(r, "wordsize", 8)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, compileResponse{Error: "Word size must be a number."})
+		return
+	}
+	target := r.URL.Query().Get("t")
+	if len(target) == 0 {
+		target = "1.0"
+	}
+	opts, err := newOptions(cellsize, target, wordsize)
+	if err == nil && cellsize > maxServeCellsize {
+		err = usageError(fmt.Sprint("Cell size must be between ", minCellsize, " and ", maxServeCellsize, "."))
+	}
+	if lang := r.URL.Query().Get("lang"); err == nil && len(lang) > 0 {
+		opts.lang = lang
+		if !slices.Contains(languages, lang) {
+			err = usageError(fmt.Sprint("Unknown language \"", lang, "\", must be ", strings.Join(languages, " or "), "."))
+		}
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, compileResponse{Error: err.Error(), Code: errorCode(err)})
+		return
+	}
+	file, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeJSON(w, http.StatusRequestEntityTooLarge, compileResponse{Error: "Source too large."})
+		return
+	}
+
+	c, err := compile(file, opts)
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, compileResponse{Diagnostics: c.diagnostics, Error: err.Error(), Code: errorCode(err)})
+		return
+	}
+	// A pragma may have raised the cell size, and .space the number of cells
+	if c.opts.cellsize > maxServeCellsize {
+		err = usageError(fmt.Sprint("Cell size must be between ", minCellsize, " and ", maxServeCellsize, "."))
+		writeJSON(w, http.StatusBadRequest, compileResponse{Diagnostics: c.diagnostics, Error: err.Error(), Code: errorCode(err)})
+		return
+	}
+	written := c.written(c.opts)
+	if maxX, maxY := layout(len(written.cellColors(c.opts.cellsize))); maxX*maxY*c.opts.cellsize*c.opts.cellsize > maxServePixels {
+		writeJSON(w, http.StatusRequestEntityTooLarge, compileResponse{Diagnostics: c.diagnostics, Error: fmt.Sprint("Image too large, the service draws up to ", maxServePixels, " pixels.")})
+		return
+	}
+	var image bytes.Buffer
+	if err := encodePNG(&image, render(written, c.opts.cellsize), c); err != nil {
+		writeJSON(w, http.StatusInternalServerError, compileResponse{Diagnostics: c.diagnostics, Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, compileResponse{Image: image.Bytes(), Diagnostics: c.diagnostics})
+}
+
+func handleRun(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusNotImplemented, compileResponse{Error: "Running images needs the VM, which is not part of this build."})
+}
+
+// registerServe registers the flags of the serve subcommand
+func registerServe(flags *flag.FlagSet, listen *string) {
+	flags.StringVar(listen, "listen", ":8080", "Address to listen on, default is :8080")
+	flags.BoolVar(&silent, "s", false, "Run in silent mode, default is false")
+}
+
+// serve parses the flags of the serve subcommand and runs the HTTP service until it fails, returning the exit code
+func serve(args []string) int {
+	var listen string
+
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	registerServe(flags, &listen)
+	flags.Parse(args)
+	if err := applyEnv(flags); err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+
+	assets, err := fs.Sub(playground, "playground")
+	if err != nil {
+		log.Fatalln("Fatal error:", "\"", err, "\"")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServerFS(assets))
+	mux.HandleFunc("POST /compile", handleCompile)
+	mux.HandleFunc("POST /run", handleRun)
+	logWrapper(fmt.Sprint("Pollock serving on ", listen))
+	err = ioError(fmt.Sprint("Fatal serve error: \"", http.ListenAndServe(listen, mux), "\""))
+	log.Println(err)
+	return exitCode(err)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleCompile(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		source string
+		status int
+	}{
+		{"program", "", "push 1; outi; halt\n", http.StatusOK},
+		{"largest cell size", "?c=50", "push 1; outi; halt\n", http.StatusOK},
+		{"cell size over the limit", "?c=51", "push 1; outi; halt\n", http.StatusBadRequest},
+		{"pragma cell size over the limit", "", "#pragma cellsize 200\npush 1; outi; halt\n", http.StatusBadRequest},
+		{"too many pixels", "?c=50", ".space 100000\npush 1; outi; halt\n", http.StatusRequestEntityTooLarge},
+		{"syntax error", "", "push 1; push NOWHERE; jmpnz\n", http.StatusUnprocessableEntity},
+	}
+	silent = true
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handleCompile(recorder, httptest.NewRequest(http.MethodPost, "/compile"+test.query, strings.NewReader(test.source)))
+			if recorder.Code != test.status {
+				t.Errorf("got status %d, want %d: %s", recorder.Code, test.status, recorder.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+// Contact sheets of program collections, with "pollock sheet -o sheet.png gallery/"
+//
+// The compiled images in the directory (the .png files with a Pollock header, other files are skipped) are scaled
+// down to thumbnails of at most -size pixels, captioned with their file names in the font of teach.go. Every
+// thumbnail is written as NAME.thumb.png in the -thumbs directory and the contact sheet has all of them in a grid,
+// in file name order, -columns wide or as square as possible. The thumbnails are for looking at, they aren't
+// executable.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Default size of the thumbnails in pixels
+const defaultThumbSize = 128
+
+// Space around the thumbnails of the contact sheet
+const sheetPadding = 8
+
+// Height of the caption under a thumbnail
+const captionHeight = 5*glyphScale + 8
+
+var sheetBackground = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+
+// registerSheet registers the flags of the sheet subcommand
+func registerSheet(flags *flag.FlagSet, outputfile *string, thumbs *string, size *int, columns *int) {
+	flags.StringVar(outputfile, "o", "", "Output file name of the contact sheet, mandatory")
+	flags.StringVar(thumbs, "thumbs", "", "Directory of the thumbnails, default is thumbs next to the contact sheet")
+	flags.IntVar(size, "size", defaultThumbSize, fmt.Sprint("Size of the thumbnails in pixels, default is ", defaultThumbSize))
+	flags.IntVar(columns, "columns", 0, "Number of thumbnails in a row, default is as square as possible")
+	flags.BoolVar(&silent, "s", false, "Run in silent mode, default is false")
+}
+
+// caption returns the name shortened to fit in width pixels
+func caption(name string, width int) string {
+	fits := width / (4 * glyphScale)
+	if len(name) <= fits {
+		return name
+	}
+	return name[:max(fits-2, 0)] + ".."
+}
+
+// thumbnail scales the image to fit in size x size pixels, keeping the cells sharp, and captions it with the name
+func thumbnail(img image.Image, name string, size int) *image.RGBA {
+	bounds := img.Bounds()
+	scale := math.Min(float64(size)/float64(bounds.Dx()), float64(size)/float64(bounds.Dy()))
+	w, h := max(int(float64(bounds.Dx())*scale), 1), max(int(float64(bounds.Dy())*scale), 1)
+	thumb := image.NewRGBA(image.Rect(0, 0, size, size+captionHeight))
+	draw.Draw(thumb, thumb.Bounds(), image.NewUniform(sheetBackground), image.Point{}, draw.Src)
+	left, top := (size-w)/2, (size-h)/2
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			pixel := img.At(bounds.Min.X+x*bounds.Dx()/w, bounds.Min.Y+y*bounds.Dy()/h)
+			thumb.Set(left+x, top+y, pixel)
+		}
+	}
+	drawText(thumb, 0, size+4, caption(name, size), color.RGBA{A: 255})
+	return thumb
+}
+
+// encodeFile writes the image as a PNG file
+func encodeFile(name string, img image.Image) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return ioError(fmt.Sprint("Fatal create error: \"", err, "\""))
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return ioError(fmt.Sprint("Fatal encode error: \"", err, "\""))
+	}
+	if err := f.Close(); err != nil {
+		return ioError(fmt.Sprint("Fatal close error: \"", err, "\""))
+	}
+	return nil
+}
+
+// readPrograms returns the compiled images of the directory by file name, the other files are skipped
+func readPrograms(dir string) ([]string, map[string]image.Image, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, ioError(fmt.Sprint("Fatal error: \"", err, "\""))
+	}
+	var names []string
+	images := make(map[string]image.Image)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(entry.Name()), ".png") {
+			continue
+		}
+		name := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, nil, ioError(fmt.Sprint("Fatal error: \"", err, "\""))
+		}
+		if _, err := decodeImage(data); err != nil {
+			logWrapper(fmt.Sprint("Skipping ", name, ": ", err))
+			continue
+		}
+		img, _ := png.Decode(bytes.NewReader(data))
+		names = append(names, entry.Name())
+		images[entry.Name()] = img
+	}
+	return names, images, nil
+}
+
+// sheet parses the flags of the sheet subcommand, writes the thumbnails and the contact sheet and returns the exit
+// code
+func sheet(args []string) int {
+	var outputfile, thumbs string
+	var size, columns int
+
+	flags := flag.NewFlagSet("sheet", flag.ExitOnError)
+	registerSheet(flags, &outputfile, &thumbs, &size, &columns)
+	flags.Parse(args)
+	err := applyEnv(flags)
+	if err == nil && len(outputfile) == 0 {
+		err = usageError("Fatal error: Output file is required.")
+	}
+	if err == nil && flags.NArg() != 1 {
+		err = usageError("Fatal error: Exactly one directory is needed.")
+	}
+	if err == nil && (size < 16 || columns < 0) {
+		err = usageError("Fatal error: The thumbnail size must be at least 16 and the number of columns positive.")
+	}
+	var names []string
+	var images map[string]image.Image
+	if err == nil {
+		names, images, err = readPrograms(flags.Arg(0))
+	}
+	if err == nil && len(names) == 0 {
+		err = usageError(fmt.Sprint("Fatal error: No compiled images in \"", flags.Arg(0), "\"."))
+	}
+	if err == nil {
+		if len(thumbs) == 0 {
+			thumbs = filepath.Join(filepath.Dir(outputfile), "thumbs")
+		}
+		if mkErr := os.MkdirAll(thumbs, 0o755); mkErr != nil {
+			err = ioError(fmt.Sprint("Fatal error: \"", mkErr, "\""))
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+
+	if columns == 0 {
+		columns = int(math.Ceil(math.Sqrt(float64(len(names)))))
+	}
+	columns = min(columns, len(names))
+	rows := (len(names) + columns - 1) / columns
+	tileW, tileH := size+sheetPadding, size+captionHeight+sheetPadding
+	contact := image.NewRGBA(image.Rect(0, 0, columns*tileW+sheetPadding, rows*tileH+sheetPadding))
+	draw.Draw(contact, contact.Bounds(), image.NewUniform(sheetBackground), image.Point{}, draw.Src)
+	for i, name := range names {
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		thumb := thumbnail(images[name], base, size)
+		thumbName := filepath.Join(thumbs, base+".thumb.png")
+		logWrapper(fmt.Sprint("Creating thumbnail: ", thumbName))
+		if err := encodeFile(thumbName, thumb); err != nil {
+			log.Println(err)
+			return exitCode(err)
+		}
+		x, y := sheetPadding+(i%columns)*tileW, sheetPadding+(i/columns)*tileH
+		draw.Draw(contact, image.Rect(x, y, x+size, y+size+captionHeight), thumb, image.Point{}, draw.Src)
+	}
+	logWrapper(fmt.Sprint("Creating contact sheet of ", len(names), " images: ", outputfile))
+	if err := encodeFile(outputfile, contact); err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+	return exitOK
+}
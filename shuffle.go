@@ -0,0 +1,120 @@
+package main
+
+// Shuffled images
+//
+// -shuffle KEY places the program cells in a keyed pseudo-random order, so the layout of the picture tells nothing
+// about the control flow. The header cells and the extension cells stay in place. The order is a Fisher-Yates
+// permutation drawn from ChaCha8, seeded with the HMAC-SHA256 of a random nonce under a secret derived from the key,
+// so every build of the same program is shuffled differently. The nonce is recorded in extension cells (kind 3):
+// the first one holds a 16-bit check value of the key, the next four the 64-bit nonce encrypted with the key, high
+// bits first. The commands reading images restore the order with -shuffle-key, the same KEY, and drop those cells.
+// Label addresses, the entry point and the relocation table refer to the unshuffled order.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mrand "math/rand/v2"
+)
+
+// Number of shuffle extension cells, the key check and the 4 cells of the nonce
+const shuffleCells = 5
+
+// shuffleSecret derives the secret of the permutations from the key
+func shuffleSecret(key string) []byte {
+	secret := sha256.Sum256([]byte("pollock shuffle\x00" + key))
+	return secret[:]
+}
+
+// keyedHash is the HMAC-SHA256 of the data under the secret
+func keyedHash(secret []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// permutation returns the keyed order of n cells, the i-th cell of the image is the permutation[i]-th of the program
+func permutation(secret []byte, nonce []byte, n int) []int {
+	var seed [32]byte
+	copy(seed[:], keyedHash(secret, nonce))
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	mrand.New(mrand.NewChaCha8(seed)).Shuffle(n, func(i, j int) {
+		order[i], order[j] = order[j], order[i]
+	})
+	return order
+}
+
+// shuffle places the program cells in the keyed order and records the nonce in extension cells
+func (c *compiled) shuffle(key string) error {
+	secret := shuffleSecret(key)
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	mask := keyedHash(secret, []byte("nonce"))
+	check := keyedHash(secret, []byte("check"))
+	c.extensions = append(c.extensions, [3]uint8{extShuffle, check[0], check[1]})
+	for i := 0; i < 8; i += 2 {
+		c.extensions = append(c.extensions, [3]uint8{extShuffle, nonce[i] ^ mask[i], nonce[i+1] ^ mask[i+1]})
+	}
+
+	program := progarray{r: make([]uint8, c.progline), g: make([]uint8, c.progline), b: make([]uint8, c.progline)}
+	for i, k := range permutation(secret, nonce, c.progline) {
+		program.r[i], program.g[i], program.b[i] = c.program.r[k], c.program.g[k], c.program.b[k]
+	}
+	c.program = program
+	if c.minor < 1 {
+		c.minor = 1
+		c.opts.logMsg(fmt.Sprint("Shuffling needs format version ", VMAJOR, ".", c.minor, "."))
+	}
+	c.opts.logMsg(fmt.Sprint("Shuffled ", c.progline, " program cells."))
+	return nil
+}
+
+// unshuffle restores the order of the program cells of a decoded image and drops the shuffle extension cells
+func (c *compiled) unshuffle(key string) error {
+	var cells [][3]uint8
+	var extensions [][3]uint8
+	for _, ext := range c.extensions {
+		if ext[0] == extShuffle {
+			cells = append(cells, ext)
+		} else {
+			extensions = append(extensions, ext)
+		}
+	}
+	if len(cells) == 0 {
+		return nil
+	}
+	if len(key) == 0 {
+		return errors.New("image is shuffled, its key is needed")
+	}
+	if len(cells) != shuffleCells {
+		return errors.New(fmt.Sprint("image has ", len(cells), " shuffle cells instead of ", shuffleCells))
+	}
+	secret := shuffleSecret(key)
+	check := keyedHash(secret, []byte("check"))
+	if cells[0][1] != check[0] || cells[0][2] != check[1] {
+		return errors.New("wrong shuffle key")
+	}
+	mask := keyedHash(secret, []byte("nonce"))
+	nonce := make([]byte, 8)
+	for i := 0; i < 8; i += 2 {
+		binary.BigEndian.PutUint16(nonce[i:], uint16(cells[1+i/2][1])<<8|uint16(cells[1+i/2][2]))
+		nonce[i] ^= mask[i]
+		nonce[i+1] ^= mask[i+1]
+	}
+
+	program := progarray{r: make([]uint8, c.progline), g: make([]uint8, c.progline), b: make([]uint8, c.progline)}
+	for i, k := range permutation(secret, nonce, c.progline) {
+		program.r[k], program.g[k], program.b[k] = c.program.r[i], c.program.g[i], c.program.b[i]
+	}
+	c.program = program
+	c.extensions = extensions
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+// Signed images
+//
+// -sign key.pem signs the image with an Ed25519 private key (PKCS #8 PEM, e.g. "openssl genpkey -algorithm ed25519")
+// and writes the 64-byte signature into the plSg chunk of the PNG file. The signature covers the token stream, the
+// cell colors of the header, the program and the extension cells, without the cell size, and the Pollock chunks
+// which give the cells their meaning: the export, relocation and symbol tables and the source map, which pollock
+// link rewrites the cells with. The chunks are signed as the decoder reads them back, so the image can be rendered
+// at another cell size or recompressed and stays valid, but any changed instruction or table entry breaks it.
+// -verify-key pub.pem (PKIX PEM, "openssl pkey -pubout") makes the commands reading images refuse the images
+// which are unsigned or whose signature doesn't match, and "pollock verify -key pub.pem images..." checks them.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// readPEM returns the DER bytes of the first PEM block of the file
+func readPEM(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, ioError(fmt.Sprint("Fatal error: \"", err, "\""))
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, usageError(fmt.Sprint("Fatal error: \"", filename, "\" is not a PEM file."))
+	}
+	return block.Bytes, nil
+}
+
+// loadSigningKey reads an Ed25519 private key
+func loadSigningKey(filename string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if private, ok := key.(ed25519.PrivateKey); err == nil && ok {
+		return private, nil
+	}
+	return nil, usageError(fmt.Sprint("Fatal error: \"", filename, "\" is not an Ed25519 private key."))
+}
+
+// loadVerifyKey reads an Ed25519 public key
+func loadVerifyKey(filename string) (ed25519.PublicKey, error) {
+	der, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if public, ok := key.(ed25519.PublicKey); err == nil && ok {
+		return public, nil
+	}
+	return nil, usageError(fmt.Sprint("Fatal error: \"", filename, "\" is not an Ed25519 public key."))
+}
+
+// signing sets the signing key of the compilation from the -sign flag
+func (bf *buildFlags) signing(opts *options) error {
+	if len(bf.sign) == 0 {
+		return nil
+	}
+	key, err := loadSigningKey(bf.sign)
+	opts.signKey = key
+	return err
+}
+
+// tokenStream returns the signed bytes of the image, the channels of its cells without the cell size
+func (c compiled) tokenStream() []byte {
+	var stream bytes.Buffer
+	for _, cell := range c.cellColors(0) {
+		stream.Write([]byte{cell.R, cell.G, cell.B})
+	}
+	return stream.Bytes()
+}
+
+// signedMessage returns the bytes the signature covers, the token stream followed by the name, the length and the
+// data of each table chunk
+func (c compiled) signedMessage() []byte {
+	message := bytes.NewBuffer(c.tokenStream())
+	for _, chunk := range c.tableChunks() {
+		message.WriteString(chunk.name)
+		binary.Write(message, binary.BigEndian, uint32(len(chunk.data)))
+		message.Write(chunk.data)
+	}
+	return message.Bytes()
+}
+
+// sign returns the signature of the image
+func (c compiled) sign() []byte {
+	return ed25519.Sign(c.opts.signKey, c.signedMessage())
+}
+
+// verifySignature checks the signature of a decoded image with the public key
+func (c compiled) verifySignature(key ed25519.PublicKey) error {
+	if len(c.signature) == 0 {
+		return errors.New("image is not signed")
+	}
+	if !ed25519.Verify(key, c.signedMessage(), c.signature) {
+		return errors.New("signature doesn't match")
+	}
+	return nil
+}
+
+// checkSignature checks the signature of a decoded image if there is a key
+func checkSignature(c compiled, filename string, key ed25519.PublicKey) error {
+	if key == nil {
+		return nil
+	}
+	if err := c.verifySignature(key); err != nil {
+		return verifyError(fmt.Sprint("Fatal error: Untrusted image \"", filename, "\": ", err, "."))
+	}
+	return nil
+}
+
+// decodeVerified reads an image, checks its signature if there is a key and restores its cell order if it is
+// shuffled
+func decodeVerified(filename string, key ed25519.PublicKey, shuffleKey string) (compiled, error) {
+	c, err := decodeFile(filename)
+	if err == nil {
+		err = checkSignature(c, filename, key)
+	}
+	if err != nil {
+		return c, err
+	}
+	if err := c.unshuffle(shuffleKey); err != nil {
+		return c, verifyError(fmt.Sprint("Fatal error: Invalid Pollock image \"", filename, "\": ", err))
+	}
+	return c, nil
+}
+
+// verifyKeyFlag reads the public key of -verify-key, nil without it
+func verifyKeyFlag(filename string) (ed25519.PublicKey, error) {
+	if len(filename) == 0 {
+		return nil, nil
+	}
+	return loadVerifyKey(filename)
+}
+
+// registerVerify registers the flags of the verify subcommand
+func registerVerify(flags *flag.FlagSet, keyfile *string) {
+	flags.StringVar(keyfile, "key", "", "Ed25519 public key in PEM format, mandatory")
+	flags.BoolVar(&silent, "s", false, "Run in silent mode, default is false")
+}
+
+// verify checks the signatures of the images and returns the exit code of the first failure
+func verify(args []string) int {
+	var keyfile string
+
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	registerVerify(flags, &keyfile)
+	flags.Parse(args)
+	err := applyEnv(flags)
+	if err == nil && len(keyfile) == 0 {
+		err = usageError("Fatal error: Public key is required.")
+	}
+	if err == nil && flags.NArg() == 0 {
+		err = usageError("Fatal error: At least one image is needed.")
+	}
+	var key ed25519.PublicKey
+	if err == nil {
+		key, err = loadVerifyKey(keyfile)
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+
+	status := exitOK
+	for _, name := range flags.Args() {
+		c, err := decodeFile(name)
+		if err == nil {
+			err = checkSignature(c, name, key)
+		}
+		if err != nil {
+			log.Println(err)
+			if status == exitOK {
+				status = exitCode(err)
+			}
+			continue
+		}
+		logWrapper(fmt.Sprint("Signature of \"", name, "\" is valid."))
+	}
+	return status
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testTamper replaces old with new in the data of the named chunk of the file
+func testTamper(t *testing.T, path string, name string, old string, new string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := chunkList(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tampered bytes.Buffer
+	tampered.Write(data[:8])
+	for _, chunk := range chunks {
+		if chunk.name == name {
+			if !bytes.Contains(chunk.data, []byte(old)) {
+				t.Fatalf("chunk %s has no %q: %q", name, old, chunk.data)
+			}
+			chunk.data = bytes.Replace(chunk.data, []byte(old), []byte(new), 1)
+		}
+		writeChunk(&tampered, chunk)
+	}
+	if err := os.WriteFile(path, tampered.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignature(t *testing.T) {
+	const (
+		tables = ".export FOO\n.extern BAR\nFOO: push 1; push BAR; jmpnz\nhalt; nop; nop\n"
+		prints = "push 1; outd; pop\nhalt; nop; nop\n"
+	)
+	dir := t.TempDir()
+	signKey, verifyKey := testKeys(t, dir)
+	key, err := loadVerifyKey(verifyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		source string
+		chunk  string
+		old    string
+		new    string
+		code   string
+	}{
+		{"export and relocation tables", tables, "", "", "", ""},
+		{"source map", prints, "", "", "", ""},
+		{"changed relocation", tables, "plRl", "BAR", "BAZ", "verify"},
+		{"changed export", tables, "plEx", "FOO", "FOX", "verify"},
+		{"changed symbol", tables, "plSy", "FOO", "FOX", "verify"},
+		{"changed source map", prints, "plSm", "1 1", "1 2", "verify"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := testCompile(t, test.source, func(opts *options) { opts.symbols = true })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.opts.signKey, err = loadSigningKey(signKey); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, "signed.png")
+			if err := writeImage(c, path, c.opts); err != nil {
+				t.Fatal(err)
+			}
+			if len(test.chunk) > 0 {
+				testTamper(t, path, test.chunk, test.old, test.new)
+			}
+			if _, err := decodeVerified(path, key, ""); errorCode(err) != test.code {
+				t.Errorf("got error code %q (%v), want %q", errorCode(err), err, test.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+// Program statistics, with -stats
+//
+// The report is printed after the compilation, before -shuffle-key moves the cells: the number of every
+// instruction, the push literals counted as push, the share of nops, the basic blocks (see flow.go) and the longest
+// one, the labels and the jumps, and the Shannon entropy of the colors of the program cells, the bits per cell an
+// ideal encoding of the image would need, along with the entropy of the tokens. Programs with a high entropy make
+// busier images, programs with many nops or long blocks leave room for the optimizer.
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// entropy returns the Shannon entropy in bits of the distribution of the counts
+func entropy[K comparable](counts map[K]int, total int) float64 {
+	bits := 0.0
+	for _, n := range counts {
+		p := float64(n) / float64(total)
+		bits -= p * math.Log2(p)
+	}
+	return bits
+}
+
+// writeStats prints the statistics of the program
+func (c compiled) writeStats(w io.Writer) {
+	tokens := 3 * c.progline
+	counts := make(map[string]int)
+	tokenCounts := make(map[uint8]int)
+	colors := make(map[[3]uint8]int)
+	jumps := 0
+	for pos := 0; pos < tokens; pos++ {
+		token := c.token(pos)
+		name := mnemonic(token)
+		if _, literal := c.literal(pos); literal {
+			name = "push"
+		}
+		counts[name]++
+		tokenCounts[token]++
+		if condJumps[name] || fusedJumps[name] {
+			jumps++
+		}
+	}
+	for cell := 0; cell < c.progline; cell++ {
+		colors[[3]uint8{c.program.r[cell], c.program.g[cell], c.program.b[cell]}]++
+	}
+	g := c.flowGraph()
+	longest := 0
+	for i, b := range g.blocks {
+		if b.end-b.start > g.blocks[longest].end-g.blocks[longest].start {
+			longest = i
+		}
+	}
+
+	fmt.Fprintln(w, "Program statistics")
+	if tokens == 0 {
+		fmt.Fprintln(w, " Empty program")
+		return
+	}
+	percent := func(n int) string {
+		return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(tokens))
+	}
+	fmt.Fprintln(w, " Cells:", c.progline, "program cells,", tokens, "instructions")
+	fmt.Fprintln(w, " Code:", tokens-counts["nop"], "instructions,", counts["nop"], "nops,", percent(counts["nop"]), "nops")
+	fmt.Fprintln(w, " Labels:", len(c.labels), "labels,", jumps, "jumps")
+	b := g.blocks[longest]
+	fmt.Fprintln(w, " Basic blocks:", len(g.blocks), "blocks, the longest has", b.end-b.start, "instructions at address", fmt.Sprint(b.start/3+2, colChannel(b.start%3)))
+	fmt.Fprintf(w, " Entropy: %.2f bits per cell, %.2f bits per instruction, %d distinct colors\n", entropy(colors, c.progline), entropy(tokenCounts, tokens), len(colors))
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	fmt.Fprintln(w, " Instructions:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-8s %6d %7s\n", name, counts[name], percent(counts[name]))
+	}
+}
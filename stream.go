@@ -0,0 +1,97 @@
+package main
+
+// Streaming encoding of huge programs
+//
+// render keeps every pixel of the image in memory, 4 * cellsize * cellsize bytes per cell, which is too much for
+// programs with millions of cells. cellImage computes the pixels from the cell colors when they are asked for,
+// and png.Encode asks for them row by row, so besides the cells only a few rows of pixels are in memory.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Images with more pixel bytes than this are streamed instead of drawn in memory
+const streamThreshold = 1 << 26
+
+// cellImage is the image of a compiled program, computed from the cell colors on the fly
+type cellImage struct {
+	colors   []color.RGBA
+	maxX     int
+	maxY     int
+	cellsize int
+	progress *progress
+	grid     color.RGBA
+	palette  string
+	paint    *painter
+	progline int
+}
+
+func newCellImage(c compiled, cellsize int) *cellImage {
+	colors := c.cellColors(cellsize)
+	maxX, maxY := layout(len(colors))
+	c.opts.logMsg(fmt.Sprint("X size: ", maxX, ", Y size: ", maxY))
+	m := &cellImage{colors: colors, maxX: maxX, maxY: maxY, cellsize: cellsize}
+	if c.opts.gridded(cellsize) {
+		m.grid = c.opts.grid
+	}
+	if c.opts.patterned(cellsize) {
+		m.palette = c.opts.palette
+	}
+	m.paint, m.progline = newPainter(c, colors, maxX, maxY, cellsize), c.progline
+	return m
+}
+
+// streamed tells if the image of the program is too large to draw in memory
+func streamed(c compiled, cellsize int) bool {
+	maxX, maxY := layout(c.progline + 2 + len(c.extensions))
+	return maxX*maxY*cellsize*cellsize*4 > streamThreshold
+}
+
+func (m *cellImage) ColorModel() color.Model {
+	return color.RGBAModel
+}
+
+func (m *cellImage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, m.maxX*m.cellsize, m.maxY*m.cellsize)
+}
+
+func (m *cellImage) At(x, y int) color.Color {
+	if x == m.maxX*m.cellsize-1 {
+		// The encoder asks for the pixels row by row, the last pixel finishes a row
+		m.progress.add(1)
+	}
+	k := (y/m.cellsize)*m.maxX + x/m.cellsize
+	if x < 0 || y < 0 || x >= m.maxX*m.cellsize || y >= m.maxY*m.cellsize {
+		return color.RGBA{}
+	}
+	if k >= len(m.colors) {
+		// Empty cells at the end of the grid
+		if m.paint != nil {
+			if ink, ok := m.paint.ink(k, x%m.cellsize, y%m.cellsize); ok {
+				return ink
+			}
+		}
+		return color.RGBA{}
+	}
+	if m.grid.A != 0 && (x%m.cellsize == m.cellsize-1 || y%m.cellsize == m.cellsize-1) {
+		return m.grid
+	}
+	if len(m.palette) > 0 && k >= 2 && k < m.progline+2 {
+		if ink, ok := patternInk(m.palette, m.colors[k], x%m.cellsize, y%m.cellsize, m.cellsize); ok {
+			return ink
+		}
+	}
+	if m.paint != nil {
+		if ink, ok := m.paint.ink(k, x%m.cellsize, y%m.cellsize); ok {
+			return ink
+		}
+	}
+	return m.colors[k]
+}
+
+// Opaque answers the opacity check of the encoder, which would otherwise read every pixel once more
+func (m *cellImage) Opaque() bool {
+	return len(m.colors) == m.maxX*m.maxY
+}
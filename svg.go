@@ -0,0 +1,59 @@
+package main
+
+// SVG output
+//
+// An output file ending in .svg (or -format svg for the default names) gets the program as an SVG of rectangles,
+// one per cell of cellsize x cellsize user units, laid out like the PNG image, which scales losslessly for posters
+// and web pages. The empty cells at the end of the grid are left out. -grid COLOR strokes the cell borders (see grid.go).
+// The SVG is for looking at, it has no Pollock chunks and the compiler doesn't read it back.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// parseColor reads a color written as RRGGBB or #RRGGBB
+func parseColor(text string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(text, "#")
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 6 || err != nil {
+		return color.RGBA{}, errors.New(fmt.Sprint("Invalid color \"", text, "\", must be RRGGBB or #RRGGBB."))
+	}
+	return color.RGBA{R: uint8(value >> 16), G: uint8(value >> 8), B: uint8(value), A: 255}, nil
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// writeSVG writes the cells of the program as SVG rectangles
+func writeSVG(w io.Writer, c compiled, opts options) error {
+	colors := c.cellColors(opts.cellsize)
+	maxX, maxY := layout(len(colors))
+	c.opts.logMsg(fmt.Sprint("X size: ", maxX, ", Y size: ", maxY))
+	size := opts.cellsize
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, `<?xml version="1.0" encoding="UTF-8"?>`)
+	fmt.Fprintf(out, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\" shape-rendering=\"crispEdges\">\n",
+		maxX*size, maxY*size, maxX*size, maxY*size)
+	fmt.Fprintf(out, "<!-- Pollock program, format version %d.%d\n", VMAJOR, c.minor)
+	fmt.Fprintln(out, "     Cell k is the rectangle in column k % width and row k / width of the grid, its fill color holds the")
+	fmt.Fprintln(out, "     3 channels of the cell. Cell 0 is [major version, minor version, cell size], cell 1 the number of")
+	fmt.Fprintln(out, "     program cells in 24 bits, the program cells follow from cell 2, then the extension cells. -->")
+	stroke := ""
+	if opts.grid.A != 0 {
+		stroke = fmt.Sprint(" stroke=\"", hexColor(opts.grid), "\" stroke-width=\"1\"")
+	}
+	fmt.Fprintf(out, "<g%s>\n", stroke)
+	for k, cell := range colors {
+		fmt.Fprintf(out, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"%s\"/>\n", (k%maxX)*size, (k/maxX)*size, size, size, hexColor(cell))
+	}
+	fmt.Fprintln(out, "</g>")
+	fmt.Fprintln(out, "</svg>")
+	return out.Flush()
+}
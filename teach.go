@@ -0,0 +1,108 @@
+package main
+
+// Teaching mode
+//
+// -teach writes a companion image next to the output, NAME.teach.png, for slides and tutorials: the same grid with
+// cells of teachCellsize pixels, each labeled with its three channels, one line per channel in a 3x5 bitmap font.
+// Program cells show the mnemonics of their tokens and the values of their push literals, the header and extension
+// cells show their raw values. The companion image is not executable, the image in the output file stays the same.
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+)
+
+// Cell size of the companion image
+const teachCellsize = 48
+
+// Pixels of a font pixel
+const glyphScale = 2
+
+// glyphs is a 3x5 font, every glyph is 5 rows of 3 pixels separated by spaces, lower case letters are drawn as
+// upper case
+var glyphs = map[rune]string{
+	'A': ".#. #.# ### #.# #.#", 'B': "##. #.# ##. #.# ##.", 'C': ".## #.. #.. #.. .##", 'D': "##. #.# #.# #.# ##.",
+	'E': "### #.. ##. #.. ###", 'F': "### #.. ##. #.. #..", 'G': ".## #.. #.# #.# .##", 'H': "#.# #.# ### #.# #.#",
+	'I': "### .#. .#. .#. ###", 'J': "..# ..# ..# #.# .#.", 'K': "#.# #.# ##. #.# #.#", 'L': "#.. #.. #.. #.. ###",
+	'M': "#.# ### ### #.# #.#", 'N': "##. #.# #.# #.# #.#", 'O': ".#. #.# #.# #.# .#.", 'P': "##. #.# ##. #.. #..",
+	'Q': ".#. #.# #.# ##. .##", 'R': "##. #.# ##. #.# #.#", 'S': ".## #.. .#. ..# ##.", 'T': "### .#. .#. .#. .#.",
+	'U': "#.# #.# #.# #.# ###", 'V': "#.# #.# #.# #.# .#.", 'W': "#.# #.# ### ### #.#", 'X': "#.# #.# .#. #.# #.#",
+	'Y': "#.# #.# .#. .#. .#.", 'Z': "### ..# .#. #.. ###", '0': "### #.# #.# #.# ###", '1': ".#. ##. .#. .#. ###",
+	'2': "##. ..# .#. #.. ###", '3': "##. ..# .#. ..# ##.", '4': "#.# #.# ### ..# ..#", '5': "### #.. ##. ..# ##.",
+	'6': ".## #.. ### #.# ###", '7': "### ..# .#. .#. .#.", '8': "### #.# ### #.# ###", '9': "### #.# ### ..# ##.",
+	'.': "... ... ... ... .#.", '-': "... ... ### ... ...", '_': "... ... ... ... ###", '?': "##. ..# .#. ... .#.",
+}
+
+// teachName returns the name of the companion image of the output file
+func teachName(outputfile string) string {
+	if dot := strings.LastIndex(outputfile, "."); dot > strings.LastIndexAny(outputfile, `/\`) {
+		outputfile = outputfile[:dot]
+	}
+	return outputfile + ".teach.png"
+}
+
+// drawText draws the text with its top left corner at x, y
+func drawText(img *image.RGBA, x int, y int, text string, ink color.RGBA) {
+	for _, r := range strings.ToUpper(text) {
+		glyph, ok := glyphs[r]
+		if !ok {
+			glyph = glyphs['?']
+		}
+		for i, pixel := range strings.ReplaceAll(glyph, " ", "") {
+			if pixel != '#' {
+				continue
+			}
+			px, py := x+(i%3)*glyphScale, y+(i/3)*glyphScale
+			draw.Draw(img, image.Rect(px, py, px+glyphScale, py+glyphScale), image.NewUniform(ink), image.Point{}, draw.Src)
+		}
+		x += 4 * glyphScale
+	}
+}
+
+// cellLabels returns the three lines of the k-th cell of the image
+func (c compiled) cellLabels(k int, cell color.RGBA) [3]string {
+	channels := [3]uint8{cell.R, cell.G, cell.B}
+	var labels [3]string
+	for i, value := range channels {
+		if k >= 2 && k < c.progline+2 {
+			labels[i] = mnemonic(value)
+		} else {
+			labels[i] = strconv.Itoa(int(value))
+		}
+	}
+	return labels
+}
+
+// renderTeaching draws the companion image with the labeled cells
+func renderTeaching(c compiled) *image.RGBA {
+	colors := c.cellColors(c.opts.cellsize)
+	maxX, maxY := layout(len(colors))
+	img := image.NewRGBA(image.Rect(0, 0, maxX*teachCellsize, maxY*teachCellsize))
+	border := color.RGBA{R: 64, G: 64, B: 64, A: 255}
+	for k, cell := range colors {
+		x, y := (k%maxX)*teachCellsize, (k/maxX)*teachCellsize
+		rect := image.Rect(x, y, x+teachCellsize, y+teachCellsize)
+		draw.Draw(img, rect, image.NewUniform(border), image.Point{}, draw.Src)
+		draw.Draw(img, rect.Inset(1), image.NewUniform(cell), image.Point{}, draw.Src)
+		// Dark text on light cells, light text on dark ones
+		ink := color.RGBA{A: 255}
+		if 299*int(cell.R)+587*int(cell.G)+114*int(cell.B) < 128000 {
+			ink = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+		}
+		for line, label := range c.cellLabels(k, cell) {
+			drawText(img, x+4, y+5+line*14, label, ink)
+		}
+	}
+	return img
+}
+
+// writeTeaching writes the companion image of the output file
+func writeTeaching(c compiled, outputfile string) error {
+	name := teachName(outputfile)
+	c.opts.logMsg(fmt.Sprint("Creating teaching image: ", name))
+	return encodeFile(name, renderTeaching(c))
+}
@@ -0,0 +1,455 @@
+package main
+
+// Conformance checks of images, with "pollock validate image.png..."
+//
+// validate checks PNG images against the format definition at the top of pollock.go, for the authors of other
+// encoders: the header cell, the cell size against the size of the image, the program size cell against the cells
+// of the image, the tokens of the program cells, the extension cells and the features cell (see features.go), the
+// grid layout, the Pollock chunks and the colors of the cells. Every pixel of a cell must have the color of its
+// center pixel, but the grid lines of -grid, and the patterns of -palette, which keep the first and the center
+// pixels of the program cells and are reported as warnings. With the art extension cell (kind 4) only the center
+// pixels of the program cells and the empty cells are checked. The report lists the rules with their problems, an
+// image which fails any rule fails the command.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image/color"
+	"image/png"
+	"log"
+	"os"
+	"strings"
+)
+
+// The rules of the format, in the order they are checked and reported
+var formatRules = []string{"header", "cell size", "program size", "tokens", "extensions", "layout", "chunks", "cell colors"}
+
+// Newest minor format version
+const latestMinor = 1
+
+// Most problems listed for a rule
+const maxProblems = 5
+
+// rule is the outcome of a rule of the format on an image, its problems are warnings unless it failed
+type rule struct {
+	name     string
+	checked  bool
+	failed   bool
+	detail   string
+	problems []string
+}
+
+// conformance is the report of an image
+type conformance struct {
+	rules []rule
+}
+
+func newConformance() *conformance {
+	r := &conformance{}
+	for _, name := range formatRules {
+		r.rules = append(r.rules, rule{name: name})
+	}
+	return r
+}
+
+// rule returns the rule of the name, which is checked from then on
+func (r *conformance) rule(name string) *rule {
+	for i := range r.rules {
+		if r.rules[i].name == name {
+			r.rules[i].checked = true
+			return &r.rules[i]
+		}
+	}
+	panic("unknown rule " + name)
+}
+
+// pass records what the rule found
+func (r *conformance) pass(name string, detail string) {
+	r.rule(name).detail = detail
+}
+
+// fail records a problem breaking the rule
+func (r *conformance) fail(name string, problem string) {
+	rl := r.rule(name)
+	rl.failed = true
+	rl.problems = append(rl.problems, problem)
+}
+
+// warn records a problem which doesn't break the rule
+func (r *conformance) warn(name string, problem string) {
+	rl := r.rule(name)
+	rl.problems = append(rl.problems, problem)
+}
+
+// conforms tells if the image breaks no rule
+func (r *conformance) conforms() bool {
+	for _, rl := range r.rules {
+		if rl.failed {
+			return false
+		}
+	}
+	return true
+}
+
+// write prints the report of the image of the name
+func (r *conformance) write(name string) {
+	if r.conforms() {
+		fmt.Printf("\"%s\": conforms\n", name)
+	} else {
+		fmt.Printf("\"%s\": does not conform\n", name)
+	}
+	for _, rl := range r.rules {
+		status := "ok"
+		switch {
+		case !rl.checked:
+			status = "skipped"
+		case rl.failed:
+			status = "FAIL"
+		case len(rl.problems) > 0:
+			status = "warning"
+		}
+		line := fmt.Sprintf("  %-8s %s", status, rl.name)
+		if len(rl.detail) > 0 {
+			line += ": " + rl.detail
+		}
+		fmt.Println(line)
+		for i, problem := range rl.problems {
+			if i == maxProblems {
+				fmt.Println("           ... and", len(rl.problems)-maxProblems, "more")
+				break
+			}
+			fmt.Println("          ", problem)
+		}
+	}
+}
+
+// cellName is the name of the k-th cell in the report, with its channel if it is 0 to 2
+func cellName(k int, channel int) string {
+	if channel < 0 {
+		return fmt.Sprint("cell ", k)
+	}
+	return fmt.Sprint("cell ", k, " ", colChannel(channel))
+}
+
+// validateImage checks the encoded image against the rules of the format
+func validateImage(data []byte) *conformance {
+	r := newConformance()
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		r.fail("header", fmt.Sprint("not a PNG image: ", err))
+		return r
+	}
+	chunks, err := readChunks(data)
+	if err != nil {
+		r.fail("header", fmt.Sprint("invalid PNG chunks: ", err))
+		return r
+	}
+	img = srgbImage(img, chunks)
+	img, moved := orient(img)
+	bounds := img.Bounds()
+	pixel := func(x int, y int) color.NRGBA {
+		return color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+	}
+
+	header := pixel(0, 0)
+	if header.R != VMAJOR || header.G > latestMinor {
+		r.fail("header", fmt.Sprint("unsupported format version ", header.R, ".", header.G))
+		return r
+	}
+	minor, stated := int(header.G), int(header.B)
+	if header.A != 255 {
+		r.fail("header", "the header cell is not opaque")
+	}
+	cellsize := measureCellsize(img, stated)
+	if stated == 0 {
+		// Cell sizes over 255 are in their extension cell
+		if stated, cellsize = extendedCellsize(img); cellsize == 0 {
+			r.pass("header", fmt.Sprint("format ", VMAJOR, ".", minor, ", cell size 0"))
+			r.fail("cell size", "no cell size extension cell matches the cells of the image")
+			return r
+		}
+	}
+	if stated < minCellsize || stated > maxCellsize {
+		r.warn("header", fmt.Sprint("the cell size ", stated, " is out of the ", minCellsize, "-", maxCellsize, " range of the compiler"))
+	}
+	if len(moved) > 0 {
+		r.warn("header", fmt.Sprint("the image was ", moved, ", it is read in its original orientation"))
+	}
+	r.pass("header", fmt.Sprint("format ", VMAJOR, ".", minor, ", cell size ", stated))
+
+	if cellsize == 0 {
+		r.fail("cell size", fmt.Sprint("the image of ", bounds.Dx(), "x", bounds.Dy(), " pixels is no grid of cells of ", stated, " pixels"))
+		return r
+	}
+	if cellsize != stated {
+		r.warn("cell size", fmt.Sprint("the image was resized, its cells are ", cellsize, " pixels instead of ", stated))
+	}
+	maxX, maxY := bounds.Dx()/cellsize, bounds.Dy()/cellsize
+	r.pass("cell size", fmt.Sprint(bounds.Dx(), "x", bounds.Dy(), " pixels, ", maxX, " by ", maxY, " cells"))
+
+	if maxX*maxY < 2 {
+		r.fail("program size", "the image has no program size cell")
+		return r
+	}
+	size := cellAt(img, 1, maxX, cellsize)
+	progline := int(size.R)<<16 | int(size.G)<<8 | int(size.B)
+	if size.A != 255 {
+		r.fail("program size", "the program size cell is not opaque")
+	}
+	if progline+2 > maxX*maxY {
+		r.fail("program size", fmt.Sprint(progline, " program cells don't fit in the ", maxX*maxY, " cells of the image"))
+		return r
+	}
+	r.pass("program size", fmt.Sprint(progline, " program cells"))
+
+	var program progarray
+	repeats := 0
+	for k := 2; k < progline+2; k++ {
+		cell := cellAt(img, k, maxX, cellsize)
+		program.r = append(program.r, cell.R)
+		program.g = append(program.g, cell.G)
+		program.b = append(program.b, cell.B)
+		if cell.A != 255 {
+			r.fail("tokens", fmt.Sprint(cellName(k, -1), " is not opaque"))
+		}
+		if cell.R == repeatToken {
+			// Repeat cell of -rle, which holds a count
+			repeats++
+			switch {
+			case minor < 1:
+				r.fail("tokens", fmt.Sprint("repeat ", cellName(k, -1), " needs format 1.1"))
+			case k == 2:
+				r.fail("tokens", fmt.Sprint("repeat ", cellName(k, -1), " has no program cell before it"))
+			case cell.G == 0 && cell.B == 0:
+				r.fail("tokens", fmt.Sprint("repeat ", cellName(k, -1), " has a count of 0"))
+			}
+			continue
+		}
+		for channel, token := range [3]uint8{cell.R, cell.G, cell.B} {
+			name := mnemonic(token)
+			if strings.HasPrefix(name, "0x") {
+				r.fail("tokens", fmt.Sprint(cellName(k, channel), ": ", name, " is no instruction"))
+			} else if tokenMinor(token) > minor {
+				r.fail("tokens", fmt.Sprint(cellName(k, channel), ": ", name, " needs format ", VMAJOR, ".", tokenMinor(token)))
+			}
+		}
+	}
+	detail := fmt.Sprint(3*(progline-repeats), " tokens")
+	if repeats > 0 {
+		detail += fmt.Sprint(", ", repeats, " repeat cells")
+	}
+	r.pass("tokens", detail)
+
+	// The extension cells follow the program up to the first cell of kind 0
+	extensions := progline + 2
+	art, features := 0, 0
+	kinds := make(map[uint8]int)
+	for ; extensions < maxX*maxY; extensions++ {
+		cell := cellAt(img, extensions, maxX, cellsize)
+		if cell.A == 0 || cell.R == 0 {
+			break
+		}
+		k, value := extensions, int(cell.G)<<8|int(cell.B)
+		if minor < 1 {
+			r.fail("extensions", fmt.Sprint("extension ", cellName(k, -1), " needs format 1.1"))
+		}
+		if cell.A != 255 {
+			r.fail("extensions", fmt.Sprint("extension ", cellName(k, -1), " is not opaque"))
+		}
+		if kinds[cell.R] > 0 && cell.R != extShuffle {
+			r.fail("extensions", fmt.Sprint("extension ", cellName(k, -1), " repeats kind ", cell.R))
+		}
+		kinds[cell.R]++
+		switch cell.R {
+		case extWordSize:
+			if value != 16 && value != 32 {
+				r.fail("extensions", fmt.Sprint("extension ", cellName(k, -1), ": word size ", value, " is not 16 or 32"))
+			}
+		case extEntry:
+			if value < 2 || value >= progline+2 {
+				r.fail("extensions", fmt.Sprint("extension ", cellName(k, -1), ": entry ", value, " is not a program cell"))
+			}
+		case extShuffle:
+		case extArt:
+			if value == 0 || value&^(artJitter|artBackground|artFiller) != 0 {
+				r.fail("extensions", fmt.Sprint("extension ", cellName(k, -1), ": unknown painting modes ", value))
+			}
+			art = value
+		case extCellsize:
+			if header.B != 0 || value <= maxHeaderCellsize {
+				r.fail("extensions", fmt.Sprint("cell size ", cellName(k, -1), ": cell size ", value, " fits in the header cell"))
+			}
+		case extOrientation:
+			if value != orientationMark {
+				r.fail("extensions", fmt.Sprint("orientation ", cellName(k, -1), ": ", value, " is not the orientation mark ", orientationMark))
+			}
+		case extFeatures:
+			if k != progline+2 {
+				r.warn("extensions", fmt.Sprint("features ", cellName(k, -1), " is not the first extension cell"))
+			}
+			if unknown := value &^ knownFeatures; unknown != 0 {
+				r.fail("extensions", fmt.Sprint("features ", cellName(k, -1), ": unsupported features ", featureList(unknown)))
+			}
+			features = value
+		default:
+			r.fail("extensions", fmt.Sprint("extension ", cellName(k, -1), " has the unknown kind ", cell.R))
+		}
+	}
+	if kinds[extShuffle] > 0 && kinds[extShuffle] != shuffleCells {
+		r.fail("extensions", fmt.Sprint(kinds[extShuffle], " shuffle cells instead of ", shuffleCells))
+	}
+	used := 0
+	if kinds[extWordSize] > 0 {
+		used |= featureWideWords
+	}
+	if repeats > 0 {
+		used |= featureRepeats
+	}
+	if kinds[extShuffle] > 0 {
+		used |= featureShuffled
+	}
+	switch {
+	case kinds[extFeatures] == 0 && used != 0:
+		// Written before the features cell
+		r.warn("extensions", fmt.Sprint("no features cell for the ", featureList(used)))
+	case used&^features != 0:
+		r.fail("extensions", fmt.Sprint("the features cell leaves out the ", featureList(used&^features)))
+	case features&knownFeatures&^used != 0:
+		r.warn("extensions", fmt.Sprint("the features cell has the unused ", featureList(features&knownFeatures&^used)))
+	}
+	r.pass("extensions", fmt.Sprint(extensions-progline-2, " extension cells"))
+
+	for k := extensions; k < maxX*maxY; k++ {
+		if cell := cellAt(img, k, maxX, cellsize); cell.A != 0 {
+			r.fail("layout", fmt.Sprint("empty ", cellName(k, -1), " is not transparent"))
+		}
+	}
+	if x, y := layout(extensions); x != maxX || y != maxY {
+		r.fail("layout", fmt.Sprint(maxX, " by ", maxY, " cells instead of ", x, " by ", y, " for ", extensions, " cells"))
+	}
+	r.pass("layout", fmt.Sprint(extensions, " cells, ", maxX*maxY-extensions, " empty"))
+
+	c := compiled{progline: progline}
+	if minor >= 1 {
+		if err := program.expandRuns(); err == nil {
+			c.progline = len(program.r)
+		}
+	}
+	if err := c.readTables(chunks); err != nil {
+		r.fail("chunks", err.Error())
+	}
+	var found []string
+	for _, chunk := range []struct{ name, table string }{{"plEx", "exports"}, {"plSy", "symbols"}, {"plRl", "relocations"}, {"plSg", "signature"}} {
+		if _, ok := chunks[chunk.name]; ok {
+			found = append(found, chunk.table)
+		}
+	}
+	if len(found) == 0 {
+		found = []string{"none"}
+	}
+	r.pass("chunks", strings.Join(found, ", "))
+
+	validateColors(r, pixel, maxX*maxY, maxX, cellsize, max(cellsize/stated, 1), progline, extensions, art)
+	return r
+}
+
+// validateColors checks that the pixels of every cell have the color of its center pixel, but the grid lines as
+// wide as band, the patterns of -palette and the painted cells
+func validateColors(r *conformance, pixel func(int, int) color.NRGBA, cells int, maxX int, cellsize int, band int, progline int, extensions int, art int) {
+	// The grid lines cover the last pixels of the first row of the header cell
+	grid := pixel(cellsize-1, 0)
+	gridded := cellsize >= gridMinCellsize && grid != pixel(0, 0)
+	patterned := 0
+	for k := 0; k < cells; k++ {
+		program := k >= 2 && k < progline+2
+		if art != 0 && (program || k >= extensions) {
+			continue
+		}
+		left, top := (k%maxX)*cellsize, (k/maxX)*cellsize
+		center := pixel(left+cellsize/2, top+cellsize/2)
+		uniform, lines, pattern := true, true, false
+		for j := 0; j < cellsize; j++ {
+			for i := 0; i < cellsize; i++ {
+				p := pixel(left+i, top+j)
+				if gridded && k < extensions && (i >= cellsize-band || j >= cellsize-band) {
+					lines = lines && p == grid
+				} else if p != center {
+					// The patterns keep the first pixel
+					if program && i+j > 0 {
+						pattern = true
+					} else {
+						uniform = false
+					}
+				}
+			}
+		}
+		if uniform && pattern {
+			patterned++
+		}
+		if !uniform {
+			r.fail("cell colors", fmt.Sprint(cellName(k, -1), " is not uniform"))
+		}
+		if !lines {
+			r.fail("cell colors", fmt.Sprint(cellName(k, -1), " has broken grid lines"))
+		}
+	}
+	if patterned > 0 {
+		r.warn("cell colors", fmt.Sprint(patterned, " program cells have patterns, only their first and center pixels are code"))
+	}
+	var detail []string
+	if gridded {
+		detail = append(detail, "grid lines")
+	}
+	if patterned > 0 {
+		detail = append(detail, "patterns")
+	}
+	if art != 0 {
+		detail = append(detail, "painted cells, only their center pixels are code")
+	}
+	if len(detail) == 0 {
+		detail = []string{"flat cells"}
+	}
+	r.pass("cell colors", strings.Join(detail, ", "))
+}
+
+// registerValidate registers the flags of the validate subcommand
+func registerValidate(flags *flag.FlagSet) {
+	flags.BoolVar(&silent, "s", false, "Run in silent mode, default is false")
+}
+
+// validate prints the conformance reports of the images and returns the exit code of the first failure
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	registerValidate(flags)
+	flags.Parse(args)
+	err := applyEnv(flags)
+	if err == nil && flags.NArg() == 0 {
+		err = usageError("Fatal error: At least one image is needed.")
+	}
+	if err != nil {
+		log.Println(err)
+		return exitCode(err)
+	}
+
+	status := exitOK
+	for _, name := range flags.Args() {
+		data, err := os.ReadFile(name)
+		if err == nil {
+			r := validateImage(data)
+			r.write(name)
+			if !r.conforms() {
+				err = verifyError(fmt.Sprint("Fatal error: \"", name, "\" does not conform to the Pollock format."))
+			}
+		} else {
+			err = ioError(fmt.Sprint("Fatal error: \"", err, "\""))
+		}
+		if err != nil {
+			log.Println(err)
+			if status == exitOK {
+				status = exitCode(err)
+			}
+		}
+	}
+	return status
+}
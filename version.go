@@ -0,0 +1,96 @@
+package main
+
+// Self-description, with "pollock -version"
+//
+// Prints the semantic version of the compiler, the format versions and word sizes it supports and the fingerprint
+// of its instruction set. The fingerprint is the sha256 of the opcode table, the mnemonic, the token, the format
+// version and the stack effect of every instruction, the push literals included, one line each in token order, and
+// of the expansions of the pseudo-instructions: a sample of each, the wide pushes, pusha LABEL, the fused jumps, the
+// immediates, hostcall N and the string literals, is expanded for every format version and word size. Two builds
+// with the same fingerprint turn every program into the same tokens, so a bug report or a decoder can check which
+// instruction set an image was written with. The descriptions of the instructions are not part of it, nor are the
+// -O optimizations, which only run on request.
+//
+// The version is VMAJOR, the newest format version the compiler writes and the release within it, so it changes
+// with the formats.
+//
+//	pollock 1.1.0
+//	Format versions: 1.0, 1.1
+//	Word sizes: 8, 16, 32
+//	Instruction set: 62 opcodes, sha256:63b01ff0771e0aa7...
+//	Built with go1.27.1 for linux/amd64
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Newest minor format version the compiler writes, and the release of the compiler for it
+const (
+	newestMinor = 1
+	release     = 0
+)
+
+// Semantic version of the compiler
+var version = fmt.Sprint(VMAJOR, ".", newestMinor, ".", release)
+
+// Word sizes the compiler compiles for
+var wordSizes = []int{8, 16, 32}
+
+// Samples of the pseudo-instructions whose expansions are part of the fingerprint, as the lexer passes them
+var expansionSamples = []string{
+	"push200", "push-5", "push70000", "push'\u00e9'", "pushaLOOP", "jeqL", "jltL", "jgtL",
+	"addi2", "subi5", "muli3", "hostcall3", `push"ab"`, `pushs"ab"`, `pushl"ab"`,
+}
+
+// formatVersions returns the format versions the compiler writes
+func formatVersions() []string {
+	var versions []string
+	for minor := 0; minor <= newestMinor; minor++ {
+		versions = append(versions, fmt.Sprint(VMAJOR, ".", minor))
+	}
+	return versions
+}
+
+// opcodeFingerprint returns the hex sha256 of the instruction set and the number of its opcodes
+func opcodeFingerprint() (string, int) {
+	ops := slices.Clone(opcodes)
+	slices.SortFunc(ops, func(a opcode, b opcode) int { return cmp.Compare(a.token, b.token) })
+	hash := sha256.New()
+	fmt.Fprintln(hash, "0x00-0x7F", pushLiteral.name, pushLiteral.effect, 0)
+	for _, op := range ops {
+		fmt.Fprintf(hash, "0x%02X %s %s %d\n", op.token, op.name, op.effect, tokenMinor(op.token))
+	}
+	for minor := 0; minor <= newestMinor; minor++ {
+		for _, wordsize := range wordSizes {
+			for _, sample := range expansionSamples {
+				instrs, err := expand([]byte(sample), minor, wordsize)
+				fmt.Fprintln(hash, minor, wordsize, sample, string(bytes.Join(instrs, []byte(" "))), err != nil)
+			}
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), len(ops)
+}
+
+// versionText returns the self-description printed by -version
+func versionText() string {
+	fingerprint, count := opcodeFingerprint()
+	sizes := make([]string, len(wordSizes))
+	for i, size := range wordSizes {
+		sizes[i] = strconv.Itoa(size)
+	}
+	var text strings.Builder
+	fmt.Fprintln(&text, "pollock", version)
+	fmt.Fprintln(&text, "Format versions:", strings.Join(formatVersions(), ", "))
+	fmt.Fprintln(&text, "Word sizes:", strings.Join(sizes, ", "))
+	fmt.Fprint(&text, "Instruction set: ", count, " opcodes, sha256:", fingerprint, "\n")
+	fmt.Fprint(&text, "Built with ", runtime.Version(), " for ", runtime.GOOS, "/", runtime.GOARCH, "\n")
+	return text.String()
+}